@@ -41,7 +41,7 @@ func apvmRefreshFirewallHandler(ctx *server.CommandContext) interface{} {
 	for _, rule := range cmd.Rules {
 		var nicname string
 		if rule.DestIp != "" {
-			nicname, err = utils.GetNicNameByIp(rule.DestIp); utils.PanicOnError(err)
+			nicname, err = server.GetNicNameByIp(rule.DestIp); utils.PanicOnError(err)
 		} else {
 			nicname = func() string {
 				for _, nic := range nics {
@@ -68,18 +68,14 @@ func apvmRefreshFirewallHandler(ctx *server.CommandContext) interface{} {
 			rs := make([]string, 0)
 
 			if rule.SourceIp != "" {
-				rs = append(rs, fmt.Sprintf("source address %v/32", rule.SourceIp))
+				rs = append(rs, server.ConfigPath("source", "address", rule.SourceIp + "/32"))
 			}
 
 			if rule.DestIp != "" {
-				rs = append(rs, fmt.Sprintf("destination address %v/32", rule.DestIp))
+				rs = append(rs, server.ConfigPath("destination", "address", rule.DestIp + "/32"))
 			}
 
-			if rule.StartPort == rule.EndPort {
-				rs = append(rs, fmt.Sprintf("destination port %v", rule.StartPort))
-			} else {
-				rs = append(rs, fmt.Sprintf("destination port %v-%v", rule.StartPort, rule.EndPort))
-			}
+			rs = append(rs, server.ConfigPath("destination", "port", portRange(rule.StartPort, rule.EndPort)))
 			rs = append(rs, "state new enable")
 
 			if rule.Protocol == "all" {
@@ -0,0 +1,36 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+	"zvr/server"
+	"zvr/utils"
+)
+
+type batchTestEntry struct {
+	Path string `json:"path"`
+	Body interface{} `json:"body"`
+}
+
+func TestSimulatedBatch(t *testing.T) {
+	a, stop := startSimulatedAgent(t)
+	defer stop()
+
+	// the vip is set by the first entry, the EIP of the second finds its nic in the batch tree
+	vip := vipInfo{ Ip: "172.20.14.210", Netmask: "255.255.0.0", OwnerEthernetMac: "fa:62:6b:d9:10:00" }
+	eip := eipInfo{ VipIp: vip.Ip, PrivateMac: "fa:62:6b:d9:10:01", GuestIp: "10.0.0.12" }
+	batch := map[string]interface{}{ "entries": []batchTestEntry{
+		{ Path: VR_CREATE_VIP, Body: setVipCmd{ Vips: []vipInfo{ vip } } },
+		{ Path: VR_CREATE_EIP, Body: setEipCmd{ Eip: eip } },
+	} }
+
+	rsp := struct {
+		server.CommandResponseHeader
+		Results []json.RawMessage `json:"results"`
+	}{}
+	a.call(server.BATCH_PATH, false, batch, &rsp)
+	utils.Assertf(rsp.Success && len(rsp.Results) == 2, "the batch failed, %s", rsp.Error)
+	utils.Assertf(a.backend.Commits() == 1, "the batch is committed %v times", a.backend.Commits())
+	utils.Assertf(a.running().Has("interfaces ethernet eth0 address 172.20.14.210/16"), "the vip is not committed:\n%s", a.backend.ShowConfiguration())
+	assertEipCommitted(a, eip, true)
+}
@@ -33,20 +33,59 @@ type removeDhcpCmd struct {
 	DhcpEntries []dhcpInfo `json:"dhcpEntries"`
 }
 
+// the hostname and the domain are written into the config of dhcpd
+func (info dhcpInfo) validate() {
+	utils.AssertIpArgument("ip", info.Ip)
+	utils.AssertMacArgument("mac", info.Mac)
+	utils.AssertNetmaskArgument("netmask", info.Netmask)
+	utils.AssertMacArgument("vrNicMac", info.VrNicMac)
+	if info.Gateway != "" {
+		utils.AssertIpArgument("gateway", info.Gateway)
+	}
+	for _, dns := range info.Dns {
+		utils.AssertIpArgument("dns", dns)
+	}
+	if info.Hostname != "" {
+		utils.AssertHostnameArgument("hostname", info.Hostname)
+	}
+	if info.DnsDomain != "" {
+		utils.AssertHostnameArgument("dnsDomain", info.DnsDomain)
+	}
+}
+
+func validateDhcpEntries(infos []dhcpInfo) {
+	for _, info := range infos {
+		info.validate()
+	}
+}
+
 func addDhcpHandler(ctx *server.CommandContext) interface{} {
 	cmd := &addDhcpCmd{}
 	ctx.GetCommand(cmd)
+	validateDhcpEntries(cmd.DhcpEntries)
+	ctx.LockResources(dhcpResources(cmd.DhcpEntries)...)
 
 	if cmd.rebuild {
-		deleteDhcp(cmd.DhcpEntries)
-		setDhcp(cmd.DhcpEntries)
+		deleteDhcp(ctx, cmd.DhcpEntries)
+		setDhcp(ctx, cmd.DhcpEntries)
 	} else {
-		setDhcp(cmd.DhcpEntries)
+		setDhcp(ctx, cmd.DhcpEntries)
 	}
 
 	return nil
 }
 
+// the dhcp server and the local firewall of the nics it serves
+func dhcpResources(infos []dhcpInfo) []string {
+	rs := []string{ server.RESOURCE_DHCP }
+	for _, info := range infos {
+		nicname, err := server.GetNicNameByMac(info.VrNicMac); utils.PanicOnError(err)
+		rs = append(rs, server.FirewallResource(nicname, "local"), server.InterfaceFirewallResource(nicname, "local"))
+	}
+
+	return rs
+}
+
 func makeLanName(nicname string) string {
 	return fmt.Sprintf("%s_subnet", nicname)
 }
@@ -55,13 +94,23 @@ func makeServerName(mac string) string {
 	return strings.Replace(mac, ":", "_", -1)
 }
 
-func makeDhcpFirewallRuleDescription(netname string) string {
-	return fmt.Sprintf("DHCP-for-%s", netname)
+// bumped when the firewall rules of the DHCP are changed
+const DHCP_RULE_VERSION = 1
+
+func makeDhcpFirewallRuleOwner(netname string) server.RuleOwner {
+	return server.RuleOwner{ Feature: server.RULE_FEATURE_DHCP, Resource: netname, Version: DHCP_RULE_VERSION }
 }
 
-func setDhcp(infos []dhcpInfo) {
-	parser := server.NewParserFromShowConfiguration()
+// DHCP-for-<netname>
+func parseLegacyDhcpDescription(des string) (string, string, bool) {
+	if strings.HasPrefix(des, "DHCP-for-") {
+		return strings.TrimPrefix(des, "DHCP-for-"), "", true
+	}
+	return "", "", false
+}
 
+// the pid file of dhcpd is kept without side effects, e.g. in a dry run
+func setDhcp(ctx *server.CommandContext, infos []dhcpInfo) {
 	macs := make(map[string]dhcpInfo)
 	for _, info := range infos {
 		macs[info.VrNicMac] = info
@@ -69,29 +118,31 @@ func setDhcp(infos []dhcpInfo) {
 
 	subnetNames := make(map[string]string)
 
-	tree := parser.Tree
+	tree := ctx.ConfigTree()
 	for vrMac, info := range macs {
 		netName, subnet, nicname := infoToNetNameAndSubnet(info)
 		subnetNames[vrMac] = netName
 
-		tree.Setf("service dhcp-server shared-network-name %s authoritative enable", netName)
+		tree.SetPath("service", "dhcp-server", "shared-network-name", netName, "authoritative", "enable")
 
 		// DHCPD requires at least one lease rule in the configuration
 		// We use the gateway as the default lease
 		serverName := makeServerName(info.VrNicMac)
-		tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s ip-address %s", netName, subnet, serverName, info.Gateway)
-		tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s mac-address %s", netName, subnet, serverName, info.VrNicMac)
+		tree.SetPath("service", "dhcp-server", "shared-network-name", netName, "subnet", subnet, "static-mapping", serverName, "ip-address", info.Gateway)
+		tree.SetPath("service", "dhcp-server", "shared-network-name", netName, "subnet", subnet, "static-mapping", serverName, "mac-address", strings.ToLower(info.VrNicMac))
 
-		des := makeDhcpFirewallRuleDescription(netName)
-		if r := tree.FindFirewallRuleByDescription(nicname, "local", des); r == nil {
+		owner := makeDhcpFirewallRuleOwner(netName)
+		if r := tree.FindFirewallRuleByOwner(nicname, "local", owner); r == nil {
 			tree.SetFirewallOnInterface(nicname, "local",
-				fmt.Sprintf("description %v", des),
+				server.ConfigPath("description", owner.Description()),
 				"destination port 67-68",
 				"protocol tcp_udp",
 				"action accept",
 			)
 
 			tree.AttachFirewallToInterface(nicname, "local")
+		} else {
+			tree.SetRuleOwner(r, owner)
 		}
 	}
 
@@ -99,32 +150,32 @@ func setDhcp(infos []dhcpInfo) {
 		netName := subnetNames[info.VrNicMac]
 		subnet, err := utils.GetNetworkNumber(info.Ip, info.Netmask); utils.PanicOnError(err)
 		serverName := makeServerName(info.Mac)
-		tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s ip-address %s", netName, subnet, serverName, info.Ip)
-		tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s mac-address %s", netName, subnet, serverName, strings.ToLower(info.Mac))
-		tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s static-mapping-parameters \"%s\"",
-			netName, subnet, serverName, fmt.Sprintf("option subnet-mask %s;", info.Netmask))
+		tree.SetPath("service", "dhcp-server", "shared-network-name", netName, "subnet", subnet, "static-mapping", serverName, "ip-address", info.Ip)
+		tree.SetPath("service", "dhcp-server", "shared-network-name", netName, "subnet", subnet, "static-mapping", serverName, "mac-address", strings.ToLower(info.Mac))
+		// the hostname and the domain are from the users, they're set as words
+		param := func(p string) {
+			tree.AddValuePath("service", "dhcp-server", "shared-network-name", netName, "subnet", subnet,
+				"static-mapping", serverName, "static-mapping-parameters", p)
+		}
+		param(fmt.Sprintf("option subnet-mask %s;", info.Netmask))
 
 		if info.IsDefaultL3Network {
 			if info.Hostname != "" {
-				tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s static-mapping-parameters \"%s\"",
-					netName, subnet, serverName, fmt.Sprintf("option host-name &quot;%s&quot;;", info.Hostname))
+				param(fmt.Sprintf("option host-name &quot;%s&quot;;", info.Hostname))
 			}
 			if info.Dns != nil {
-				tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s static-mapping-parameters \"%s\"",
-					netName, subnet, serverName, fmt.Sprintf("option domain-name-servers %s;", strings.Join(info.Dns, ",")))
+				param(fmt.Sprintf("option domain-name-servers %s;", strings.Join(info.Dns, ",")))
 			}
 			if info.Gateway != "" {
-				tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s static-mapping-parameters \"%s\"",
-					netName, subnet, serverName, fmt.Sprintf("option routers %s;", info.Gateway))
+				param(fmt.Sprintf("option routers %s;", info.Gateway))
 			}
 			if info.DnsDomain != "" {
-				tree.Setf("service dhcp-server shared-network-name %s subnet %s static-mapping %s static-mapping-parameters \"%s\"",
-					netName, subnet, serverName, fmt.Sprintf("option domain-name &quot;%s&quot;;", info.DnsDomain))
+				param(fmt.Sprintf("option domain-name &quot;%s&quot;;", info.DnsDomain))
 			}
 		}
 	}
 
-	if tree.HasChanges() {
+	if tree.HasChanges() && ctx.HasSideEffects() {
 		deleteDhcpdPIDFile()
 	}
 
@@ -145,23 +196,22 @@ func deleteDhcpdPIDFile() {
 }
 
 func infoToNetNameAndSubnet(info dhcpInfo) (string, string, string) {
-	nicname, err := utils.GetNicNameByMac(info.VrNicMac); utils.PanicOnError(err)
+	nicname, err := server.GetNicNameByMac(info.VrNicMac); utils.PanicOnError(err)
 	subnet, err := utils.GetNetworkNumber(info.Ip, info.Netmask); utils.PanicOnError(err)
 
 	return makeLanName(nicname), subnet, nicname
 }
 
-func deleteDhcp(infos []dhcpInfo) {
-	parser := server.NewParserFromShowConfiguration()
-	tree := parser.Tree
+func deleteDhcp(ctx *server.CommandContext, infos []dhcpInfo) {
+	tree := ctx.ConfigTree()
 
 	for _, info := range infos {
 		netName, subnet, _ := infoToNetNameAndSubnet(info)
 		serverName := makeServerName(info.Mac)
-		tree.Deletef("service dhcp-server shared-network-name %s subnet %s static-mapping %s", netName, subnet, serverName)
+		tree.DeletePath("service", "dhcp-server", "shared-network-name", netName, "subnet", subnet, "static-mapping", serverName)
 	}
 
-	if tree.HasChanges() {
+	if tree.HasChanges() && ctx.HasSideEffects() {
 		deleteDhcpdPIDFile()
 	}
 
@@ -171,8 +221,9 @@ func deleteDhcp(infos []dhcpInfo) {
 func removeDhcpHandler(ctx *server.CommandContext) interface{} {
 	cmd := &removeDhcpCmd{}
 	ctx.GetCommand(cmd)
+	validateDhcpEntries(cmd.DhcpEntries)
 
-	deleteDhcp(cmd.DhcpEntries)
+	deleteDhcp(ctx, cmd.DhcpEntries)
 
 	return nil
 }
@@ -183,6 +234,7 @@ var runVyosScript = func(script string, args map[string]string)  {
 
 
 func DhcpEntryPoint() {
-	server.RegisterAsyncCommandHandler(ADD_DHCP_PATH, server.VyosLock(addDhcpHandler))
-	server.RegisterAsyncCommandHandler(REMOVE_DHCP_PATH, server.VyosLock(removeDhcpHandler))
+	server.RegisterLegacyRuleOwner(server.RULE_FEATURE_DHCP, parseLegacyDhcpDescription)
+	server.RegisterAsyncCommandHandler(ADD_DHCP_PATH, addDhcpHandler)
+	server.RegisterAsyncCommandHandler(REMOVE_DHCP_PATH, server.ResourceLock(removeDhcpHandler, server.RESOURCE_DHCP))
 }
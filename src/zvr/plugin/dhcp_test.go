@@ -102,8 +102,8 @@ service {
 }`
 	}
 
-	deleteDhcp(infos)
-	setDhcp(infos)
+	deleteDhcp(&server.CommandContext{}, infos)
+	setDhcp(&server.CommandContext{}, infos)
 }
 
 func TestDHCPRemoveEntry(t *testing.T) {
@@ -163,7 +163,7 @@ service {
 }`
 	}
 
-	deleteDhcp(infos)
+	deleteDhcp(&server.CommandContext{}, infos)
 }
 
 func TestDHCPAddEntry(t *testing.T) {
@@ -188,5 +188,5 @@ interfaces {
 }`
 	}
 
-	setDhcp(infos)
+	setDhcp(&server.CommandContext{}, infos)
 }
@@ -6,6 +6,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"zvr/utils"
 	"strings"
+	"regexp"
 )
 
 const (
@@ -39,92 +40,136 @@ type syncDnatCmd struct {
 	Rules []dnatInfo `json:"rules"`
 }
 
+func (r dnatInfo) validate() {
+	utils.AssertPortRangeArgument("vipPort", r.VipPortStart, r.VipPortEnd)
+	utils.AssertPortRangeArgument("privatePort", r.PrivatePortStart, r.PrivatePortEnd)
+	utils.AssertOneOfArgument("protocolType", strings.ToLower(r.ProtocolType), "tcp", "udp")
+	utils.AssertIpArgument("vipIp", r.VipIp)
+	utils.AssertIpArgument("privateIp", r.PrivateIp)
+	utils.AssertMacArgument("privateMac", r.PrivateMac)
+	if r.AllowedCidr != "" {
+		utils.AssertCidrArgument("allowedCidr", r.AllowedCidr)
+	}
+}
+
+func validateDnatRules(rules []dnatInfo) {
+	for _, r := range rules {
+		r.validate()
+	}
+}
+
+// only the rules of the port forwardings are reconciled, the rules of
+// others, e.g. the EIPs, and the unchanged rules are not touched
 func syncDnatHandler(ctx *server.CommandContext) interface{} {
 	cmd := &syncDnatCmd{}
 	ctx.GetCommand(cmd)
+	validateDnatRules(cmd.Rules)
+
+	desired := make(map[string]bool)
+	for _, r := range cmd.Rules {
+		desired[makeDnatOwner(r).Id()] = true
+	}
+
+	tree := ctx.ConfigTree()
+	for _, r := range tree.FindRulesByOwner(func(o server.RuleOwner) bool {
+		return o.Feature == server.RULE_FEATURE_PORT_FORWARDING && !desired[o.Id()]
+	}) {
+		r.Node().Delete()
+	}
 
-	tree := server.NewParserFromShowConfiguration().Tree
-	tree.Delete("nat destination")
-	setRuleInTree(tree, cmd.Rules)
+	setRuleInTree(ctx, tree, cmd.Rules)
 	tree.Apply(false)
 	return nil
 }
 
-func getRule(tree *server.VyosConfigTree, description string) *server.VyosConfigNode {
-	rs := tree.Get("nat destination rule")
-	if rs == nil {
-		return nil
+// the dnat rules and the firewall of the vip nics
+func dnatResources(ctx *server.CommandContext, rules []dnatInfo) []string {
+	rs := []string{ server.RESOURCE_NAT_DESTINATION }
+	for _, r := range rules {
+		pubNicName, err := ctx.NicNameByIp(r.VipIp); utils.PanicOnError(err)
+		rs = append(rs, server.FirewallResource(pubNicName, "in"), server.InterfaceFirewallResource(pubNicName, "in"))
 	}
 
-	for _, r := range rs.Children() {
-		if des := r.Get("description"); des != nil && des.Value() == description {
-			return r
-		}
+	return rs
+}
+
+// bumped when the rules of the port forwardings are changed
+const DNAT_RULE_VERSION = 1
+
+// the vip identifies the port forwarding with the ports, the management node sends no uuid
+func makeDnatOwner(r dnatInfo) server.RuleOwner {
+	return server.RuleOwner{
+		Feature: server.RULE_FEATURE_PORT_FORWARDING,
+		Resource: r.VipIp,
+		Version: DNAT_RULE_VERSION,
+		Key: fmt.Sprintf("%v-%v-%v-%v-%v-%v", r.VipPortStart, r.VipPortEnd, r.PrivateMac, r.PrivatePortStart, r.PrivatePortEnd, r.ProtocolType),
+	}
+}
+
+// e.g. 172.20.14.100-22-22-fa:4c:ad:b9:15:00-22-22-TCP
+var dnatDescriptionRegex = regexp.MustCompile(`^(\d+\.\d+\.\d+\.\d+)-(\d+-\d+-[0-9a-fA-F:]+-\d+-\d+-\w+)$`)
+
+func parseLegacyDnatDescription(des string) (string, string, bool) {
+	if m := dnatDescriptionRegex.FindStringSubmatch(des); m != nil {
+		return m[1], m[2], true
 	}
+	return "", "", false
+}
 
-	return nil
+func portRange(start, end int) string {
+	if start == end {
+		return fmt.Sprintf("%v", start)
+	}
+	return fmt.Sprintf("%v-%v", start, end)
 }
 
-func makeDnatDescription(r dnatInfo) string {
-	return fmt.Sprintf("%v-%v-%v-%v-%v-%v-%v", r.VipIp, r.VipPortStart, r.VipPortEnd, r.PrivateMac, r.PrivatePortStart, r.PrivatePortEnd, r.ProtocolType)
+func dnatRuleConfig(r dnatInfo) []string {
+	return []string{
+		server.ConfigPath("description", makeDnatOwner(r).Description()),
+		server.ConfigPath("destination", "address", r.VipIp),
+		server.ConfigPath("destination", "port", portRange(r.VipPortStart, r.VipPortEnd)),
+		"inbound-interface any",
+		server.ConfigPath("protocol", strings.ToLower(r.ProtocolType)),
+		server.ConfigPath("translation", "address", r.PrivateIp),
+		server.ConfigPath("translation", "port", portRange(r.PrivatePortStart, r.PrivatePortEnd)),
+	}
 }
 
-func setRuleInTree(tree *server.VyosConfigTree, rules []dnatInfo) {
-	for _, r := range rules {
-		des := makeDnatDescription(r)
-		if currentRule := getRule(tree, des); currentRule != nil {
-			log.Debugf("dnat rule %s exists, skip it", des)
-			continue
-		}
+func dnatFirewallConfig(r dnatInfo) []string {
+	config := []string{ "action accept" }
+	if r.AllowedCidr != "" && r.AllowedCidr != "0.0.0.0/0" {
+		config = append(config, server.ConfigPath("source", "address", r.AllowedCidr))
+	}
 
-		var sport string
-		if r.VipPortStart == r.VipPortEnd {
-			sport = fmt.Sprintf("%v", r.VipPortStart)
-		} else {
-			sport = fmt.Sprintf("%v-%v", r.VipPortStart, r.VipPortEnd)
-		}
-		var dport string
-		if r.PrivatePortStart == r.PrivatePortEnd {
-			dport = fmt.Sprintf("%v", r.PrivatePortStart)
+	return append(config,
+		server.ConfigPath("description", makeDnatOwner(r).Description()),
+		// NOTE: the destination is private IP
+		// because the destination address is changed by the dnat rule
+		server.ConfigPath("destination", "address", r.PrivateIp),
+		server.ConfigPath("destination", "port", portRange(r.PrivatePortStart, r.PrivatePortEnd)),
+		server.ConfigPath("protocol", strings.ToLower(r.ProtocolType)),
+		"state new enable",
+	)
+}
+
+// the existing rules are changed in place only if they differ, the
+// descriptions of the rules of the older versions are changed too
+func setRuleInTree(ctx *server.CommandContext, tree *server.VyosConfigTree, rules []dnatInfo) {
+	for _, r := range rules {
+		owner := makeDnatOwner(r)
+		if currentRule := tree.FindDnatRuleByOwner(owner); currentRule != nil {
+			if tree.ReconcileConfig(currentRule.String(), dnatRuleConfig(r)...) {
+				log.Debugf("dnat rule %s is changed", owner.Description())
+			}
 		} else {
-			dport = fmt.Sprintf("%v-%v", r.PrivatePortStart, r.PrivatePortEnd)
+			tree.SetDnatFor(server.RULE_FEATURE_PORT_FORWARDING, dnatRuleConfig(r)...)
 		}
 
-		pubNicName, err := utils.GetNicNameByIp(r.VipIp); utils.PanicOnError(err)
-
-		tree.SetDnat(
-			fmt.Sprintf("description %v", des),
-			fmt.Sprintf("destination address %v", r.VipIp),
-			fmt.Sprintf("destination port %v", sport),
-			fmt.Sprintf("inbound-interface any"),
-			fmt.Sprintf("protocol %v", strings.ToLower(r.ProtocolType)),
-			fmt.Sprintf("translation address %v", r.PrivateIp),
-			fmt.Sprintf("translation port %v", dport),
-		)
-
-		if fr := tree.FindFirewallRuleByDescription(pubNicName, "in", des); fr == nil {
-			if r.AllowedCidr != "" && r.AllowedCidr != "0.0.0.0/0" {
-				tree.SetFirewallOnInterface(pubNicName, "in",
-					"action accept",
-					fmt.Sprintf("source address %v", r.AllowedCidr),
-					fmt.Sprintf("description %v", des),
-					// NOTE: the destination is private IP
-					// because the destination address is changed by the dnat rule
-					fmt.Sprintf("destination address %v", r.PrivateIp),
-					fmt.Sprintf("destination port %v", dport),
-					fmt.Sprintf("protocol %s", strings.ToLower(r.ProtocolType)),
-					"state new enable",
-				)
-			} else {
-				tree.SetFirewallOnInterface(pubNicName, "in",
-					"action accept",
-					fmt.Sprintf("description %v", des),
-					fmt.Sprintf("destination address %v", r.PrivateIp),
-					fmt.Sprintf("destination port %v", dport),
-					fmt.Sprintf("protocol %s", strings.ToLower(r.ProtocolType)),
-					"state new enable",
-				)
-			}
+		pubNicName, err := ctx.NicNameByIp(r.VipIp); utils.PanicOnError(err)
+		if fr := tree.FindFirewallRuleByOwner(pubNicName, "in", owner); fr != nil {
+			tree.ReconcileConfig(fr.String(), dnatFirewallConfig(r)...)
+		} else {
+			tree.SetFirewallOnInterface(pubNicName, "in", dnatFirewallConfig(r)...)
 		}
 
 		tree.AttachFirewallToInterface(pubNicName, "in")
@@ -134,9 +179,11 @@ func setRuleInTree(tree *server.VyosConfigTree, rules []dnatInfo) {
 func setDnatHandler(ctx *server.CommandContext) interface{} {
 	cmd := &setDnatCmd{}
 	ctx.GetCommand(cmd)
+	validateDnatRules(cmd.Rules)
+	ctx.LockResources(dnatResources(ctx, cmd.Rules)...)
 
-	tree := server.NewParserFromShowConfiguration().Tree
-	setRuleInTree(tree, cmd.Rules)
+	tree := ctx.ConfigTree()
+	setRuleInTree(ctx, tree, cmd.Rules)
 	tree.Apply(false)
 
 	return nil
@@ -145,16 +192,18 @@ func setDnatHandler(ctx *server.CommandContext) interface{} {
 func removeDnatHandler(ctx *server.CommandContext) interface{} {
 	cmd := &removeDnatCmd{}
 	ctx.GetCommand(cmd)
+	validateDnatRules(cmd.Rules)
+	ctx.LockResources(dnatResources(ctx, cmd.Rules)...)
 
-	tree := server.NewParserFromShowConfiguration().Tree
+	tree := ctx.ConfigTree()
 	for _, r := range cmd.Rules {
-		des := makeDnatDescription(r)
-		if c := getRule(tree, des); c != nil {
+		owner := makeDnatOwner(r)
+		if c := tree.FindDnatRuleByOwner(owner); c != nil {
 			c.Delete()
 		}
 
-		pubNicName, err := utils.GetNicNameByIp(r.VipIp); utils.PanicOnError(err)
-		if fr := tree.FindFirewallRuleByDescription(pubNicName, "in", des); fr != nil {
+		pubNicName, err := ctx.NicNameByIp(r.VipIp); utils.PanicOnError(err)
+		if fr := tree.FindFirewallRuleByOwner(pubNicName, "in", owner); fr != nil {
 			fr.Delete()
 		}
 	}
@@ -164,7 +213,9 @@ func removeDnatHandler(ctx *server.CommandContext) interface{} {
 }
 
 func DnatEntryPoint() {
-	server.RegisterAsyncCommandHandler(CREATE_PORT_FORWARDING_PATH, server.VyosLock(setDnatHandler))
-	server.RegisterAsyncCommandHandler(REVOKE_PORT_FORWARDING_PATH, server.VyosLock(removeDnatHandler))
-	server.RegisterAsyncCommandHandler(SYNC_PORT_FORWARDING_PATH, server.VyosLock(syncDnatHandler))
+	server.RegisterLegacyRuleOwner(server.RULE_FEATURE_PORT_FORWARDING, parseLegacyDnatDescription)
+	server.RegisterAsyncCommandHandler(CREATE_PORT_FORWARDING_PATH, setDnatHandler)
+	server.RegisterAsyncCommandHandler(REVOKE_PORT_FORWARDING_PATH, removeDnatHandler)
+	server.RegisterAsyncCommandHandler(SYNC_PORT_FORWARDING_PATH, server.ResourceLock(syncDnatHandler, server.RESOURCE_NAT_DESTINATION, server.RESOURCE_FIREWALL, server.RESOURCE_INTERFACES))
+	server.RegisterBatchCommand(CREATE_PORT_FORWARDING_PATH, REVOKE_PORT_FORWARDING_PATH, SYNC_PORT_FORWARDING_PATH)
 }
@@ -3,7 +3,7 @@ package plugin
 import (
 	"zvr/server"
 	"zvr/utils"
-	"fmt"
+	"strings"
 )
 
 const (
@@ -25,44 +25,63 @@ type removeDnsCmd struct {
 }
 
 
-func makeDnsFirewallRuleDescription(nicname string) string {
-	return fmt.Sprintf("DNS-for-%s", nicname)
+// bumped when the firewall rules of the DNS are changed
+const DNS_RULE_VERSION = 1
+
+func makeDnsFirewallRuleOwner(nicname string) server.RuleOwner {
+	return server.RuleOwner{ Feature: server.RULE_FEATURE_DNS, Resource: nicname, Version: DNS_RULE_VERSION }
 }
 
-func setDnsHandler(ctx *server.CommandContext) interface{} {
-	tree := server.NewParserFromShowConfiguration().Tree
+// DNS-for-<nicname>
+func parseLegacyDnsDescription(des string) (string, string, bool) {
+	if strings.HasPrefix(des, "DNS-for-") {
+		return strings.TrimPrefix(des, "DNS-for-"), "", true
+	}
+	return "", "", false
+}
 
+func setDnsHandler(ctx *server.CommandContext) interface{} {
 	cmd := &setDnsCmd{}
 	ctx.GetCommand(cmd)
 
 	dnsByMac := make(map[string][]dnsInfo)
+	resources := []string{ server.RESOURCE_DNS }
 	for _, info := range cmd.Dns {
+		utils.AssertIpArgument("dnsAddress", info.DnsAddress)
+		utils.AssertMacArgument("nicMac", info.NicMac)
 		dns := dnsByMac[info.NicMac]
 		if dns == nil {
 			dns = make([]dnsInfo, 0)
+			eth, err := ctx.NicNameByMac(info.NicMac); utils.PanicOnError(err)
+			resources = append(resources, server.FirewallResource(eth, "local"), server.InterfaceFirewallResource(eth, "local"))
 		}
 		dns = append(dns, info)
 		dnsByMac[info.NicMac] = dns
 	}
 
+	ctx.LockResources(resources...)
+	tree := ctx.ConfigTree()
+
 	for mac, dns := range dnsByMac {
 		for _, info := range dns {
-			tree.Setf("service dns forwarding name-server %s", info.DnsAddress)
+			tree.AddValuePath("service", "dns", "forwarding", "name-server", info.DnsAddress)
 		}
-		eth, err := utils.GetNicNameByMac(mac); utils.PanicOnError(err)
-		tree.Setf("service dns forwarding listen-on %s", eth)
+		eth, err := ctx.NicNameByMac(mac); utils.PanicOnError(err)
+		tree.AddValuePath("service", "dns", "forwarding", "listen-on", eth)
 
 
-		des := makeDnsFirewallRuleDescription(eth)
-		if r := tree.FindFirewallRuleByDescription(eth, "local", des); r == nil {
+		owner := makeDnsFirewallRuleOwner(eth)
+		if r := tree.FindFirewallRuleByOwner(eth, "local", owner); r == nil {
 			tree.SetFirewallOnInterface(eth, "local",
-				fmt.Sprintf("description %v", des),
+				server.ConfigPath("description", owner.Description()),
 				"destination port 53",
 				"protocol tcp_udp",
 				"action accept",
 			)
 
 			tree.AttachFirewallToInterface(eth, "local")
+		} else {
+			tree.SetRuleOwner(r, owner)
 		}
 	}
 
@@ -72,13 +91,14 @@ func setDnsHandler(ctx *server.CommandContext) interface{} {
 }
 
 func removeDnsHandler(ctx *server.CommandContext) interface{} {
-	tree := server.NewParserFromShowConfiguration().Tree
+	tree := ctx.ConfigTree()
 
 	cmd := &removeDnsCmd{}
 	ctx.GetCommand(cmd)
 
 	for _, info := range cmd.Dns {
-		tree.Deletef("service dns forwarding name-server %s", info.DnsAddress)
+		utils.AssertIpArgument("dnsAddress", info.DnsAddress)
+		tree.DeletePath("service", "dns", "forwarding", "name-server", info.DnsAddress)
 	}
 
 	tree.Apply(false)
@@ -86,6 +106,8 @@ func removeDnsHandler(ctx *server.CommandContext) interface{} {
 }
 
 func DnsEntryPoint() {
-	server.RegisterAsyncCommandHandler(SET_DNS_PATH, server.VyosLock(setDnsHandler))
-	server.RegisterAsyncCommandHandler(REMOVE_DNS_PATH, server.VyosLock(removeDnsHandler))
+	server.RegisterLegacyRuleOwner(server.RULE_FEATURE_DNS, parseLegacyDnsDescription)
+	server.RegisterAsyncCommandHandler(SET_DNS_PATH, setDnsHandler)
+	server.RegisterAsyncCommandHandler(REMOVE_DNS_PATH, server.ResourceLock(removeDnsHandler, server.RESOURCE_DNS))
+	server.RegisterBatchCommand(SET_DNS_PATH, REMOVE_DNS_PATH)
 }
@@ -32,38 +32,83 @@ type syncEipCmd struct {
 	Eips []eipInfo `json:"eips"`
 }
 
-var EIP_SNAT_START_RULE_NUM = 5000
+// bumped when the rules of the EIPs are changed
+const EIP_RULE_VERSION = 1
+
+// the vip identifies the EIP, the management node sends no uuid
+func makeEipOwner(info eipInfo) server.RuleOwner {
+	return server.RuleOwner{
+		Feature: server.RULE_FEATURE_EIP,
+		Resource: info.VipIp,
+		Version: EIP_RULE_VERSION,
+		Key: fmt.Sprintf("%v-%v", info.GuestIp, info.PrivateMac),
+	}
+}
+
+// EIP-<vip>-<guest ip>-<private mac>, the resource is unknown for other rules starting with EIP
+func parseLegacyEipDescription(des string) (string, string, bool) {
+	if !strings.HasPrefix(des, "EIP") {
+		return "", "", false
+	}
 
-func makeEipDescription(info eipInfo) string {
-	return fmt.Sprintf("EIP-%v-%v-%v", info.VipIp, info.GuestIp, info.PrivateMac)
+	if fs := strings.SplitN(des, "-", 3); len(fs) == 3 && fs[0] == "EIP" {
+		return fs[1], fs[2], true
+	}
+	return "", "", true
 }
 
-func setEip(tree *server.VyosConfigTree, eip eipInfo) {
-	des := makeEipDescription(eip)
-	nicname, err := utils.GetNicNameByIp(eip.VipIp); utils.PanicOnError(err)
+func (eip eipInfo) validate() {
+	utils.AssertIpArgument("vipIp", eip.VipIp)
+	utils.AssertMacArgument("privateMac", eip.PrivateMac)
+	utils.AssertIpArgument("guestIp", eip.GuestIp)
+}
 
-	if r := tree.FindSnatRuleDescription(des); r == nil {
-		tree.SetSnat(
-			fmt.Sprintf("description %v", des),
-			fmt.Sprintf("outbound-interface any"),
-			fmt.Sprintf("source address %v", eip.GuestIp),
-			fmt.Sprintf("translation address %v", eip.VipIp),
+// the nat rules and the firewall of the vip nic and the private nic
+func eipResources(ctx *server.CommandContext, eip eipInfo) []string {
+	nicname, err := ctx.NicNameByIp(eip.VipIp); utils.PanicOnError(err)
+	prinicname, err := ctx.NicNameByMac(eip.PrivateMac); utils.PanicOnError(err)
+
+	return []string{
+		server.RESOURCE_NAT_SOURCE,
+		server.RESOURCE_NAT_DESTINATION,
+		server.FirewallResource(nicname, "in"),
+		server.FirewallResource(prinicname, "in"),
+		server.InterfaceFirewallResource(nicname, "in"),
+		server.InterfaceFirewallResource(prinicname, "in"),
+	}
+}
+
+func setEip(ctx *server.CommandContext, tree *server.VyosConfigTree, eip eipInfo) {
+	owner := makeEipOwner(eip)
+	des := owner.Description()
+	nicname, err := ctx.NicNameByIp(eip.VipIp); utils.PanicOnError(err)
+
+	if r := tree.FindSnatRuleByOwner(owner); r == nil {
+		tree.SetSnatFor(server.RULE_FEATURE_EIP,
+			server.ConfigPath("description", des),
+			"outbound-interface any",
+			server.ConfigPath("source", "address", eip.GuestIp),
+			server.ConfigPath("translation", "address", eip.VipIp),
 		)
+	} else {
+		tree.SetRuleOwner(r, owner)
 	}
 
-	if r := tree.FindDnatRuleDescription(des); r == nil {
-		tree.SetDnat(
-			fmt.Sprintf("description %v", des),
-			fmt.Sprintf("inbound-interface any"),
-			fmt.Sprintf("destination address %v", eip.VipIp),
-			fmt.Sprintf("translation address %v", eip.GuestIp),
+	if r := tree.FindDnatRuleByOwner(owner); r == nil {
+		tree.SetDnatFor(server.RULE_FEATURE_EIP,
+			server.ConfigPath("description", des),
+			"inbound-interface any",
+			server.ConfigPath("destination", "address", eip.VipIp),
+			server.ConfigPath("translation", "address", eip.GuestIp),
 		)
+	} else {
+		tree.SetRuleOwner(r, owner)
 	}
 
-	if r := tree.FindFirewallRuleByDescription(nicname, "in", des); r == nil {
+	if r := tree.FindFirewallRuleByOwner(nicname, "in", owner); r == nil {
 		tree.SetFirewallOnInterface(nicname, "in",
-			fmt.Sprintf("description %v", des),
-			fmt.Sprintf("destination address %v", eip.GuestIp),
+			server.ConfigPath("description", des),
+			server.ConfigPath("destination", "address", eip.GuestIp),
 			"state new enable",
 			"state established enable",
 			"state related enable",
@@ -71,13 +116,15 @@ func setEip(tree *server.VyosConfigTree, eip eipInfo) {
 		)
 
 		tree.AttachFirewallToInterface(nicname, "in")
+	} else {
+		tree.SetRuleOwner(r, owner)
 	}
 
-	prinicname, err := utils.GetNicNameByMac(eip.PrivateMac); utils.PanicOnError(err)
-	if r := tree.FindFirewallRuleByDescription(prinicname, "in", des); r == nil {
+	prinicname, err := ctx.NicNameByMac(eip.PrivateMac); utils.PanicOnError(err)
+	if r := tree.FindFirewallRuleByOwner(prinicname, "in", owner); r == nil {
 		tree.SetFirewallOnInterface(prinicname, "in",
-			fmt.Sprintf("description %v", des),
-			fmt.Sprintf("source address %v", eip.GuestIp),
+			server.ConfigPath("description", des),
+			server.ConfigPath("source", "address", eip.GuestIp),
 			"state new enable",
 			"state established enable",
 			"state related enable",
@@ -85,27 +132,29 @@ func setEip(tree *server.VyosConfigTree, eip eipInfo) {
 		)
 
 		tree.AttachFirewallToInterface(prinicname, "in")
+	} else {
+		tree.SetRuleOwner(r, owner)
 	}
 }
 
-func deleteEip(tree *server.VyosConfigTree, eip eipInfo) {
-	des := makeEipDescription(eip)
-	nicname, err := utils.GetNicNameByIp(eip.VipIp); utils.PanicOnError(err)
+func deleteEip(ctx *server.CommandContext, tree *server.VyosConfigTree, eip eipInfo) {
+	owner := makeEipOwner(eip)
+	nicname, err := ctx.NicNameByIp(eip.VipIp); utils.PanicOnError(err)
 
-	if r := tree.FindSnatRuleDescription(des); r != nil {
+	if r := tree.FindSnatRuleByOwner(owner); r != nil {
 		r.Delete()
 	}
 
-	if r := tree.FindDnatRuleDescription(des); r != nil {
+	if r := tree.FindDnatRuleByOwner(owner); r != nil {
 		r.Delete()
 	}
 
-	if r := tree.FindFirewallRuleByDescription(nicname, "in", des); r != nil {
+	if r := tree.FindFirewallRuleByOwner(nicname, "in", owner); r != nil {
 		r.Delete()
 	}
 
-	prinicname, err := utils.GetNicNameByMac(eip.PrivateMac); utils.PanicOnError(err)
-	if r := tree.FindFirewallRuleByDescription(prinicname, "in", des); r != nil {
+	prinicname, err := ctx.NicNameByMac(eip.PrivateMac); utils.PanicOnError(err)
+	if r := tree.FindFirewallRuleByOwner(prinicname, "in", owner); r != nil {
 		r.Delete()
 	}
 }
@@ -114,9 +163,11 @@ func createEip(ctx *server.CommandContext) interface{} {
 	cmd := &setEipCmd{}
 	ctx.GetCommand(cmd)
 	eip := cmd.Eip
+	eip.validate()
+	ctx.LockResources(eipResources(ctx, eip)...)
 
-	tree := server.NewParserFromShowConfiguration().Tree
-	setEip(tree, eip)
+	tree := ctx.ConfigTree()
+	setEip(ctx, tree, eip)
 	tree.Apply(false)
 
 	return nil
@@ -126,9 +177,11 @@ func removeEip(ctx *server.CommandContext) interface{} {
 	cmd := &removeEipCmd{}
 	ctx.GetCommand(cmd)
 	eip := cmd.Eip
+	eip.validate()
+	ctx.LockResources(eipResources(ctx, eip)...)
 
-	tree := server.NewParserFromShowConfiguration().Tree
-	deleteEip(tree, eip)
+	tree := ctx.ConfigTree()
+	deleteEip(ctx, tree, eip)
 	tree.Apply(false)
 
 	return nil
@@ -137,40 +190,25 @@ func removeEip(ctx *server.CommandContext) interface{} {
 func syncEip(ctx *server.CommandContext) interface{} {
 	cmd := &syncEipCmd{}
 	ctx.GetCommand(cmd)
-
-	tree := server.NewParserFromShowConfiguration().Tree
-
-	// delete all EIP related rules
-	if rs := tree.Get("nat destination rule"); rs != nil {
-		for _, r := range rs.Children() {
-			if d := r.Get("description"); d != nil && strings.HasPrefix(d.Value(), "EIP") {
-				r.Delete()
-			}
-		}
+	for _, eip := range cmd.Eips {
+		eip.validate()
 	}
 
-	if rs := tree.Getf("nat source rule"); rs != nil {
-		for _, r := range rs.Children() {
-			if d := r.Get("description"); d != nil && strings.HasPrefix(d.Value(), "EIP") {
-				r.Delete()
-			}
-		}
+	desired := make(map[string]bool)
+	for _, eip := range cmd.Eips {
+		desired[makeEipOwner(eip).Id()] = true
 	}
 
-	if rs := tree.Getf("firewall name"); rs != nil {
-		for _, r := range rs.Children() {
-			if rss := r.Get("rule"); rss != nil {
-				for _, rr := range rss.Children() {
-					if d := rr.Get("description"); d != nil && strings.HasPrefix(d.Value(), "EIP") {
-						rr.Delete()
-					}
-				}
-			}
-		}
+	// delete the rules of the EIPs not synced, the rules of the others are kept
+	tree := ctx.ConfigTree()
+	for _, r := range tree.FindRulesByOwner(func(o server.RuleOwner) bool {
+		return o.Feature == server.RULE_FEATURE_EIP && !desired[o.Id()]
+	}) {
+		r.Node().Delete()
 	}
 
 	for _, eip := range cmd.Eips {
-		setEip(tree, eip)
+		setEip(ctx, tree, eip)
 	}
 
 	tree.Apply(false)
@@ -179,7 +217,10 @@ func syncEip(ctx *server.CommandContext) interface{} {
 }
 
 func EipEntryPoint() {
-	server.RegisterAsyncCommandHandler(VR_CREATE_EIP, server.VyosLock(createEip))
-	server.RegisterAsyncCommandHandler(VR_REMOVE_EIP, server.VyosLock(removeEip))
-	server.RegisterAsyncCommandHandler(VR_SYNC_EIP, server.VyosLock(syncEip))
+	server.RegisterLegacyRuleOwner(server.RULE_FEATURE_EIP, parseLegacyEipDescription)
+	server.RegisterAsyncCommandHandler(VR_CREATE_EIP, createEip)
+	server.RegisterAsyncCommandHandler(VR_REMOVE_EIP, removeEip)
+	// the sync cleans up EIP rules in all firewalls
+	server.RegisterAsyncCommandHandler(VR_SYNC_EIP, server.ResourceLock(syncEip, server.RESOURCE_NAT, server.RESOURCE_FIREWALL, server.RESOURCE_INTERFACES))
+	server.RegisterBatchCommand(VR_CREATE_EIP, VR_REMOVE_EIP, VR_SYNC_EIP)
 }
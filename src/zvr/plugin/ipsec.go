@@ -4,6 +4,8 @@ import (
 	"zvr/server"
 	"zvr/utils"
 	"fmt"
+	"strings"
+	"strconv"
 )
 
 const(
@@ -43,91 +45,108 @@ type syncIPsecCmd struct {
 	Infos []ipsecInfo `json:"infos"`
 }
 
-func createIPsec(tree *server.VyosConfigTree, info ipsecInfo)  {
-	nicname, err := utils.GetNicNameByIp(info.Vip); utils.PanicOnError(err)
+// what identifies the connection and its rules
+func (info ipsecInfo) validateConnection() {
+	utils.AssertUuidArgument("uuid", info.Uuid)
+	utils.AssertIpArgument("peerAddress", info.PeerAddress)
+	utils.AssertIpArgument("vip", info.Vip)
+	for _, cidr := range info.LocalCidrs {
+		utils.AssertCidrArgument("localCidrs", cidr)
+	}
+	for _, cidr := range info.PeerCidrs {
+		utils.AssertCidrArgument("peerCidrs", cidr)
+	}
+}
+
+func (info ipsecInfo) validate() {
+	info.validateConnection()
+	utils.AssertArgument(info.AuthMode == "psk", "vyos plugin only supports authMode 'psk', %s is not supported yet", info.AuthMode)
+	utils.AssertArgument(info.AuthKey != "", "authKey cannot be empty")
+	utils.AssertArgument(len(info.LocalCidrs) == 1, "localCidrs%v containing more than one CIDR is not supported yet", info.LocalCidrs)
+	utils.AssertArgument(info.IkeDhGroup > 0, "ikeDhGroup[%v] is not valid", info.IkeDhGroup)
+	utils.AssertWordArgument("ikeAuthAlgorithm", info.IkeAuthAlgorithm)
+	utils.AssertWordArgument("ikeEncryptionAlgorithm", info.IkeEncryptionAlgorithm)
+	utils.AssertWordArgument("policyAuthAlgorithm", info.PolicyAuthAlgorithm)
+	utils.AssertWordArgument("policyEncryptionAlgorithm", info.PolicyEncryptionAlgorithm)
+	utils.AssertWordArgument("policyMode", info.PolicyMode)
+	if info.Pfs != "" {
+		utils.AssertWordArgument("pfs", info.Pfs)
+	}
+}
 
-	tree.Setf("vpn ipsec ipsec-interfaces interface %s", nicname)
+func createIPsec(ctx *server.CommandContext, tree *server.VyosConfigTree, info ipsecInfo)  {
+	setIPsecVpn(ctx, tree, info)
+	setIPsecFirewall(ctx, tree, info)
+}
+
+// the config under 'vpn ipsec'
+func setIPsecVpn(ctx *server.CommandContext, tree *server.VyosConfigTree, info ipsecInfo) {
+	nicname, err := ctx.NicNameByIp(info.Vip); utils.PanicOnError(err)
+
+	tree.SetPath("vpn", "ipsec", "ipsec-interfaces", "interface", nicname)
 
 	// create ike group
-	tree.Setf("vpn ipsec ike-group %s proposal 1 dh-group %v", info.Uuid, info.IkeDhGroup)
-	tree.Setf("vpn ipsec ike-group %s proposal 1 encryption %v", info.Uuid, info.IkeEncryptionAlgorithm)
-	tree.Setf("vpn ipsec ike-group %s proposal 1 hash %v", info.Uuid, info.IkeAuthAlgorithm)
+	tree.SetPath("vpn", "ipsec", "ike-group", info.Uuid, "proposal", "1", "dh-group", strconv.Itoa(info.IkeDhGroup))
+	tree.SetPath("vpn", "ipsec", "ike-group", info.Uuid, "proposal", "1", "encryption", info.IkeEncryptionAlgorithm)
+	tree.SetPath("vpn", "ipsec", "ike-group", info.Uuid, "proposal", "1", "hash", info.IkeAuthAlgorithm)
 
 	// create esp group
 	if info.Pfs == "" {
-		tree.Setf("vpn ipsec esp-group %s pfs disable", info.Uuid)
+		tree.SetPath("vpn", "ipsec", "esp-group", info.Uuid, "pfs", "disable")
 	} else {
-		tree.Setf("vpn ipsec esp-group %s pfs %s", info.Uuid, info.Pfs)
+		tree.SetPath("vpn", "ipsec", "esp-group", info.Uuid, "pfs", info.Pfs)
 	}
-	tree.Setf("vpn ipsec esp-group %s proposal 1 encryption %s", info.Uuid, info.PolicyEncryptionAlgorithm)
-	tree.Setf("vpn ipsec esp-group %s proposal 1 hash %s", info.Uuid, info.PolicyAuthAlgorithm)
-	tree.Setf("vpn ipsec esp-group %s mode %s", info.Uuid, info.PolicyMode)
-
-	// create peer connection
-	utils.Assertf(info.AuthMode == "psk", "vyos plugin only supports authMode 'psk', %s is not supported yet", info.AuthMode)
-	tree.Setf("vpn ipsec site-to-site peer %s authentication mode pre-shared-secret", info.PeerAddress)
-	tree.Setf("vpn ipsec site-to-site peer %s authentication pre-shared-secret %s", info.PeerAddress, info.AuthKey)
-	tree.Setf("vpn ipsec site-to-site peer %s default-esp-group %s", info.PeerAddress, info.Uuid)
-	tree.Setf("vpn ipsec site-to-site peer %s ike-group %s", info.PeerAddress, info.Uuid)
-
-	tree.Setf("vpn ipsec site-to-site peer %s local-address %s", info.PeerAddress, info.Vip)
-	utils.Assertf(len(info.LocalCidrs) == 1, "localCidrs%v containing more than one CIDR is not supported yet", info.LocalCidrs)
+	tree.SetPath("vpn", "ipsec", "esp-group", info.Uuid, "proposal", "1", "encryption", info.PolicyEncryptionAlgorithm)
+	tree.SetPath("vpn", "ipsec", "esp-group", info.Uuid, "proposal", "1", "hash", info.PolicyAuthAlgorithm)
+	tree.SetPath("vpn", "ipsec", "esp-group", info.Uuid, "mode", info.PolicyMode)
+
+	// create peer connection, the arguments are checked by validate()
+	tree.SetPath("vpn", "ipsec", "site-to-site", "peer", info.PeerAddress, "authentication", "mode", "pre-shared-secret")
+	// the key may have any characters
+	tree.SetPath("vpn", "ipsec", "site-to-site", "peer", info.PeerAddress, "authentication", "pre-shared-secret", info.AuthKey)
+	tree.SetPath("vpn", "ipsec", "site-to-site", "peer", info.PeerAddress, "default-esp-group", info.Uuid)
+	tree.SetPath("vpn", "ipsec", "site-to-site", "peer", info.PeerAddress, "ike-group", info.Uuid)
+
+	tree.SetPath("vpn", "ipsec", "site-to-site", "peer", info.PeerAddress, "local-address", info.Vip)
 	localCidr := info.LocalCidrs[0]
 	for i, remoteCidr := range info.PeerCidrs {
-		tree.Setf("vpn ipsec site-to-site peer %v tunnel %v local prefix %v", info.PeerAddress, i+1, localCidr)
-		tree.Setf("vpn ipsec site-to-site peer %v tunnel %v remote prefix %v", info.PeerAddress, i+1, remoteCidr)
-	}
-
-	// configure firewall
-	des := "ipsec-500-udp"
-	if r := tree.FindFirewallRuleByDescription(nicname, "local", des); r == nil {
-		tree.SetFirewallOnInterface(nicname, "local",
-			"destination port 500",
-			fmt.Sprintf("description %s", des),
-			"protocol udp",
-			"action accept",
-		)
-	}
-
-	des = "ipsec-4500-udp"
-	if r := tree.FindFirewallRuleByDescription(nicname, "local", des); r == nil {
-		tree.SetFirewallOnInterface(nicname, "local",
-			"destination port 4500",
-			fmt.Sprintf("description %s", des),
-			"protocol udp",
-			"action accept",
-		)
+		tree.SetPath("vpn", "ipsec", "site-to-site", "peer", info.PeerAddress, "tunnel", strconv.Itoa(i+1), "local", "prefix", localCidr)
+		tree.SetPath("vpn", "ipsec", "site-to-site", "peer", info.PeerAddress, "tunnel", strconv.Itoa(i+1), "remote", "prefix", remoteCidr)
 	}
+}
 
-	des = "ipsec-esp"
-	if r := tree.FindFirewallRuleByDescription(nicname, "local", des); r == nil {
-		tree.SetFirewallOnInterface(nicname, "local",
-			fmt.Sprintf("description %s", des),
-			"protocol esp",
-			"action accept",
-		)
-	}
+// the firewall and snat rules of the connection
+func setIPsecFirewall(ctx *server.CommandContext, tree *server.VyosConfigTree, info ipsecInfo) {
+	nicname, err := ctx.NicNameByIp(info.Vip); utils.PanicOnError(err)
+	localCidr := info.LocalCidrs[0]
 
-	des = "ipsec-ah"
-	if r := tree.FindFirewallRuleByDescription(nicname, "local", des); r == nil {
-		tree.SetFirewallOnInterface(nicname, "local",
-			fmt.Sprintf("description %s", des),
-			"protocol ah",
-			"action accept",
-		)
+	// configure firewall, the local rules are shared by all connections
+	local := func(key string, rules ...string) {
+		owner := makeIPsecRuleOwner("", key)
+		if r := tree.FindFirewallRuleByOwner(nicname, "local", owner); r == nil {
+			tree.SetFirewallOnInterface(nicname, "local", append(rules, server.ConfigPath("description", owner.Description()))...)
+		} else {
+			tree.SetRuleOwner(r, owner)
+		}
 	}
+	local("500-udp", "destination port 500", "protocol udp", "action accept")
+	local("4500-udp", "destination port 4500", "protocol udp", "action accept")
+	local("esp", "protocol esp", "action accept")
+	local("ah", "protocol ah", "action accept")
 
 	for _, cidr := range info.PeerCidrs {
-		des = fmt.Sprintf("IPSEC-%s-%s", info.Uuid, cidr)
-		if r := tree.FindFirewallRuleByDescription(nicname, "in", des); r == nil {
+		owner := makeIPsecRuleOwner(info.Uuid, cidr)
+		if r := tree.FindFirewallRuleByOwner(nicname, "in", owner); r == nil {
 			tree.SetFirewallOnInterface(nicname, "in",
 				"action accept",
 				"state established enable",
 				"state related enable",
 				"state new enable",
-				fmt.Sprintf("description %v", des),
-				fmt.Sprintf("source address %v", cidr),
+				server.ConfigPath("description", owner.Description()),
+				server.ConfigPath("source", "address", cidr),
 			)
+		} else {
+			tree.SetRuleOwner(r, owner)
 		}
 	}
 
@@ -136,15 +155,17 @@ func createIPsec(tree *server.VyosConfigTree, info ipsecInfo)  {
 
 	if info.ExcludeSnat {
 		for _, remoteCidr := range info.PeerCidrs {
-			des = fmt.Sprintf("ipsec-%s-%s-%s", info.Uuid, localCidr, remoteCidr)
-			if r := tree.FindSnatRuleDescription(des); r == nil {
-				tree.SetSnat(
-					fmt.Sprintf("destination address %v", remoteCidr),
-					fmt.Sprintf("source address %v", localCidr),
-					fmt.Sprintf("outbound-interface %v", nicname),
-					fmt.Sprintf("description %v", des),
+			owner := makeIPsecRuleOwner(info.Uuid, fmt.Sprintf("%s-%s", localCidr, remoteCidr))
+			if r := tree.FindSnatRuleByOwner(owner); r == nil {
+				tree.SetSnatFor(server.RULE_FEATURE_IPSEC,
+					server.ConfigPath("destination", "address", remoteCidr),
+					server.ConfigPath("source", "address", localCidr),
+					server.ConfigPath("outbound-interface", nicname),
+					server.ConfigPath("description", owner.Description()),
 					"exclude",
 				)
+			} else {
+				tree.SetRuleOwner(r, owner)
 			}
 		}
 	}
@@ -153,11 +174,13 @@ func createIPsec(tree *server.VyosConfigTree, info ipsecInfo)  {
 func createIPsecConnection(ctx *server.CommandContext) interface{} {
 	cmd := &createIPsecCmd{}
 	ctx.GetCommand(cmd)
+	for _, info := range cmd.Infos {
+		info.validate()
+	}
 
-	vyos := server.NewParserFromShowConfiguration()
-	tree := vyos.Tree
+	tree := ctx.ConfigTree()
 	for _, info := range cmd.Infos {
-		createIPsec(tree, info)
+		createIPsec(ctx, tree, info)
 	}
 	tree.Apply(false)
 
@@ -167,56 +190,112 @@ func createIPsecConnection(ctx *server.CommandContext) interface{} {
 func syncIPsecConnection(ctx *server.CommandContext) interface{} {
 	cmd := &syncIPsecCmd{}
 	ctx.GetCommand(cmd)
+	for _, info := range cmd.Infos {
+		info.validate()
+	}
 
-	vyos := server.NewParserFromShowConfiguration()
-	tree := vyos.Tree
+	tree := ctx.ConfigTree()
 
-	tree.Delete("vpn ipsec")
+	// only the changed connections are set, the SAs of others are kept
+	desired := &server.VyosConfigTree{}
+	for _, info := range cmd.Infos {
+		setIPsecVpn(ctx, desired, info)
+	}
+	tree.Reconcile("vpn ipsec", desired)
+
+	// delete the rules of the connections not synced, and the shared ones if no connection is left
+	owned := make(map[string]bool)
+	for _, info := range cmd.Infos {
+		for _, o := range ipsecRuleOwners(info) {
+			owned[o.Id()] = true
+		}
+	}
+	for _, r := range tree.FindRulesByOwner(func(o server.RuleOwner) bool {
+		if o.Feature != server.RULE_FEATURE_IPSEC {
+			return false
+		}
+		return (o.Resource != "" && !owned[o.Id()]) || (o.Resource == "" && len(cmd.Infos) == 0)
+	}) {
+		r.Node().Delete()
+	}
 
 	for _, info := range cmd.Infos {
-		createIPsec(tree, info)
+		setIPsecFirewall(ctx, tree, info)
 	}
 	tree.Apply(false)
 
 	return nil
 }
 
+// bumped when the rules of the IPsec connections are changed
+const IPSEC_RULE_VERSION = 1
+
+// the connection is empty for the local firewall rules shared by all connections
+func makeIPsecRuleOwner(connectionUuid, key string) server.RuleOwner {
+	return server.RuleOwner{ Feature: server.RULE_FEATURE_IPSEC, Resource: connectionUuid, Version: IPSEC_RULE_VERSION, Key: key }
+}
+
+// the owners of the firewall and snat rules of the connection
+func ipsecRuleOwners(info ipsecInfo) []server.RuleOwner {
+	owners := make([]server.RuleOwner, 0)
+	for _, cidr := range info.PeerCidrs {
+		owners = append(owners, makeIPsecRuleOwner(info.Uuid, cidr))
+		if info.ExcludeSnat && len(info.LocalCidrs) == 1 {
+			owners = append(owners, makeIPsecRuleOwner(info.Uuid, fmt.Sprintf("%s-%s", info.LocalCidrs[0], cidr)))
+		}
+	}
+	return owners
+}
+
+// ipsec-500-udp, ipsec-4500-udp, ipsec-esp and ipsec-ah shared by all connections,
+// IPSEC-<uuid>-<peer cidr> and ipsec-<uuid>-<local cidr>-<peer cidr>
+func parseLegacyIPsecDescription(des string) (string, string, bool) {
+	if des == "ipsec-500-udp" || des == "ipsec-4500-udp" || des == "ipsec-esp" || des == "ipsec-ah" {
+		return "", strings.TrimPrefix(des, "ipsec-"), true
+	}
+
+	if fs := strings.SplitN(des, "-", 3); len(fs) == 3 && (fs[0] == "IPSEC" || fs[0] == "ipsec") {
+		return fs[1], fs[2], true
+	}
+	return "", "", false
+}
+
 func deleteIPsecConnection(ctx *server.CommandContext) interface{} {
 	cmd := &deleteIPsecCmd{}
 	ctx.GetCommand(cmd)
+	for _, info := range cmd.Infos {
+		info.validateConnection()
+	}
 
-	vyos := server.NewParserFromShowConfiguration()
-	tree := vyos.Tree
+	tree := ctx.ConfigTree()
 	for _, info := range cmd.Infos {
-		deleteIPsec(tree, info)
+		deleteIPsec(ctx, tree, info)
 	}
 	tree.Apply(false)
 
 	return nil
 }
 
-func deleteIPsec(tree *server.VyosConfigTree, info ipsecInfo) {
-	nicname, err := utils.GetNicNameByIp(info.Vip); utils.PanicOnError(err)
+func deleteIPsec(ctx *server.CommandContext, tree *server.VyosConfigTree, info ipsecInfo) {
+	nicname, err := ctx.NicNameByIp(info.Vip); utils.PanicOnError(err)
 
-	tree.Deletef("vpn ipsec ike-group %s", info.Uuid)
-	tree.Deletef("vpn ipsec esp-group %s", info.Uuid)
-	tree.Deletef("vpn ipsec site-to-site peer %s", info.PeerAddress)
+	tree.DeletePath("vpn", "ipsec", "ike-group", info.Uuid)
+	tree.DeletePath("vpn", "ipsec", "esp-group", info.Uuid)
+	tree.DeletePath("vpn", "ipsec", "site-to-site", "peer", info.PeerAddress)
 
 	if info.ExcludeSnat {
-		utils.Assertf(len(info.LocalCidrs) == 1, "localCidrs%v containing more than one CIDR is not supported yet", info.LocalCidrs)
+		utils.AssertArgument(len(info.LocalCidrs) == 1, "localCidrs%v containing more than one CIDR is not supported yet", info.LocalCidrs)
 		localCidr := info.LocalCidrs[0]
 
 		for _, remoteCidr := range info.PeerCidrs {
-			des := fmt.Sprintf("ipsec-%s-%s-%s", info.Uuid, localCidr, remoteCidr)
-			if r := tree.FindSnatRuleDescription(des); r != nil {
+			if r := tree.FindSnatRuleByOwner(makeIPsecRuleOwner(info.Uuid, fmt.Sprintf("%s-%s", localCidr, remoteCidr))); r != nil {
 				r.Delete()
 			}
 		}
 	}
 
 	for _, cidr := range info.PeerCidrs {
-		des := fmt.Sprintf("IPSEC-%s-%s", info.Uuid, cidr)
-		if r := tree.FindFirewallRuleByDescription(nicname, "in", des); r != nil {
+		if r := tree.FindFirewallRuleByOwner(nicname, "in", makeIPsecRuleOwner(info.Uuid, cidr)); r != nil {
 			r.Delete()
 		}
 	}
@@ -229,23 +308,20 @@ func deleteIPsec(tree *server.VyosConfigTree, info ipsecInfo) {
 		tree.Delete("vpn ipsec")
 
 		// delete firewall
-		if r := tree.FindFirewallRuleByDescription(nicname, "local", "ipsec-500-udp"); r != nil {
-			r.Delete()
-		}
-		if r := tree.FindFirewallRuleByDescription(nicname, "local", "ipsec-4500-udp"); r != nil {
-			r.Delete()
-		}
-		if r := tree.FindFirewallRuleByDescription(nicname, "local", "ipsec-esp"); r != nil {
-			r.Delete()
-		}
-		if r := tree.FindFirewallRuleByDescription(nicname, "local", "ipsec-ah"); r != nil {
-			r.Delete()
+		for _, key := range []string{ "500-udp", "4500-udp", "esp", "ah" } {
+			if r := tree.FindFirewallRuleByOwner(nicname, "local", makeIPsecRuleOwner("", key)); r != nil {
+				r.Delete()
+			}
 		}
 	}
 }
 
 func IPsecEntryPoint() {
-	server.RegisterAsyncCommandHandler(CREATE_IPSEC_CONNECTION, server.VyosLock(createIPsecConnection))
-	server.RegisterAsyncCommandHandler(DELETE_IPSEC_CONNECTION, server.VyosLock(deleteIPsecConnection))
-	server.RegisterAsyncCommandHandler(SYNC_IPSEC_CONNECTION, server.VyosLock(syncIPsecConnection))
+	server.RegisterLegacyRuleOwner(server.RULE_FEATURE_IPSEC, parseLegacyIPsecDescription)
+	// ipsec changes the nat and firewall rules of the vip nic and attaches the firewall to it
+	resources := []string{ server.RESOURCE_IPSEC, server.RESOURCE_NAT_SOURCE, server.RESOURCE_FIREWALL, server.RESOURCE_INTERFACES }
+	server.RegisterAsyncCommandHandler(CREATE_IPSEC_CONNECTION, server.ResourceLock(createIPsecConnection, resources...))
+	server.RegisterAsyncCommandHandler(DELETE_IPSEC_CONNECTION, server.ResourceLock(deleteIPsecConnection, resources...))
+	server.RegisterAsyncCommandHandler(SYNC_IPSEC_CONNECTION, server.ResourceLock(syncIPsecConnection, resources...))
+	server.RegisterBatchCommand(CREATE_IPSEC_CONNECTION, DELETE_IPSEC_CONNECTION, SYNC_IPSEC_CONNECTION)
 }
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"github.com/fatih/structs"
 	"strings"
+	"strconv"
 	"fmt"
 	"path/filepath"
 	"io/ioutil"
@@ -18,7 +19,9 @@ import (
 const (
 	REFRESH_LB_PATH = "/lb/refresh"
 	DELETE_LB_PATH = "/lb/delete"
+)
 
+var (
 	LB_ROOT_DIR = "/home/vyos/zvr/lb/"
 )
 
@@ -41,6 +44,35 @@ func makeLbConfFilePath(lb lbInfo) string {
 	return filepath.Join(LB_ROOT_DIR, "conf", fmt.Sprintf("lb-%v-listener-%v.cfg", lb.LbUuid, lb.ListenerUuid))
 }
 
+// the uuids name the files, the parameters are written into the config of haproxy
+func (lb lbInfo) validate() {
+	utils.AssertUuidArgument("lbUuid", lb.LbUuid)
+	utils.AssertUuidArgument("listenerUuid", lb.ListenerUuid)
+	utils.AssertIpArgument("vip", lb.Vip)
+	for _, ip := range lb.NicIps {
+		utils.AssertIpArgument("nicIps", ip)
+	}
+	utils.AssertPortRangeArgument("instancePort", lb.InstancePort, lb.InstancePort)
+	utils.AssertPortRangeArgument("loadBalancerPort", lb.LoadBalancerPort, lb.LoadBalancerPort)
+	utils.AssertOneOfArgument("mode", lb.Mode, "tcp", "http")
+
+	for _, param := range lb.Parameters {
+		kv := strings.SplitN(param, "::", 2)
+		utils.AssertArgument(len(kv) == 2, "the parameter[%s] is not in the format of key::value", param)
+		utils.AssertWordArgument("the key of parameters", kv[0])
+		utils.AssertWordArgument(kv[0], kv[1])
+		if kv[0] == "healthCheckTarget" {
+			utils.AssertArgument(len(strings.Split(kv[1], ":")) == 2, "healthCheckTarget[%s] is not in the format of protocol:port", kv[1])
+		}
+	}
+}
+
+func validateLbs(lbs []lbInfo) {
+	for _, lb := range lbs {
+		lb.validate()
+	}
+}
+
 type refreshLbCmd struct {
 	Lbs []lbInfo `json:"lbs"`
 }
@@ -49,11 +81,49 @@ type deleteLbCmd struct {
 	Lbs []lbInfo `json:"lbs"`
 }
 
-func makeLbFirewallRuleDescription(lb lbInfo) string {
-	return fmt.Sprintf("LB-%v-%v", lb.LbUuid, lb.ListenerUuid)
+// bumped when the firewall rules of the load balancers are changed
+const LB_RULE_VERSION = 1
+
+func makeLbFirewallRuleOwner(lb lbInfo) server.RuleOwner {
+	return server.RuleOwner{ Feature: server.RULE_FEATURE_LB, Resource: lb.LbUuid, Version: LB_RULE_VERSION, Key: lb.ListenerUuid }
+}
+
+// the rule dropping the SYN packets while haproxy is reloaded
+func makeLbDropRuleOwner(lb lbInfo) server.RuleOwner {
+	o := makeLbFirewallRuleOwner(lb)
+	o.Key = fmt.Sprintf("%s-drop", lb.ListenerUuid)
+	return o
+}
+
+// LB-<lb uuid>-<listener uuid> or lb-<lb uuid>-<listener uuid>-drop
+func parseLegacyLbDescription(des string) (string, string, bool) {
+	if fs := strings.SplitN(des, "-", 3); len(fs) == 3 && (fs[0] == "LB" || fs[0] == "lb" && strings.HasSuffix(fs[2], "-drop")) {
+		return fs[1], fs[2], true
+	}
+	return "", "", false
 }
 
-func setLb(lb lbInfo) {
+// the rule accepting the traffic to the listener
+func setLbFirewallRule(tree *server.VyosConfigTree, nicname string, lb lbInfo) {
+	owner := makeLbFirewallRuleOwner(lb)
+	if r := tree.FindFirewallRuleByOwner(nicname, "local", owner); r == nil {
+		tree.SetFirewallOnInterface(nicname, "local",
+			server.ConfigPath("description", owner.Description()),
+			server.ConfigPath("destination", "address", lb.Vip),
+			server.ConfigPath("destination", "port", strconv.Itoa(lb.LoadBalancerPort)),
+			"protocol tcp",
+			"action accept",
+		)
+	} else {
+		tree.SetRuleOwner(r, owner)
+	}
+
+	tree.AttachFirewallToInterface(nicname, "local")
+}
+
+// without side effects, e.g. in a dry run, only the firewall rule kept after
+// the reload is set, the config of haproxy is not written and haproxy is not reloaded
+func setLb(ctx *server.CommandContext, lb lbInfo) {
 	conf := `global
 maxconn {{.MaxConnection}}
 log 127.0.0.1 local1
@@ -95,6 +165,14 @@ server nic-{{$ip}} {{$ip}}:{{$.InstancePort}} check port {{$.CheckPort}} inter {
 
 	err = tmpl.Execute(&buf, m); utils.PanicOnError(err)
 
+	nicname, err := server.GetNicNameByIp(lb.Vip); utils.PanicOnError(err)
+	if !ctx.HasSideEffects() {
+		tree := ctx.ConfigTree()
+		setLbFirewallRule(tree, nicname, lb)
+		tree.Apply(false)
+		return
+	}
+
 	pidPath := makeLbPidFilePath(lb)
 	err = utils.MkdirForFile(pidPath, 0755); utils.PanicOnError(err)
 	confPath := makeLbConfFilePath(lb)
@@ -103,38 +181,29 @@ server nic-{{$ip}} {{$ip}}:{{$.InstancePort}} check port {{$.CheckPort}} inter {
 
 	// drop SYN packets to make clients to resend
 	// this is for restarting LB without losing packets
-	nicname, err := utils.GetNicNameByIp(lb.Vip); utils.PanicOnError(err)
-	tree := server.NewParserFromShowConfiguration().Tree
-	dropRuleDes := fmt.Sprintf("lb-%v-%s-drop", lb.LbUuid, lb.ListenerUuid)
-	if r := tree.FindFirewallRuleByDescription(nicname, "local", dropRuleDes); r == nil {
+	tree := ctx.ConfigTree()
+	dropRuleOwner := makeLbDropRuleOwner(lb)
+	if r := tree.FindFirewallRuleByOwner(nicname, "local", dropRuleOwner); r == nil {
 		tree.SetFirewallOnInterface(nicname, "local",
-			fmt.Sprintf("description %v", dropRuleDes),
-			fmt.Sprintf("destination address %v", lb.Vip),
-			fmt.Sprintf("destination port %v", lb.LoadBalancerPort),
+			server.ConfigPath("description", dropRuleOwner.Description()),
+			server.ConfigPath("destination", "address", lb.Vip),
+			server.ConfigPath("destination", "port", strconv.Itoa(lb.LoadBalancerPort)),
 			"protocol tcp",
 			"tcp flags SYN",
 			"action drop",
 		)
+	} else {
+		tree.SetRuleOwner(r, dropRuleOwner)
 	}
 
-	des := makeLbFirewallRuleDescription(lb)
-	if r := tree.FindFirewallRuleByDescription(nicname, "local", des); r == nil {
-		tree.SetFirewallOnInterface(nicname, "local",
-			fmt.Sprintf("description %v", des),
-			fmt.Sprintf("destination address %v", lb.Vip),
-			fmt.Sprintf("destination port %v", lb.LoadBalancerPort),
-			"protocol tcp",
-			"action accept",
-		)
-	}
-
-	tree.AttachFirewallToInterface(nicname, "local")
+	owner := makeLbFirewallRuleOwner(lb)
+	setLbFirewallRule(tree, nicname, lb)
 	tree.Apply(false)
 
 	defer func() {
 		// delete the DROP SYNC rule on exit
-		tree := server.NewParserFromShowConfiguration().Tree
-		if r := tree.FindFirewallRuleByDescription(nicname, "local", dropRuleDes); r != nil {
+		tree := ctx.ConfigTree()
+		if r := tree.FindFirewallRuleByOwner(nicname, "local", dropRuleOwner); r != nil {
 			r.Delete()
 		}
 		tree.Apply(false)
@@ -143,13 +212,14 @@ server nic-{{$ip}} {{$ip}}:{{$.InstancePort}} check port {{$.CheckPort}} inter {
 	time.Sleep(time.Duration(1) * time.Second)
 
 	bash := utils.Bash{
-		Command: fmt.Sprintf("sudo /opt/vyatta/sbin/haproxy -D -f %s -p %s -sf $(cat %s)", confPath, pidPath, pidPath),
+		Command: fmt.Sprintf("sudo /opt/vyatta/sbin/haproxy -D -f %s -p %s -sf $(cat %s)",
+			utils.ShellQuote(confPath), utils.ShellQuote(pidPath), utils.ShellQuote(pidPath)),
 	}
 
 	if ret, _, _, err := bash.RunWithReturn(); ret != 0 || err != nil {
 		// fail, cleanup the firewall rule
-		tree = server.NewParserFromShowConfiguration().Tree
-		if r := tree.FindFirewallRuleByDescription(nicname, "local", des); r != nil {
+		tree = ctx.ConfigTree()
+		if r := tree.FindFirewallRuleByOwner(nicname, "local", owner); r != nil {
 			r.Delete()
 		}
 		tree.Apply(false)
@@ -158,38 +228,62 @@ server nic-{{$ip}} {{$ip}}:{{$.InstancePort}} check port {{$.CheckPort}} inter {
 	bash.PanicIfError()
 }
 
+// the listeners and the local firewall of the vip nics, the haproxy
+// reload of a listener doesn't block the commands of others
+func lbResources(lbs []lbInfo) []string {
+	rs := make([]string, 0)
+	for _, lb := range lbs {
+		nicname, err := server.GetNicNameByIp(lb.Vip); utils.PanicOnError(err)
+		rs = append(rs, server.LbListenerResource(lb.LbUuid, lb.ListenerUuid), server.FirewallResource(nicname, "local"),
+			server.InterfaceFirewallResource(nicname, "local"))
+	}
+
+	return rs
+}
+
 func refreshLb(ctx *server.CommandContext) interface{} {
 	cmd := &refreshLbCmd{}
 	ctx.GetCommand(cmd)
+	validateLbs(cmd.Lbs)
+	if len(cmd.Lbs) == 0 {
+		return nil
+	}
+	ctx.LockResources(lbResources(cmd.Lbs)...)
 
 	for _, lb := range cmd.Lbs {
 		if len(lb.NicIps) == 0 {
-			delLb(lb)
+			delLb(ctx, lb)
 		} else {
-			setLb(lb)
+			setLb(ctx, lb)
 		}
 	}
 
 	return nil
 }
 
-func delLb(lb lbInfo) {
+// without side effects, e.g. in a dry run, only the firewall rule is deleted, haproxy is not stopped
+func delLb(ctx *server.CommandContext, lb lbInfo) {
 	pidPath := makeLbPidFilePath(lb)
 	confPath := makeLbConfFilePath(lb)
 
-	pid, err := utils.FindPIDByPS(pidPath, confPath)
-	if pid > 0 {
-		err := utils.KillProcess(pid); utils.PanicOnError(err)
+	if ctx.HasSideEffects() {
+		pid, _ := utils.FindPIDByPS(pidPath, confPath)
+		if pid > 0 {
+			err := utils.KillProcess(pid); utils.PanicOnError(err)
+		}
 	}
 
-	nicname, err := utils.GetNicNameByIp(lb.Vip); utils.PanicOnError(err)
-	des := makeLbFirewallRuleDescription(lb)
-	tree := server.NewParserFromShowConfiguration().Tree
-	if r := tree.FindFirewallRuleByDescription(nicname, "local", des); r != nil {
+	nicname, err := server.GetNicNameByIp(lb.Vip); utils.PanicOnError(err)
+	tree := ctx.ConfigTree()
+	if r := tree.FindFirewallRuleByOwner(nicname, "local", makeLbFirewallRuleOwner(lb)); r != nil {
 		r.Delete()
 	}
 	tree.Apply(false)
 
+	if !ctx.HasSideEffects() {
+		return
+	}
+
 	if e, _ := utils.PathExists(pidPath); e {
 		err = os.Remove(pidPath); utils.LogError(err)
 	}
@@ -203,13 +297,20 @@ func deleteLb(ctx *server.CommandContext) interface{} {
 	ctx.GetCommand(cmd)
 
 	if len(cmd.Lbs) > 0 {
-		delLb(cmd.Lbs[0])
+		// the parameters aren't needed to delete it
+		lb := cmd.Lbs[0]
+		utils.AssertUuidArgument("lbUuid", lb.LbUuid)
+		utils.AssertUuidArgument("listenerUuid", lb.ListenerUuid)
+		utils.AssertIpArgument("vip", lb.Vip)
+		ctx.LockResources(lbResources(cmd.Lbs[:1])...)
+		delLb(ctx, cmd.Lbs[0])
 	}
 
 	return nil
 }
 
 func LbEntryPoint() {
-	server.RegisterAsyncCommandHandler(REFRESH_LB_PATH, server.VyosLock(refreshLb))
-	server.RegisterAsyncCommandHandler(DELETE_LB_PATH, server.VyosLock(deleteLb))
+	server.RegisterLegacyRuleOwner(server.RULE_FEATURE_LB, parseLegacyLbDescription)
+	server.RegisterAsyncCommandHandler(REFRESH_LB_PATH, refreshLb)
+	server.RegisterAsyncCommandHandler(DELETE_LB_PATH, deleteLb)
 }
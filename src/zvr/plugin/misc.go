@@ -1,6 +1,9 @@
 package plugin
 
-import "zvr/server"
+import (
+	"zvr/server"
+	"zvr/utils"
+)
 
 const (
 	INIT_PATH = "/init"
@@ -11,6 +14,8 @@ const (
 type InitConfig struct {
 	RestartDnsmasqAfterNumberOfSIGUSER1 int `json:"restartDnsmasqAfterNumberOfSIGUSER1"`
 	Uuid string `json:"uuid"`
+	// the new secret to sign the requests and replies, see server.ChangeAuthSecret
+	Secret string `json:"secret"`
 }
 
 type pingRsp struct {
@@ -22,7 +27,18 @@ var (
 )
 
 func initHandler(ctx *server.CommandContext) interface{} {
+	if ctx.IsDryRun() {
+		// the config and the secret are kept
+		ctx.GetCommand(&InitConfig{})
+		return nil
+	}
+
 	ctx.GetCommand(initConfig)
+	if initConfig.Secret != "" {
+		// only by a signed request, see server.ChangeAuthSecret
+		err := server.ChangeAuthSecret(initConfig.Secret)
+		utils.AssertArgument(err == nil, "unable to change the secret, %v", err)
+	}
 	return nil
 }
 
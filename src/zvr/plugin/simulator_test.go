@@ -0,0 +1,296 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"zvr/server"
+	"zvr/utils"
+)
+
+const simulatedVyosConfig = `interfaces {
+    ethernet eth0 {
+        address 172.20.14.114/16
+        address 172.20.14.200/16
+        address 172.20.14.201/16
+        hw-id fa:62:6b:d9:10:00
+    }
+    ethernet eth1 {
+        address 10.0.0.1/24
+        address 10.0.0.100/24
+        hw-id fa:62:6b:d9:10:01
+    }
+}
+`
+
+func TestMain(m *testing.M) {
+	// the workers remove the replies from the outbox after the tests get
+	// them, so the outbox is set once for all tests and never restored
+	dir, err := ioutil.TempDir("", "zvr-simulator-outbox"); utils.PanicOnError(err)
+	server.OUTBOX_DIR = dir
+
+	// the handlers are registered once, a test may run more than once
+	LbEntryPoint()
+	EipEntryPoint()
+	DnatEntryPoint()
+	IPsecEntryPoint()
+	VipEntryPoint()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type simulatedAgent struct {
+	t *testing.T
+	agent *httptest.Server
+	mgmt *httptest.Server
+	backend *server.SimulatedBackend
+	replies chan []byte
+}
+
+// the tasks are kept by the agent, the uuids are unique in all tests
+var simulatedTasks = 0
+
+// run the agent on a simulated vyos, the files are written to a temp dir
+func startSimulatedAgent(t *testing.T) (*simulatedAgent, func()) {
+	dir, err := ioutil.TempDir("", "zvr-simulator-test"); utils.PanicOnError(err)
+	oldBackend := server.CurrentBackend()
+	restore := func(u bool, lb, history, ranges string) func() {
+		return func() {
+			server.UNIT_TEST = u; LB_ROOT_DIR = lb; server.CONFIG_HISTORY_DIR = history; server.RULE_RANGES_FILE = ranges
+			server.SetBackend(oldBackend)
+			os.RemoveAll(dir)
+		}
+	}(server.UNIT_TEST, LB_ROOT_DIR, server.CONFIG_HISTORY_DIR, server.RULE_RANGES_FILE)
+	server.UNIT_TEST = false
+	LB_ROOT_DIR = filepath.Join(dir, "lb")
+	server.CONFIG_HISTORY_DIR = filepath.Join(dir, "history")
+	server.RULE_RANGES_FILE = filepath.Join(dir, "rule-ranges.json")
+
+	a := &simulatedAgent{ t: t, backend: server.NewSimulatedBackend(simulatedVyosConfig), replies: make(chan []byte, 1) }
+	server.SetBackend(a.backend)
+	a.mgmt = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body); utils.PanicOnError(err)
+		a.replies <- body
+	}))
+	a.agent = httptest.NewServer(server.Handler())
+
+	return a, func() {
+		a.agent.Close()
+		a.mgmt.Close()
+		restore()
+	}
+}
+
+// post the async command to the agent and wait for the reply sent to the mgmt server
+func (a *simulatedAgent) call(path string, dryRun bool, body interface{}, rsp interface{}) {
+	b, err := json.Marshal(body); utils.PanicOnError(err)
+	req, err := http.NewRequest(http.MethodPost, a.agent.URL + path, bytes.NewReader(b)); utils.PanicOnError(err)
+	simulatedTasks++
+	req.Header.Set(server.TASK_UUID, fmt.Sprintf("task-%v", simulatedTasks))
+	req.Header.Set(server.CALLBACK_URL, a.mgmt.URL)
+	if dryRun {
+		req.Header.Set(server.DRY_RUN, "true")
+	}
+
+	r, err := http.DefaultClient.Do(req); utils.PanicOnError(err)
+	r.Body.Close()
+	utils.Assertf(r.StatusCode == http.StatusOK, "the command[%s] is not acked, %v", path, r.Status)
+
+	select {
+	case reply := <-a.replies:
+		utils.PanicOnError(json.Unmarshal(reply, rsp))
+	case <-time.After(10 * time.Second):
+		a.t.Fatalf("no reply of the command[%s]", path)
+	}
+}
+
+func (a *simulatedAgent) succeed(path string, body interface{}) {
+	rsp := server.CommandResponseHeader{}
+	a.call(path, false, body, &rsp)
+	utils.Assertf(rsp.Success, "the command[%s] failed, %s", path, rsp.Error)
+}
+
+// the sync of what is committed changes nothing, neither in a dry run nor in a commit
+func (a *simulatedAgent) syncAgain(path string, body interface{}) {
+	dryRun := server.DryRunResponse{}
+	a.call(path, true, body, &dryRun)
+	utils.Assertf(dryRun.Success && len(dryRun.Commands) == 0, "the second sync[%s] changes the config, %v", path, dryRun.Commands)
+
+	commits := a.backend.Commits()
+	a.succeed(path, body)
+	utils.Assertf(a.backend.Commits() == commits, "the second sync[%s] is committed:\n%s", path, a.backend.ShowConfiguration())
+}
+
+func (a *simulatedAgent) running() *server.VyosConfigTree {
+	return server.NewParserFromConfiguration(a.backend.ShowConfiguration()).Tree
+}
+
+func TestSimulatedLb(t *testing.T) {
+	a, stop := startSimulatedAgent(t)
+	defer stop()
+	b := a.backend
+
+	lb := lbInfo{
+		LbUuid: "6bd3b3ab3e4a4b4e9b8e0d7a7d2c9f01",
+		ListenerUuid: "1c0a6e0b5d2f4a7e8c3b9d6f4e2a1b02",
+		Vip: "10.0.0.100",
+		NicIps: []string{ "10.0.0.10" },
+		InstancePort: 80,
+		LoadBalancerPort: 8080,
+		Mode: "tcp",
+		Parameters: []string{ "maxConnection::2000", "healthCheckTarget::tcp:default" },
+	}
+	owner := makeLbFirewallRuleOwner(lb)
+
+	// the dry run records the accept rule only
+	dryRun := server.DryRunResponse{}
+	a.call(REFRESH_LB_PATH, true, refreshLbCmd{ Lbs: []lbInfo{ lb } }, &dryRun)
+	utils.Assertf(dryRun.Success && dryRun.DryRun && len(dryRun.Commands) != 0, "wrong dry run %+v", dryRun)
+	utils.Assertf(b.Commits() == 0, "the dry run is committed:\n%s", b.ShowConfiguration())
+
+	// the rule is committed to the simulated vyos, no file is written and no haproxy runs
+	rsp := server.CommandResponseHeader{}
+	a.call(REFRESH_LB_PATH, false, refreshLbCmd{ Lbs: []lbInfo{ lb } }, &rsp)
+	utils.Assertf(rsp.Success, "the lb is not refreshed, %s", rsp.Error)
+	running := a.running()
+	r := running.FindFirewallRuleByOwner("eth1", "local", owner)
+	utils.Assertf(r != nil && r.Get("destination port").Value() == "8080", "the lb rule is not committed:\n%s", b.ShowConfiguration())
+	utils.Assertf(running.FindFirewallRuleByOwner("eth1", "local", makeLbDropRuleOwner(lb)) == nil, "the drop rule is committed:\n%s", b.ShowConfiguration())
+	exists, _ := utils.PathExists(LB_ROOT_DIR)
+	utils.Assert(!exists, "the files of haproxy are written in the simulation")
+
+	rsp = server.CommandResponseHeader{}
+	a.call(DELETE_LB_PATH, false, deleteLbCmd{ Lbs: []lbInfo{ lb } }, &rsp)
+	utils.Assertf(rsp.Success, "the lb is not deleted, %s", rsp.Error)
+	utils.Assertf(a.running().FindFirewallRuleByOwner("eth1", "local", owner) == nil, "the lb rule is not deleted:\n%s", b.ShowConfiguration())
+}
+
+// the vip is on eth0, the guest is behind eth1
+func assertEipCommitted(a *simulatedAgent, eip eipInfo, committed bool) {
+	running := a.running()
+	owner := makeEipOwner(eip)
+	snat := running.FindSnatRuleByOwner(owner)
+	dnat := running.FindDnatRuleByOwner(owner)
+	rules := []*server.VyosConfigNode{ snat, dnat,
+		running.FindFirewallRuleByOwner("eth0", "in", owner), running.FindFirewallRuleByOwner("eth1", "in", owner) }
+
+	for _, r := range rules {
+		utils.Assertf((r != nil) == committed, "the rules of the EIP[%s] are wrong, committed: %v\n%s", eip.VipIp, committed, a.backend.ShowConfiguration())
+	}
+	if committed {
+		utils.Assertf(snat.Get("translation address").Value() == eip.VipIp && dnat.Get("translation address").Value() == eip.GuestIp,
+			"wrong nat rules of the EIP[%s]:\n%s", eip.VipIp, a.backend.ShowConfiguration())
+	}
+}
+
+func TestSimulatedEip(t *testing.T) {
+	a, stop := startSimulatedAgent(t)
+	defer stop()
+
+	eip1 := eipInfo{ VipIp: "172.20.14.200", PrivateMac: "fa:62:6b:d9:10:01", GuestIp: "10.0.0.10" }
+	eip2 := eipInfo{ VipIp: "172.20.14.201", PrivateMac: "fa:62:6b:d9:10:01", GuestIp: "10.0.0.11" }
+
+	a.succeed(VR_CREATE_EIP, setEipCmd{ Eip: eip1 })
+	assertEipCommitted(a, eip1, true)
+
+	sync := syncEipCmd{ Eips: []eipInfo{ eip1, eip2 } }
+	a.succeed(VR_SYNC_EIP, sync)
+	assertEipCommitted(a, eip1, true)
+	assertEipCommitted(a, eip2, true)
+	a.syncAgain(VR_SYNC_EIP, sync)
+
+	a.succeed(VR_REMOVE_EIP, removeEipCmd{ Eip: eip1 })
+	assertEipCommitted(a, eip1, false)
+	assertEipCommitted(a, eip2, true)
+}
+
+func TestSimulatedPortForwarding(t *testing.T) {
+	a, stop := startSimulatedAgent(t)
+	defer stop()
+
+	// the EIP on another vip is not touched by the sync of the port forwardings
+	eip := eipInfo{ VipIp: "172.20.14.200", PrivateMac: "fa:62:6b:d9:10:01", GuestIp: "10.0.0.10" }
+	a.succeed(VR_CREATE_EIP, setEipCmd{ Eip: eip })
+
+	pf := func(port int) dnatInfo {
+		return dnatInfo{ VipPortStart: port, VipPortEnd: port, PrivatePortStart: port, PrivatePortEnd: port, ProtocolType: "TCP",
+			VipIp: "172.20.14.201", PrivateIp: "10.0.0.11", PrivateMac: "fa:62:6b:d9:10:01", AllowedCidr: "0.0.0.0/0" }
+	}
+	assertPfCommitted := func(r dnatInfo, committed bool) {
+		running := a.running()
+		owner := makeDnatOwner(r)
+		dnat := running.FindDnatRuleByOwner(owner)
+		fr := running.FindFirewallRuleByOwner("eth0", "in", owner)
+		utils.Assertf((dnat != nil) == committed && (fr != nil) == committed, "the rules of the port forwarding[%v] are wrong, committed: %v\n%s",
+			r.VipPortStart, committed, a.backend.ShowConfiguration())
+		if committed {
+			utils.Assertf(dnat.Get("translation port").Value() == fmt.Sprintf("%v", r.PrivatePortStart),
+				"wrong dnat rule of the port forwarding[%v]:\n%s", r.VipPortStart, a.backend.ShowConfiguration())
+		}
+	}
+
+	sync := syncDnatCmd{ Rules: []dnatInfo{ pf(22), pf(80) } }
+	a.succeed(SYNC_PORT_FORWARDING_PATH, sync)
+	assertPfCommitted(pf(22), true)
+	assertPfCommitted(pf(80), true)
+	assertEipCommitted(a, eip, true)
+	a.syncAgain(SYNC_PORT_FORWARDING_PATH, sync)
+
+	// the port forwarding not synced is deleted, the others and the EIP are kept
+	a.succeed(SYNC_PORT_FORWARDING_PATH, syncDnatCmd{ Rules: []dnatInfo{ pf(80) } })
+	assertPfCommitted(pf(22), false)
+	assertPfCommitted(pf(80), true)
+	assertEipCommitted(a, eip, true)
+}
+
+func TestSimulatedIPsec(t *testing.T) {
+	a, stop := startSimulatedAgent(t)
+	defer stop()
+
+	info := ipsecInfo{
+		Uuid: "b7d5e1d0c7a94c0c8a1e4f2b3c4d5e6f",
+		LocalCidrs: []string{ "10.0.0.0/24" },
+		PeerAddress: "172.20.14.50",
+		AuthMode: "psk",
+		AuthKey: "a secret",
+		Vip: "172.20.14.114",
+		IkeAuthAlgorithm: "sha1",
+		IkeEncryptionAlgorithm: "aes128",
+		IkeDhGroup: 2,
+		PolicyAuthAlgorithm: "sha1",
+		PolicyEncryptionAlgorithm: "aes128",
+		PolicyMode: "tunnel",
+		PeerCidrs: []string{ "192.168.1.0/24" },
+		ExcludeSnat: true,
+	}
+	assertIPsecCommitted := func(committed bool) {
+		running := a.running()
+		rules := []*server.VyosConfigNode{
+			running.Getf("vpn ipsec site-to-site peer %s tunnel 1 remote prefix 192.168.1.0/24", info.PeerAddress),
+			running.FindFirewallRuleByOwner("eth0", "in", makeIPsecRuleOwner(info.Uuid, "192.168.1.0/24")),
+			running.FindFirewallRuleByOwner("eth0", "local", makeIPsecRuleOwner("", "esp")),
+			running.FindSnatRuleByOwner(makeIPsecRuleOwner(info.Uuid, "10.0.0.0/24-192.168.1.0/24")),
+		}
+		for _, r := range rules {
+			utils.Assertf((r != nil) == committed, "the IPsec connection is wrong, committed: %v\n%s", committed, a.backend.ShowConfiguration())
+		}
+	}
+
+	sync := syncIPsecCmd{ Infos: []ipsecInfo{ info } }
+	a.succeed(SYNC_IPSEC_CONNECTION, sync)
+	assertIPsecCommitted(true)
+	a.syncAgain(SYNC_IPSEC_CONNECTION, sync)
+
+	// no connection is left
+	a.succeed(SYNC_IPSEC_CONNECTION, syncIPsecCmd{ Infos: []ipsecInfo{} })
+	assertIPsecCommitted(false)
+}
@@ -1,9 +1,9 @@
 package plugin
 
 import (
+	"strconv"
 	"zvr/server"
 	"zvr/utils"
-	"fmt"
 )
 
 const (
@@ -32,15 +32,24 @@ type syncSnatCmd struct {
 	Snats []snatInfo `json:"snats"`
 }
 
-var SNAT_RULE_NUMBER = 9999
+// the last rule, the range of server.RULE_FEATURE_SNAT
+var SNAT_RULE_NUMBER = server.MAX_RULE_NUMBER
+
+func (s snatInfo) validate() {
+	utils.AssertMacArgument("publicNicMac", s.PublicNicMac)
+	utils.AssertIpArgument("publicIp", s.PublicIp)
+	utils.AssertIpArgument("privateNicIp", s.PrivateNicIp)
+	utils.AssertNetmaskArgument("snatNetmask", s.SnatNetmask)
+}
 
 func setSnatHandler(ctx *server.CommandContext) interface{} {
 	cmd := &setSnatCmd{}
 	ctx.GetCommand(cmd)
 
 	s := cmd.Snat
-	tree := server.NewParserFromShowConfiguration().Tree
-	outNic, err := utils.GetNicNameByMac(s.PublicNicMac); utils.PanicOnError(err)
+	s.validate()
+	tree := ctx.ConfigTree()
+	outNic, err := ctx.NicNameByMac(s.PublicNicMac); utils.PanicOnError(err)
 	address, err := utils.GetNetworkNumber(s.PrivateNicIp, s.SnatNetmask); utils.PanicOnError(err)
 
 	if hasRuleNumberForAddress(tree, address) {
@@ -50,9 +59,9 @@ func setSnatHandler(ctx *server.CommandContext) interface{} {
 	// make source nat rule as the latest rule
 	// in case there are EIP rules
 	tree.SetSnatWithRuleNumber(SNAT_RULE_NUMBER,
-		fmt.Sprintf("outbound-interface %s", outNic),
-		fmt.Sprintf("source address %v", address),
-		fmt.Sprintf("translation address %s", s.PublicIp),
+		server.ConfigPath("outbound-interface", outNic),
+		server.ConfigPath("source", "address", address),
+		server.ConfigPath("translation", "address", s.PublicIp),
 	)
 
 	tree.Apply(false)
@@ -64,19 +73,15 @@ func removeSnatHandler(ctx *server.CommandContext) interface{} {
 	cmd := &removeSnatCmd{}
 	ctx.GetCommand(&cmd)
 
-	tree := server.NewParserFromShowConfiguration().Tree
-	rs := tree.Get("nat source rule")
-	if rs == nil {
-		return nil
-	}
-
+	tree := ctx.ConfigTree()
 	for _, s := range cmd.NatInfo {
+		// only the private network identifies the rule to remove
+		utils.AssertIpArgument("privateNicIp", s.PrivateNicIp)
+		utils.AssertNetmaskArgument("snatNetmask", s.SnatNetmask)
 		address, err := utils.GetNetworkNumber(s.PrivateNicIp, s.SnatNetmask); utils.PanicOnError(err)
 
-		for _, r := range rs.Children() {
-			if addr := r.Get("source address"); addr != nil && addr.Value() == address {
-				addr.Delete()
-			}
+		for _, m := range tree.FindAll("nat source rule * source address", server.Equals(address)) {
+			m.Node.Delete()
 		}
 	}
 
@@ -86,38 +91,28 @@ func removeSnatHandler(ctx *server.CommandContext) interface{} {
 }
 
 func hasRuleNumberForAddress(tree *server.VyosConfigTree, address string) bool {
-	rs := tree.Get("nat source rule")
-	if rs == nil {
-		return false
-	}
-
-	for _, r := range rs.Children() {
-		if addr := r.Get("source address"); addr != nil && addr.Value() == address {
-			return true
-		}
-	}
-
-	return false
+	return tree.FindFirst("nat source rule * source address", server.Equals(address)) != nil
 }
 
 func syncSnatHandler(ctx *server.CommandContext) interface{} {
 	cmd := &syncSnatCmd{}
 	ctx.GetCommand(cmd)
 
-	tree := server.NewParserFromShowConfiguration().Tree
-	utils.Assert(len(cmd.Snats) < 2, "multiple source nat are not supported yet")
+	tree := ctx.ConfigTree()
+	utils.AssertArgument(len(cmd.Snats) < 2, "multiple source nat are not supported yet")
 
 	for _, s := range cmd.Snats {
-		outNic, err := utils.GetNicNameByMac(s.PublicNicMac); utils.PanicOnError(err)
+		s.validate()
+		outNic, err := ctx.NicNameByMac(s.PublicNicMac); utils.PanicOnError(err)
 		address, err := utils.GetNetworkNumber(s.PrivateNicIp, s.SnatNetmask); utils.PanicOnError(err)
-		if rs := tree.Getf("nat source rule %v", SNAT_RULE_NUMBER); rs != nil {
+		if rs := tree.GetPath("nat", "source", "rule", strconv.Itoa(SNAT_RULE_NUMBER)); rs != nil {
 			rs.Delete()
 		}
 
 		tree.SetSnatWithRuleNumber(SNAT_RULE_NUMBER,
-			fmt.Sprintf("outbound-interface %s", outNic),
-			fmt.Sprintf("source address %s", address),
-			fmt.Sprintf("translation address %s", s.PublicIp),
+			server.ConfigPath("outbound-interface", outNic),
+			server.ConfigPath("source", "address", address),
+			server.ConfigPath("translation", "address", s.PublicIp),
 		)
 	}
 
@@ -127,7 +122,8 @@ func syncSnatHandler(ctx *server.CommandContext) interface{} {
 }
 
 func SnatEntryPoint() {
-	server.RegisterAsyncCommandHandler(SET_SNAT_PATH, server.VyosLock(setSnatHandler))
-	server.RegisterAsyncCommandHandler(REMOVE_SNAT_PATH, server.VyosLock(removeSnatHandler))
-	server.RegisterAsyncCommandHandler(SYNC_SNAT_PATH, server.VyosLock(syncSnatHandler))
+	server.RegisterAsyncCommandHandler(SET_SNAT_PATH, server.ResourceLock(setSnatHandler, server.RESOURCE_NAT_SOURCE))
+	server.RegisterAsyncCommandHandler(REMOVE_SNAT_PATH, server.ResourceLock(removeSnatHandler, server.RESOURCE_NAT_SOURCE))
+	server.RegisterAsyncCommandHandler(SYNC_SNAT_PATH, server.ResourceLock(syncSnatHandler, server.RESOURCE_NAT_SOURCE))
+	server.RegisterBatchCommand(SET_SNAT_PATH, REMOVE_SNAT_PATH, SYNC_SNAT_PATH)
 }
\ No newline at end of file
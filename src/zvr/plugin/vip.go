@@ -26,18 +26,23 @@ type removeVipCmd struct {
 	Vips []vipInfo `json:"vips"`
 }
 
+func (vip vipInfo) validate() {
+	utils.AssertIpArgument("ip", vip.Ip)
+	utils.AssertNetmaskArgument("netmask", vip.Netmask)
+	utils.AssertMacArgument("ownerEthernetMac", vip.OwnerEthernetMac)
+}
+
 func setVip(ctx *server.CommandContext) interface{} {
 	cmd := &setVipCmd{}
 	ctx.GetCommand(cmd)
 
-	tree := server.NewParserFromShowConfiguration().Tree
+	tree := ctx.ConfigTree()
 	for _, vip := range cmd.Vips {
-		nicname, err := utils.GetNicNameByMac(vip.OwnerEthernetMac); utils.PanicOnError(err)
+		vip.validate()
+		nicname, err := ctx.NicNameByMac(vip.OwnerEthernetMac); utils.PanicOnError(err)
 		cidr, err := utils.NetmaskToCIDR(vip.Netmask); utils.PanicOnError(err)
 		addr := fmt.Sprintf("%v/%v", vip.Ip, cidr)
-		if n := tree.Getf("interfaces ethernet %s address %v", nicname, addr); n == nil {
-			tree.SetfWithoutCheckExisting("interfaces ethernet %s address %v", nicname, addr)
-		}
+		tree.AddValuePath("interfaces", "ethernet", nicname, "address", addr)
 	}
 
 	tree.Apply(false)
@@ -49,13 +54,14 @@ func removeVip(ctx *server.CommandContext) interface{} {
 	cmd := &removeVipCmd{}
 	ctx.GetCommand(cmd)
 
-	tree := server.NewParserFromShowConfiguration().Tree
+	tree := ctx.ConfigTree()
 	for _, vip := range cmd.Vips {
-		nicname, err := utils.GetNicNameByMac(vip.OwnerEthernetMac); utils.PanicOnError(err)
+		vip.validate()
+		nicname, err := ctx.NicNameByMac(vip.OwnerEthernetMac); utils.PanicOnError(err)
 		cidr, err := utils.NetmaskToCIDR(vip.Netmask); utils.PanicOnError(err)
 		addr := fmt.Sprintf("%v/%v", vip.Ip, cidr)
 
-		tree.Deletef("interfaces ethernet %s address %v", nicname, addr)
+		tree.DeletePath("interfaces", "ethernet", nicname, "address", addr)
 	}
 
 	tree.Apply(false)
@@ -64,6 +70,7 @@ func removeVip(ctx *server.CommandContext) interface{} {
 }
 
 func VipEntryPoint()  {
-	server.RegisterAsyncCommandHandler(VR_CREATE_VIP, server.VyosLock(setVip))
-	server.RegisterAsyncCommandHandler(VR_REMOVE_VIP, server.VyosLock(removeVip))
+	server.RegisterAsyncCommandHandler(VR_CREATE_VIP, server.ResourceLock(setVip, server.RESOURCE_INTERFACES))
+	server.RegisterAsyncCommandHandler(VR_REMOVE_VIP, server.ResourceLock(removeVip, server.RESOURCE_INTERFACES))
+	server.RegisterBatchCommand(VR_CREATE_VIP, VR_REMOVE_VIP)
 }
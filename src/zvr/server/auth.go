@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"zvr/utils"
+	"github.com/pkg/errors"
+)
+
+var (
+	// how far the timestamp of a signed request can be from now
+	SIGNATURE_MAX_CLOCK_SKEW = time.Duration(5) * time.Minute
+	// the secret changed by a command, loaded after a restart
+	AUTH_SECRET_FILE = "/home/vyos/zvr/auth-secret"
+)
+
+type authenticator struct {
+	lock sync.Mutex
+	secret []byte
+	// signatures seen within the clock skew, to reject replayed requests
+	seen map[string]time.Time
+}
+
+var auth = &authenticator{ seen: make(map[string]time.Time) }
+
+// set the secret shared with the mgmt server. Once it's set, every request
+// must be signed and async replies are signed with it. An empty secret turns
+// the authentication off
+func SetAuthSecret(secret string) {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+
+	if secret == "" {
+		auth.secret = nil
+	} else {
+		auth.secret = []byte(secret)
+	}
+}
+
+// change the secret by a command, e.g. /init. Every request is verified once
+// a secret is set, so only a signed request can change it: the first one must
+// come from the bootstrap info or the saved one. The new secret is saved
+func ChangeAuthSecret(secret string) error {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+
+	if auth.secret == nil {
+		return errors.New("the secret can only be changed by a signed request, but no secret is set")
+	}
+	if secret == "" {
+		return errors.New("the secret cannot be empty")
+	}
+
+	if err := saveAuthSecret(secret); err != nil {
+		return errors.Wrap(err, "unable to save the secret")
+	}
+	auth.secret = []byte(secret)
+	return nil
+}
+
+// readable by the owner only, replaced at once
+func saveAuthSecret(secret string) error {
+	if err := os.MkdirAll(filepath.Dir(AUTH_SECRET_FILE), 0755); err != nil {
+		return err
+	}
+
+	tmp := AUTH_SECRET_FILE + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	_, err = f.WriteString(secret)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		// the file may exist with other modes
+		err = os.Chmod(tmp, 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, AUTH_SECRET_FILE)
+}
+
+// the secret saved by ChangeAuthSecret, empty if none
+func LoadSavedAuthSecret() string {
+	b, err := ioutil.ReadFile(AUTH_SECRET_FILE)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.LogError(err)
+		}
+		return ""
+	}
+	return string(b)
+}
+
+func getAuthSecret() []byte {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	return auth.secret
+}
+
+func (a *authenticator) checkReplay(signature string, now time.Time) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for s, expire := range a.seen {
+		if now.After(expire) {
+			delete(a.seen, s)
+		}
+	}
+
+	if _, ok := a.seen[signature]; ok {
+		return errors.New("the request is replayed")
+	}
+
+	a.seen[signature] = now.Add(SIGNATURE_MAX_CLOCK_SKEW * 2)
+	return nil
+}
+
+func (a *authenticator) verify(secret []byte, path, timestamp, signature string, header http.Header, body []byte) error {
+	if signature == "" || timestamp == "" {
+		return errors.New(fmt.Sprintf("the request is not signed, the header '%s' and '%s' are required",
+			utils.HEADER_SIGNATURE, utils.HEADER_SIGNATURE_TIMESTAMP))
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid timestamp[%s]", timestamp))
+	}
+
+	now := time.Now()
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > SIGNATURE_MAX_CLOCK_SKEW || skew < -SIGNATURE_MAX_CLOCK_SKEW {
+		return errors.New(fmt.Sprintf("the request is stale, the timestamp[%s] is %v away from now", timestamp, skew))
+	}
+
+	if !utils.VerifySignature(secret, path, timestamp, header, body, signature) {
+		return errors.New("the signature mismatches")
+	}
+
+	return a.checkReplay(signature, now)
+}
+
+// check the signature of the request if the secret is set,
+// the body is read and re-filled
+func authenticate(req *http.Request) error {
+	secret := getAuthSecret()
+	if secret == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return errors.Wrap(err, "unable to read the request body")
+	}
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+
+	return auth.verify(secret, req.URL.Path, req.Header.Get(utils.HEADER_SIGNATURE_TIMESTAMP),
+		req.Header.Get(utils.HEADER_SIGNATURE), req.Header, body)
+}
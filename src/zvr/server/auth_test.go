@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"zvr/utils"
+)
+
+func TestVerifySignature(t *testing.T) {
+	a := &authenticator{ seen: make(map[string]time.Time) }
+	secret := []byte("secret")
+	body := []byte(`{"greeting":"hello"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	header := http.Header{}
+	header.Set(CALLBACK_URL, "http://mgmt/reply")
+	header.Set(TASK_UUID, "task")
+	signature := utils.Sign(secret, "/test", now, header, body)
+
+	utils.Assert(a.verify(secret, "/test", "", "", header, body) != nil, "unsigned request")
+	utils.Assert(a.verify(secret, "/test", now, signature, header, []byte("{}")) != nil, "body changed")
+	utils.Assert(a.verify(secret, "/other", now, signature, header, body) != nil, "path changed")
+	utils.Assert(a.verify([]byte("other"), "/test", now, signature, header, body) != nil, "wrong secret")
+
+	// the headers telling where to reply and how to run are signed
+	for _, h := range []string{ CALLBACK_URL, TASK_UUID, DRY_RUN } {
+		changed := http.Header{}
+		for k, v := range header {
+			changed[k] = v
+		}
+		changed.Set(h, "changed")
+		utils.Assertf(a.verify(secret, "/test", now, signature, changed, body) != nil, "the header[%s] changed", h)
+	}
+
+	utils.PanicOnError(a.verify(secret, "/test", now, signature, header, body))
+	utils.Assert(a.verify(secret, "/test", now, signature, header, body) != nil, "replayed request")
+
+	stale := strconv.FormatInt(time.Now().Add(-SIGNATURE_MAX_CLOCK_SKEW * 2).Unix(), 10)
+	utils.Assert(a.verify(secret, "/test", stale, utils.Sign(secret, "/test", stale, header, body), header, body) != nil, "stale request")
+}
+
+func TestDispatchRejectUnsignedRequest(t *testing.T) {
+	SetAuthSecret("secret")
+	defer SetAuthSecret("")
+
+	path := "/testsigned"
+	RegisterSyncCommandHandler(path, func(ctx *CommandContext) interface{} {
+		return nil
+	})
+
+	body := []byte("{}")
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	dispatch(w, req)
+	utils.Assert(w.Code == http.StatusUnauthorized, fmt.Sprintf("unexpected status code %v", w.Code))
+
+	headers := make(map[string]string)
+	utils.PanicOnError(utils.SignHttpHeaders([]byte("secret"), path, body, headers))
+	req = httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w = httptest.NewRecorder()
+	dispatch(w, req)
+	utils.Assert(w.Code == http.StatusOK, fmt.Sprintf("unexpected status code %v", w.Code))
+}
+
+func TestChangeAuthSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zvr-auth-test"); utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	defer func(f string) { AUTH_SECRET_FILE = f }(AUTH_SECRET_FILE)
+	AUTH_SECRET_FILE = filepath.Join(dir, "auth-secret")
+	defer SetAuthSecret("")
+
+	// an unsigned request cannot set the first secret
+	SetAuthSecret("")
+	utils.Assert(ChangeAuthSecret("first") != nil, "the secret is set by an unsigned request")
+	utils.Assert(getAuthSecret() == nil && LoadSavedAuthSecret() == "", "the secret is set")
+
+	SetAuthSecret("old")
+	utils.PanicOnError(ChangeAuthSecret("new"))
+	utils.Assert(string(getAuthSecret()) == "new", "the secret is not changed")
+
+	info, err := os.Stat(AUTH_SECRET_FILE); utils.PanicOnError(err)
+	utils.Assertf(info.Mode().Perm() == 0600, "the secret file is readable by others, %v", info.Mode())
+	utils.Assert(LoadSavedAuthSecret() == "new", "the secret is not saved")
+}
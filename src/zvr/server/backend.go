@@ -0,0 +1,248 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"zvr/utils"
+)
+
+// The running config is shown from and committed to a backend. The vyos
+// backend runs cli-shell-api and the vyos scripts, the simulated one keeps
+// the config in memory so the agent runs on any linux box, see simulator.go.
+// The changes of a commit are staged by Set and Delete and committed by
+// Commit under the transaction lock, see rollback.go. The nics are looked
+// up on the backend too, and the handlers change the services out of the
+// config, e.g. reload haproxy, only if the backend runs them
+
+type Backend interface {
+	// the running config in the format of showCfg, panics if it cannot be shown
+	ShowConfiguration() string
+	// changed by every commit, including the ones out of zvr, it's cheap
+	// to get and tells if the cached config is still the running one.
+	// Empty if unknown, then the cache is only reloaded by its TTL
+	ConfigRevision() string
+	// stage the change of the path, the words are not quoted
+	Set(words []string) error
+	Delete(words []string) error
+	// commit the staged changes, nothing is committed if it fails
+	Commit(asVyosUser bool) error
+	// drop the staged changes
+	Discard()
+	// replace the running config, e.g. to roll back to a snapshot
+	Load(config string, asVyosUser bool) error
+	// run a vyos script, the args are filled into the script as utils.Bash does
+	RunScript(script string, args map[string]string, asVyosUser bool) error
+	// the name of the nic with the ip or the mac, a NIC_NOT_FOUND error if none
+	NicNameByIp(ip string) (string, error)
+	NicNameByMac(mac string) (string, error)
+	// the services out of the config run on the box, see CommandContext.HasSideEffects
+	RunsServices() bool
+}
+
+var (
+	// vyos appends a line to it at every commit, see 'system config-management commit-revisions'
+	CONFIG_COMMIT_LOG = "/config/archive/commits"
+
+	backendLock = &sync.Mutex{}
+	backend Backend = &vyosBackend{}
+)
+
+func SetBackend(b Backend) {
+	utils.Assert(b != nil, "backend cannot be nil")
+
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	backend = b
+	configs.invalidate()
+}
+
+func CurrentBackend() Backend {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	return backend
+}
+
+func GetNicNameByIp(ip string) (string, error) {
+	return CurrentBackend().NicNameByIp(ip)
+}
+
+func GetNicNameByMac(mac string) (string, error) {
+	return CurrentBackend().NicNameByMac(mac)
+}
+
+// the nics of a batch are looked up in the batch tree first, the
+// addresses set by the earlier entries are not on the nics yet
+func (ctx *CommandContext) NicNameByIp(ip string) (string, error) {
+	if ctx.batchTree != nil {
+		if name, ok := ctx.batchTree.nicNameByIp(ip); ok {
+			return name, nil
+		}
+	}
+	return GetNicNameByIp(ip)
+}
+
+func (ctx *CommandContext) NicNameByMac(mac string) (string, error) {
+	if ctx.batchTree != nil {
+		if name, ok := ctx.batchTree.nicNameByMac(mac); ok {
+			return name, nil
+		}
+	}
+	return GetNicNameByMac(mac)
+}
+
+func (t *VyosConfigTree) nicNameByIp(ip string) (string, bool) {
+	for _, m := range t.FindAll("interfaces ethernet * address") {
+		for _, addr := range m.Node.Values() {
+			if strings.SplitN(addr, "/", 2)[0] == ip {
+				return m.Captures[0], true
+			}
+		}
+	}
+	return "", false
+}
+
+func (t *VyosConfigTree) nicNameByMac(mac string) (string, bool) {
+	if ms := t.FindAll("interfaces ethernet * hw-id", Equals(strings.ToLower(mac))); len(ms) != 0 {
+		return ms[0].Captures[0], true
+	}
+	return "", false
+}
+
+// stage the $SET and $DELETE lines made by VyosConfigTree and commit them
+func commitScriptCommands(b Backend, commands []string, asVyosUser bool) error {
+	for _, c := range commands {
+		op, words, err := parseScriptCommand(c)
+		if err == nil {
+			switch op {
+			case "$SET":
+				err = b.Set(words)
+			case "$DELETE":
+				err = b.Delete(words)
+			default:
+				err = fmt.Errorf("unsupported command %s", op)
+			}
+		}
+
+		if err != nil {
+			b.Discard()
+			return utils.NewAgentError(utils.VYOS_COMMIT_FAILED, map[string]interface{}{ "command": c }, "invalid command[%s], %v", c, err)
+		}
+	}
+
+	return b.Commit(asVyosUser)
+}
+
+type vyosBackend struct {
+	lock sync.Mutex
+	// the script lines staged
+	staged []string
+}
+
+func (b *vyosBackend) ConfigRevision() string {
+	info, err := os.Stat(CONFIG_COMMIT_LOG)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%v-%v", info.ModTime().UnixNano(), info.Size())
+}
+
+func (b *vyosBackend) ShowConfiguration() string {
+	bash := utils.Bash{
+		Command: "/bin/cli-shell-api showCfg",
+		NoLog: true,
+	}
+
+	_, o, _, _ := bash.RunWithReturn()
+	bash.PanicIfError()
+	return o
+}
+
+func (b *vyosBackend) stage(line string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.staged = append(b.staged, line)
+}
+
+func (b *vyosBackend) Set(words []string) error {
+	b.stage(makeScriptCommand("$SET", words))
+	return nil
+}
+
+func (b *vyosBackend) Delete(words []string) error {
+	b.stage(makeScriptCommand("$DELETE", words))
+	return nil
+}
+
+func (b *vyosBackend) Commit(asVyosUser bool) error {
+	b.lock.Lock()
+	script := strings.Join(b.staged, "\n")
+	b.staged = nil
+	b.lock.Unlock()
+
+	return execVyosScript(script, asVyosUser)
+}
+
+func (b *vyosBackend) Discard() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.staged = nil
+}
+
+// the config has the secrets, e.g. the pre-shared keys of ipsec, it's
+// written to a private dir only the user running the script can read
+func (b *vyosBackend) Load(config string, asVyosUser bool) error {
+	dir, err := ioutil.TempDir("", "zvr-load")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.boot")
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		return err
+	}
+
+	if asVyosUser {
+		for _, p := range []string{ dir, path } {
+			if err = utils.ChownToUser(p, "vyos"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return execVyosScript(fmt.Sprintf("$API loadFile %s", path), asVyosUser)
+}
+
+func (b *vyosBackend) RunScript(script string, args map[string]string, asVyosUser bool) (err error) {
+	utils.Assert(args == nil || !asVyosUser, "the script run as user vyos takes no args")
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = panicToError(e)
+		}
+	}()
+
+	if asVyosUser {
+		runVyosScriptAsUserVyos(script)
+	} else {
+		runVyosScript(script, args)
+	}
+
+	return nil
+}
+
+func (b *vyosBackend) NicNameByIp(ip string) (string, error) {
+	return utils.GetNicNameByIp(ip)
+}
+
+func (b *vyosBackend) NicNameByMac(mac string) (string, error) {
+	return utils.GetNicNameByMac(mac)
+}
+
+func (b *vyosBackend) RunsServices() bool {
+	return true
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// /batch runs the commands of other paths in order against one shared
+// VyosConfigTree and commits it once, so either all their vyos changes
+// take effect or none does. Only the commands registered by
+// RegisterBatchCommand run in a batch, their handlers change nothing but
+// the tree, so a failed batch leaves no side effect behind, e.g. a
+// reloaded haproxy. The batch is async and runs alone like VyosLock,
+// with the header 'dryrun' it returns the changes instead of committing
+// them
+
+const (
+	BATCH_PATH = "/batch"
+)
+
+type batchEntry struct {
+	Path string `json:"path"`
+	Body json.RawMessage `json:"body"`
+}
+
+type batchCmd struct {
+	Entries []batchEntry `json:"entries"`
+}
+
+type batchEntryResult struct {
+	Path string `json:"path"`
+	Response interface{} `json:"response,omitempty"`
+}
+
+type batchRsp struct {
+	CommandResponseHeader
+	Results []batchEntryResult `json:"results"`
+}
+
+var (
+	// the paths allowed in a batch
+	batchCommands = make(map[string]bool)
+)
+
+// the handlers of the paths must change nothing but the VyosConfigTree
+func RegisterBatchCommand(paths ...string) {
+	for _, p := range paths {
+		batchCommands[p] = true
+	}
+}
+
+func runBatchEntry(ctx *CommandContext, index int, e batchEntry) interface{} {
+	wrap, ok := commandHandlers[e.Path]
+	if !ok {
+		panic(utils.NewAgentError(utils.INVALID_ARGUMENT, map[string]interface{}{ "index": index, "path": e.Path },
+			"the path[%s] of the batch entry[%v] is not a command", e.Path, index))
+	}
+	if !batchCommands[e.Path] {
+		panic(utils.NewAgentError(utils.INVALID_ARGUMENT, map[string]interface{}{ "index": index, "path": e.Path },
+			"the path[%s] of the batch entry[%v] has side effects out of the vyos config, it cannot run in a batch", e.Path, index))
+	}
+
+	body := []byte(e.Body)
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.Path, bytes.NewReader(body)); utils.PanicOnError(err)
+	entryCtx := &CommandContext{
+		responseWriter: ctx.responseWriter,
+		request: req,
+		task: ctx.task,
+		locked: true,
+		lockedAll: true,
+		dryRun: ctx.dryRun,
+		batchTree: ctx.batchTree,
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			// keep the code of the entry error, and tell which entry fails
+			rsp := errorResponse(err)
+			details := map[string]interface{}{ "index": index, "path": e.Path }
+			for k, v := range rsp.ErrorDetails {
+				details[k] = v
+			}
+			panic(utils.NewAgentError(rsp.ErrorCode, details, "the batch entry[%v, path:%s] failed, %s", index, e.Path, rsp.Error))
+		}
+	}()
+
+	ctx.PanicIfCancelled()
+	return wrap.chandler(entryCtx)
+}
+
+func batchHandler(ctx *CommandContext) interface{} {
+	cmd := &batchCmd{}
+	ctx.GetCommand(cmd)
+	utils.AssertArgument(len(cmd.Entries) > 0, "no entry in the batch")
+
+	if !ctx.lockedAll {
+		ctx.lockAll()
+		defer ctx.unlockAll()
+	}
+
+	// the entries get the tree through their contexts, other commands
+	// running meanwhile don't see it
+	tree := ctx.ConfigTree()
+	tree.inBatch = true
+	ctx.batchTree = tree
+
+	rsp := batchRsp{
+		CommandResponseHeader: CommandResponseHeader{ Success: true },
+		Results: make([]batchEntryResult, 0, len(cmd.Entries)),
+	}
+
+	for i, e := range cmd.Entries {
+		log.Debugf("[BATCH] run the entry[%v] of the path[%s]", i, e.Path)
+		rsp.Results = append(rsp.Results, batchEntryResult{
+			Path: e.Path,
+			Response: runBatchEntry(ctx, i, e),
+		})
+	}
+
+	tree.inBatch = false
+	log.Debugf("[BATCH] commit %v changes of %v entries", len(tree.Commands()), len(cmd.Entries))
+	tree.Apply(false)
+
+	return rsp
+}
+
+func init() {
+	RegisterAsyncCommandHandler(BATCH_PATH, batchHandler)
+}
+
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"zvr/utils"
+)
+
+type batchTestCmd struct {
+	Rule string `json:"rule"`
+}
+
+// the batch path is async, run its handler synchronously
+const BATCH_TEST_PATH = "/testbatch/batch"
+
+func postBatch(entries []batchEntry) CommandResponseHeader {
+	body, err := json.Marshal(batchCmd{ Entries: entries }); utils.PanicOnError(err)
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, BATCH_TEST_PATH, bytes.NewReader(body)))
+
+	rsp := CommandResponseHeader{}
+	utils.PanicOnError(json.Unmarshal(w.Body.Bytes(), &rsp))
+	return rsp
+}
+
+func TestBatch(t *testing.T) {
+	defer func(u bool, f func() string) { UNIT_TEST = u; ConfigurationSourceFunc = f }(UNIT_TEST, ConfigurationSourceFunc)
+	UNIT_TEST = false
+	ConfigurationSourceFunc = func() string { return "" }
+	defer useTempHistoryDir(t)()
+	calls, restore := mockVyosCommit(func(commands []string) error { return nil })
+	defer restore()
+
+	setRule := func(ctx *CommandContext) interface{} {
+		cmd := &batchTestCmd{}
+		ctx.GetCommand(cmd)
+		utils.AssertArgument(cmd.Rule != "bad", "bad rule")
+
+		tree := ctx.ConfigTree()
+		// the rules of the batch are not seen out of the batch before the commit
+		utils.Assert(!NewParserFromShowConfiguration().Tree.Has("firewall name eth0.in rule 1"), "the batch tree is shared")
+		tree.SetFirewallOnInterface("eth0", "in", fmt.Sprintf("description %s", cmd.Rule))
+		tree.Apply(false)
+		return nil
+	}
+	RegisterAsyncCommandHandler("/testbatch/async", ResourceLock(setRule, FirewallResource("eth0", "in")))
+	RegisterSyncCommandHandler("/testbatch/sync", VyosLock(setRule))
+	RegisterBatchCommand("/testbatch/async", "/testbatch/sync")
+	RegisterSyncCommandHandler(BATCH_TEST_PATH, batchHandler)
+
+	// a command with side effects is not run
+	sideEffects := 0
+	RegisterAsyncCommandHandler("/testbatch/sideeffect", func(ctx *CommandContext) interface{} {
+		sideEffects++
+		return nil
+	})
+
+	rsp := postBatch([]batchEntry{
+		{ Path: "/testbatch/async", Body: json.RawMessage(`{"rule": "r1"}`) },
+		{ Path: "/testbatch/sync", Body: json.RawMessage(`{"rule": "r2"}`) },
+	})
+	utils.Assertf(rsp.Success, "the batch failed, %s", rsp.Error)
+	utils.Assertf(len(*calls) == 1, "expected one commit, but got %v", len(*calls))
+	// the second entry sees the rule of the first one
+	utils.Assertf(len((*calls)[0]) == 2 && (*calls)[0][1] == "$SET firewall name eth0.in rule 2 description r2",
+		"unexpected commit %v", (*calls)[0])
+
+	rsp = postBatch([]batchEntry{
+		{ Path: "/testbatch/async", Body: json.RawMessage(`{"rule": "r1"}`) },
+		{ Path: "/testbatch/sync", Body: json.RawMessage(`{"rule": "bad"}`) },
+	})
+	utils.Assert(!rsp.Success, "the batch with a bad entry succeeds")
+	utils.Assertf(rsp.ErrorCode == utils.INVALID_ARGUMENT, "unexpected code %s", rsp.ErrorCode)
+	utils.Assertf(rsp.ErrorDetails["index"] == float64(1), "unexpected details %v", rsp.ErrorDetails)
+	utils.Assertf(len(*calls) == 1, "a failed batch is committed")
+
+	rsp = postBatch([]batchEntry{
+		{ Path: "/testbatch/async", Body: json.RawMessage(`{"rule": "r1"}`) },
+		{ Path: "/testbatch/sideeffect" },
+	})
+	utils.Assertf(!rsp.Success && rsp.ErrorCode == utils.INVALID_ARGUMENT && rsp.ErrorDetails["index"] == float64(1), "unexpected response %v", rsp)
+	utils.Assert(sideEffects == 0 && len(*calls) == 1, "the command with side effects is run")
+
+	rsp = postBatch([]batchEntry{ { Path: BATCH_PATH } })
+	utils.Assert(!rsp.Success, "a nested batch is allowed")
+	rsp = postBatch([]batchEntry{ { Path: BATCH_TEST_PATH } })
+	utils.Assert(!rsp.Success, "a nested batch is allowed")
+}
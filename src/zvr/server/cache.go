@@ -0,0 +1,129 @@
+package server
+
+import (
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+// The parsed running config is cached so commands don't run showCfg and
+// parse the whole config every time. Commands get a copy-on-write clone of
+// the cached tree, see VyosConfigNode.adopt. After a commit the cache is
+// replaced by the cached tree with the committed changes, see commitBatch;
+// other commits, e.g. scripts run by RunVyosScript, invalidate it. The
+// commits out of zvr are found by the config revision of the backend, which
+// is cheap to get, and the cache is reloaded anyway once it's older than the TTL
+
+const (
+	// seconds, zero disables the cache
+	DEFAULT_CONFIG_CACHE_TTL = 30
+)
+
+type configCache struct {
+	lock sync.Mutex
+	tree *VyosConfigTree
+	// changed each time the cached tree is replaced or invalidated
+	generation uint64
+	loadedAt time.Time
+	// the config revision of the backend when the tree is cached
+	revision string
+}
+
+var configs = &configCache{}
+
+func configCacheTTL() time.Duration {
+	return time.Duration(commandOptions.ConfigCacheTTL) * time.Second
+}
+
+// it's replaced in unit tests
+var configRevision = func() string {
+	return CurrentBackend().ConfigRevision()
+}
+
+func (c *configCache) validLocked() bool {
+	if c.tree == nil || time.Since(c.loadedAt) > configCacheTTL() {
+		return false
+	}
+
+	return configRevision() == c.revision
+}
+
+// a clone of the cached tree, the running config is shown and parsed if the cache is not valid
+func (c *configCache) clone() *VyosConfigTree {
+	if configCacheTTL() == 0 {
+		return NewParserFromConfiguration(ConfigurationSourceFunc()).Tree
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.validLocked() {
+		// got before the config is shown, a commit in between reloads it again
+		revision := configRevision()
+		c.generation++
+		c.tree = NewParserFromConfiguration(ConfigurationSourceFunc()).Tree
+		c.loadedAt = time.Now()
+		c.revision = revision
+		configCacheLoads.Inc()
+	} else {
+		configCacheHits.Inc()
+	}
+
+	t := c.tree.clone()
+	t.generation = c.generation
+	return t
+}
+
+// the running config printed from the cache, false if the cache is not valid
+func (c *configCache) currentConfig() (string, bool) {
+	if configCacheTTL() == 0 {
+		return "", false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.validLocked() {
+		return "", false
+	}
+	return c.tree.Config(), true
+}
+
+func (c *configCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	c.tree = nil
+}
+
+// the tree is the running config after a commit, it's cached if it
+// was cloned from the cache and no one else committed since. It's called
+// right after the commit, a commit out of zvr in between is found by the TTL
+func (c *configCache) update(t *VyosConfigTree) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if t.generation == 0 || t.generation != c.generation || c.tree == nil {
+		c.generation++
+		c.tree = nil
+		return
+	}
+
+	log.Debugf("[Vyos Configuration] update the cached configuration with the committed changes")
+	c.generation++
+	c.tree = t.copy()
+	c.revision = configRevision()
+}
+
+// nothing is committed since the tree is cloned from the cache
+func (c *configCache) isCurrent(t *VyosConfigTree) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return t.generation != 0 && t.generation == c.generation && c.tree != nil
+}
+
+// drop the cached config, e.g. after changing the config without zvr
+func InvalidateConfigCache() {
+	configs.invalidate()
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zvr/utils"
+)
+
+func TestConfigCache(t *testing.T) {
+	defer func(o Options, c *configCache) { commandOptions = o; configs = c }(commandOptions, configs)
+	commandOptions.ConfigCacheTTL = 30
+	configs = &configCache{}
+
+	defer func(u bool, f func() string) { UNIT_TEST = u; ConfigurationSourceFunc = f }(UNIT_TEST, ConfigurationSourceFunc)
+	UNIT_TEST = false
+
+	// the config is shown and parsed only if the revision is changed
+	defer func(f func() string) { configRevision = f }(configRevision)
+	revision := int64(1)
+	configRevision = func() string { return fmt.Sprintf("%v", atomic.LoadInt64(&revision)) }
+	shows := int64(0)
+	external := ""
+	ConfigurationSourceFunc = func() string {
+		atomic.AddInt64(&shows, 1)
+		return external + `
+firewall {
+    name eth0.in {
+        rule 1 {
+            action accept
+            description EIP-1
+        }
+        rule 2 {
+            action accept
+            description EIP-2
+        }
+    }
+}
+`
+	}
+	loaded := func() time.Time {
+		configs.lock.Lock()
+		defer configs.lock.Unlock()
+		return configs.loadedAt
+	}
+
+	defer useTempHistoryDir(t)()
+	// every commit changes the revision
+	_, restore := mockVyosCommit(func(commands []string) error {
+		atomic.AddInt64(&revision, 1)
+		return nil
+	})
+	defer restore()
+
+	t1 := NewParserFromShowConfiguration().Tree
+	firstLoad := loaded()
+	t2 := NewParserFromShowConfiguration().Tree
+	utils.Assert(loaded() == firstLoad, "the config is loaded again")
+	utils.Assertf(atomic.LoadInt64(&shows) == 1, "the config is shown %v times", atomic.LoadInt64(&shows))
+
+	// the clones don't see the changes of each other
+	r := t1.FindFirewallRuleByDescription("eth0", "in", "EIP-1")
+	utils.Assert(r != nil && r.String() == "firewall name eth0.in rule 1", "rule 1 not found")
+	r.Delete()
+	utils.Assert(t1.CommandsAsString() == "$DELETE firewall name eth0.in rule 1", t1.CommandsAsString())
+	utils.Assert(!t1.Has("firewall name eth0.in rule 1"), "rule 1 is not deleted")
+	utils.Assert(t2.Has("firewall name eth0.in rule 1"), "the change leaks to another clone")
+	for _, c := range t2.Get("firewall name eth0.in rule").Children() {
+		utils.Assert(c.tree == t2, fmt.Sprintf("the node[%s] is not adopted", c.String()))
+	}
+
+	// the cache is replaced by the committed tree, the mocked commit
+	// changes nothing, so the config shown is not changed
+	t1.Apply(false)
+	t3 := NewParserFromShowConfiguration().Tree
+	utils.Assertf(!t3.Has("firewall name eth0.in rule 1") && t3.Has("firewall name eth0.in rule 2"), "the cache is not updated:\n%s", t3.String())
+
+	// t2 is cloned before t1 is committed, the cache has the changes of both
+	t2.Delete("firewall name eth0.in rule 2")
+	t2.Apply(false)
+	t3 = NewParserFromShowConfiguration().Tree
+	utils.Assertf(t3.Get("firewall name eth0.in rule 1") == nil && t3.Get("firewall name eth0.in rule 2") == nil, "the cache is not updated:\n%s", t3.String())
+	utils.Assert(loaded() == firstLoad, "the config is loaded again")
+
+	// the concurrent commits, merged or not, update the cache too
+	wg := &sync.WaitGroup{}
+	for i := 3; i < 5; i++ {
+		tree := NewParserFromShowConfiguration().Tree
+		tree.Setf("firewall name eth0.in rule %v action accept", i)
+		wg.Add(1)
+		go func() { defer wg.Done(); tree.Apply(false) }()
+	}
+	wg.Wait()
+	shown := atomic.LoadInt64(&shows)
+	config := NewParserFromShowConfiguration().Tree.Config()
+	t3 = NewParserFromConfiguration(config).Tree
+	utils.Assertf(t3.Has("firewall name eth0.in rule 3 action accept") && t3.Has("firewall name eth0.in rule 4 action accept"), "the cache is not updated:\n%s", config)
+	utils.Assert(loaded() == firstLoad && atomic.LoadInt64(&shows) == shown, "the config is loaded again")
+
+	// the config is committed out of zvr, it's found at once by the revision
+	external = "service {\n    ssh {\n        port 2222\n    }\n}\n"
+	t3 = NewParserFromShowConfiguration().Tree
+	utils.Assert(loaded() == firstLoad, "the config is loaded again without a commit")
+	atomic.AddInt64(&revision, 1)
+	t3 = NewParserFromShowConfiguration().Tree
+	utils.Assert(loaded() != firstLoad && t3.Has("service ssh port 2222") && t3.Has("firewall name eth0.in rule 1"), "the config is not loaded after an external commit")
+
+	secondLoad := loaded()
+	InvalidateConfigCache()
+	NewParserFromShowConfiguration()
+	utils.Assert(loaded() != secondLoad, "the config is not loaded after the cache is invalidated")
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+// VyosConfigTree.Apply doesn't commit by itself, it queues the changes to
+// the commit scheduler which merges the changes queued while a commit is
+// running into the next vyos commit. A change queued on an idle router is
+// committed at once. Each caller gets the result of its own changes: if a
+// merged commit fails, it's split in halves and retried to find the broken
+// changes, the others are still committed
+
+var (
+	// how long the first queued changes wait for others to merge with,
+	// only if a commit of the other queue is running or pending
+	COMMIT_COALESCE_WINDOW = time.Duration(100) * time.Millisecond
+	// the max number of trees merged into one commit
+	COMMIT_MAX_BATCH = 64
+)
+
+type commitRequest struct {
+	commands []string
+	asVyosUser bool
+	// the command queuing the changes, archived with the config
+	trigger CommandTrigger
+	// the tree changed, nil if the commands are not from a tree
+	tree *VyosConfigTree
+	result chan error
+}
+
+type commitScheduler struct {
+	lock sync.Mutex
+	// the changes as user vyos are committed by a different script,
+	// so they are queued separately
+	pending map[bool][]*commitRequest
+	flushing map[bool]bool
+}
+
+var commits = &commitScheduler{
+	pending: make(map[bool][]*commitRequest),
+	flushing: make(map[bool]bool),
+}
+
+// commit the merged changes and return the config shown after the commit, it's replaced in unit tests
+var runVyosCommit = func(commands []string, asVyosUser bool) (config string, shown bool, err error) {
+	// rolled back if the commit fails, see rollback.go
+	return commitWithRollback(commands, asVyosUser)
+}
+
+// queue the changes and wait until they are committed, no command is archived with them
+func (s *commitScheduler) commit(commands []string, asVyosUser bool) error {
+	return s.queue(&commitRequest{
+		commands: commands,
+		asVyosUser: asVyosUser,
+		result: make(chan error, 1),
+	})
+}
+
+// commit the changes of the tree, archived with the command changing the tree
+func (s *commitScheduler) commitTree(t *VyosConfigTree, asVyosUser bool) error {
+	return s.queue(&commitRequest{
+		commands: t.changeCommands,
+		asVyosUser: asVyosUser,
+		trigger: t.trigger,
+		tree: t,
+		result: make(chan error, 1),
+	})
+}
+
+func (s *commitScheduler) queue(r *commitRequest) error {
+	asVyosUser := r.asVyosUser
+
+	s.lock.Lock()
+	s.pending[asVyosUser] = append(s.pending[asVyosUser], r)
+	if !s.flushing[asVyosUser] {
+		s.flushing[asVyosUser] = true
+		// the commit waits for the other one anyway, merge more changes meanwhile
+		go s.flush(asVyosUser, s.flushing[!asVyosUser])
+	}
+	s.lock.Unlock()
+
+	return <-r.result
+}
+
+// commit the queued changes until the queue is empty. The changes
+// queued while a commit is running are merged into the next one
+func (s *commitScheduler) flush(asVyosUser bool, wait bool) {
+	if wait {
+		time.Sleep(COMMIT_COALESCE_WINDOW)
+	}
+
+	for {
+		s.lock.Lock()
+		batch := s.pending[asVyosUser]
+		if len(batch) == 0 {
+			s.flushing[asVyosUser] = false
+			s.lock.Unlock()
+			return
+		}
+
+		if len(batch) > COMMIT_MAX_BATCH {
+			batch = batch[:COMMIT_MAX_BATCH]
+		}
+		s.pending[asVyosUser] = s.pending[asVyosUser][len(batch):]
+		s.lock.Unlock()
+
+		vyosCommitBatchSize.Observe(float64(len(batch)))
+		s.commitBatchSafely(batch, asVyosUser)
+	}
+}
+
+// a panic fails the whole batch instead of killing the flushing goroutine,
+// which would leave the callers waiting and the queue flushing forever
+func (s *commitScheduler) commitBatchSafely(batch []*commitRequest, asVyosUser bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			err := panicToError(e)
+			log.Warnf("the commit of %v changes panicked, %v", len(batch), err)
+			// the running config is unknown
+			configs.invalidate()
+
+			for _, r := range batch {
+				// the requests replied before the panic have got their results
+				select {
+				case r.result <- err:
+				default:
+				}
+			}
+		}
+	}()
+
+	s.commitBatch(batch, asVyosUser)
+}
+
+func (s *commitScheduler) commitBatch(batch []*commitRequest, asVyosUser bool) {
+	commands := make([]string, 0)
+	for _, r := range batch {
+		commands = append(commands, r.commands...)
+	}
+
+	base := cloneConfigBeforeCommit()
+	config, shown, err := runVyosCommit(commands, asVyosUser)
+	// the merged trees each miss the changes of others, the running config
+	// is the cached one with the changes of all of them
+	if err == nil && shown && base != nil && configs.isCurrent(base) && base.applyScriptCommands(commands) == nil {
+		configs.update(base)
+	} else {
+		configs.invalidate()
+	}
+
+	if err == nil {
+		triggers := make([]CommandTrigger, 0, len(batch))
+		for _, r := range batch {
+			triggers = append(triggers, r.trigger)
+		}
+		// the config shown under the transaction lock is the one committed
+		if shown {
+			history.archive(triggers, commands, config)
+		} else {
+			log.Warnf("unable to archive the configuration, it cannot be shown after the commit")
+		}
+
+		for _, r := range batch {
+			if r.tree != nil {
+				r.tree.commitRuleRanges()
+			}
+		}
+	}
+
+	if err == nil || len(batch) == 1 {
+		for _, r := range batch {
+			r.result <- err
+		}
+		return
+	}
+
+	// a failed commit changes nothing, bisect to find the broken changes
+	log.Warnf("the merged commit of %v changes failed, split it to find the broken ones, %v", len(batch), err)
+	mid := len(batch) / 2
+	s.commitBatch(batch[:mid], asVyosUser)
+	s.commitBatch(batch[mid:], asVyosUser)
+}
+
+// the running config the changes are committed on, nil if it's not cached or cannot be shown
+func cloneConfigBeforeCommit() (t *VyosConfigTree) {
+	if configCacheTTL() == 0 {
+		return nil
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			log.Debugf("unable to show the configuration before the commit, %v", e)
+			t = nil
+		}
+	}()
+
+	return configs.clone()
+}
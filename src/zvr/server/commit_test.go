@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zvr/utils"
+)
+
+func mockVyosCommit(fn func(commands []string) error) (*[][]string, func()) {
+	lock := &sync.Mutex{}
+	calls := make([][]string, 0)
+	old := runVyosCommit
+	runVyosCommit = func(commands []string, asVyosUser bool) (string, bool, error) {
+		lock.Lock()
+		calls = append(calls, commands)
+		lock.Unlock()
+		if err := fn(commands); err != nil {
+			return "", false, err
+		}
+		// nothing is committed, the config shown is not changed
+		config, err := takeConfigSnapshot()
+		return config, err == nil, nil
+	}
+
+	return &calls, func() { runVyosCommit = old }
+}
+
+func commitConcurrently(n int, command func(i int) string) []error {
+	errs := make([]error, n)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = commits.commit([]string{ command(i) }, false)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestCommitCoalescing(t *testing.T) {
+	defer func(w time.Duration) { COMMIT_COALESCE_WINDOW = w }(COMMIT_COALESCE_WINDOW)
+	COMMIT_COALESCE_WINDOW = time.Duration(2) * time.Second
+	calls, restore := mockVyosCommit(func(commands []string) error {
+		time.Sleep(time.Duration(200) * time.Millisecond)
+		return nil
+	})
+	defer restore()
+
+	// the router is idle, the commit doesn't wait the window
+	start := time.Now()
+	utils.PanicOnError(commits.commit([]string{ "$SET rule 0" }, false))
+	utils.Assertf(time.Since(start) < time.Second, "the commit on an idle router takes %v", time.Since(start))
+
+	// the changes queued while the first commit is running are merged into the next one
+	errs := commitConcurrently(10, func(i int) string { return fmt.Sprintf("$SET rule %v", i) })
+	for _, err := range errs {
+		utils.PanicOnError(err)
+	}
+
+	changes := 0
+	for _, c := range (*calls)[1:] {
+		changes += len(c)
+	}
+	utils.Assertf(len(*calls) <= 3 && changes == 10, "the changes are not merged, %v", (*calls)[1:])
+
+	// a commit as user vyos is running, the changes wait the window to merge with others
+	*calls = (*calls)[:0]
+	done := make(chan error, 1)
+	go func() { done <- commits.commit([]string{ "$SET vyos" }, true) }()
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	errs = commitConcurrently(5, func(i int) string { return fmt.Sprintf("$SET rule %v", i) })
+	for _, err := range errs {
+		utils.PanicOnError(err)
+	}
+	utils.PanicOnError(<-done)
+	utils.Assertf(len(*calls) == 2 && len((*calls)[1]) == 5, "the changes are not merged, %v", *calls)
+}
+
+func TestCommitBisect(t *testing.T) {
+	defer func(w time.Duration) { COMMIT_COALESCE_WINDOW = w }(COMMIT_COALESCE_WINDOW)
+	COMMIT_COALESCE_WINDOW = time.Duration(200) * time.Millisecond
+	calls, restore := mockVyosCommit(func(commands []string) error {
+		for _, c := range commands {
+			if strings.Contains(c, "broken") {
+				return fmt.Errorf("commit failed")
+			}
+		}
+		return nil
+	})
+	defer restore()
+
+	errs := commitConcurrently(8, func(i int) string {
+		if i == 5 {
+			return "$SET broken"
+		}
+		return fmt.Sprintf("$SET rule %v", i)
+	})
+
+	for i, err := range errs {
+		if i == 5 {
+			utils.Assert(err != nil, "the broken change is committed")
+		} else {
+			utils.Assertf(err == nil, "the change %v failed, %v", i, err)
+		}
+	}
+
+	committed := 0
+	for _, c := range *calls {
+		if !strings.Contains(strings.Join(c, "\n"), "broken") {
+			committed += len(c)
+		}
+	}
+	utils.Assertf(committed == 7, "%v good changes are committed", committed)
+}
+
+func TestCommitPanic(t *testing.T) {
+	defer func(w time.Duration) { COMMIT_COALESCE_WINDOW = w }(COMMIT_COALESCE_WINDOW)
+	COMMIT_COALESCE_WINDOW = time.Duration(200) * time.Millisecond
+	_, restore := mockVyosCommit(func(commands []string) error {
+		for _, c := range commands {
+			if strings.Contains(c, "panic") {
+				panic("unexpected")
+			}
+		}
+		return nil
+	})
+	defer restore()
+
+	errs := commitConcurrently(4, func(i int) string { return fmt.Sprintf("$SET panic %v", i) })
+	for i, err := range errs {
+		utils.Assertf(err != nil && strings.Contains(err.Error(), "unexpected"), "the change %v doesn't get the panic, %v", i, err)
+	}
+
+	// the queue is still flushed after the panic
+	done := make(chan error, 1)
+	go func() { done <- commits.commit([]string{ "$SET rule 1" }, false) }()
+	select {
+	case err := <-done:
+		utils.PanicOnError(err)
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("the commit after the panic is not flushed")
+	}
+}
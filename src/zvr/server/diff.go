@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+)
+
+// Diff compares two config trees node by node and returns the commands
+// changing the current one to the desired one. A subtree only in the
+// current tree is deleted by one $DELETE, a subtree only in the desired
+// tree is set leaf by leaf. The values of a multi-value node are children
+// of the node, so only the values added or removed are set or deleted.
+// The $DELETE commands come first, then the $SET commands in the order of
+// the desired tree
+
+type configDiff struct {
+	// the nodes of the current tree to delete
+	deleted []*VyosConfigNode
+	// the nodes of the desired tree to add, and the current nodes they are added to
+	added []*VyosConfigNode
+	addedTo []*VyosConfigNode
+}
+
+// in the order of the current tree
+func (d *configDiff) compareDeleted(cur, des *VyosConfigNode) {
+	for _, c := range cur.Children() {
+		if dc := des.getNode(c.name); dc == nil {
+			d.deleted = append(d.deleted, c)
+		} else {
+			d.compareDeleted(c, dc)
+		}
+	}
+}
+
+// in the order of the desired tree
+func (d *configDiff) compareAdded(cur, des *VyosConfigNode) {
+	for _, c := range des.children {
+		if cc := cur.getNode(c.name); cc == nil {
+			d.added = append(d.added, c)
+			d.addedTo = append(d.addedTo, cur)
+		} else {
+			d.compareAdded(cc, c)
+		}
+	}
+}
+
+func (d *configDiff) commands() []string {
+	commands := make([]string, 0)
+	for _, n := range d.deleted {
+		commands = append(commands, makeScriptCommand("$DELETE", n.words()))
+	}
+	for _, n := range d.added {
+		for _, l := range leafNodes(n) {
+			commands = append(commands, makeScriptCommand("$SET", l.words()))
+		}
+	}
+	return commands
+}
+
+// the leaves under the node, e.g. the value of "interfaces ethernet eth0 address 1.1.1.1/24"
+func leafNodes(n *VyosConfigNode) []*VyosConfigNode {
+	if len(n.children) == 0 {
+		return []*VyosConfigNode{ n }
+	}
+
+	leaves := make([]*VyosConfigNode, 0)
+	for _, c := range n.children {
+		leaves = append(leaves, leafNodes(c)...)
+	}
+	return leaves
+}
+
+func diffNodes(cur, des *VyosConfigNode) *configDiff {
+	d := &configDiff{}
+	if cur == nil {
+		cur = &VyosConfigNode{}
+	}
+	if des == nil {
+		des = &VyosConfigNode{}
+	}
+
+	d.compareDeleted(cur, des)
+	d.compareAdded(cur, des)
+	return d
+}
+
+func rootOf(t *VyosConfigTree) *VyosConfigNode {
+	if t == nil {
+		return nil
+	}
+	return t.Root
+}
+
+// the commands changing the current config to the desired one
+func Diff(current, desired *VyosConfigTree) []string {
+	return diffNodes(rootOf(current), rootOf(desired)).commands()
+}
+
+// change the config under the path to what it is in the desired tree, the
+// changes are recorded like Set and Delete. The config out of the path is
+// not touched, so the desired tree only needs to have the path. It returns
+// true if anything is changed
+func (t *VyosConfigTree) Reconcile(path string, desired *VyosConfigTree) bool {
+	t.init()
+	cur := t.Get(path)
+	des := rootOf(desired)
+	if des != nil {
+		des = des.Get(path)
+	}
+
+	if des == nil {
+		return t.Delete(path)
+	}
+
+	if cur == nil {
+		cur = t.Root.addPath(splitConfigPath(path))
+	}
+
+	d := diffNodes(cur, des)
+	t.changeCommands = append(t.changeCommands, d.commands()...)
+	for _, n := range d.deleted {
+		n.deleteSelf()
+	}
+	for i, n := range d.added {
+		copyConfigNode(d.addedTo[i], n)
+	}
+
+	return len(d.deleted) != 0 || len(d.added) != 0
+}
+
+func copyConfigNode(parent, n *VyosConfigNode) {
+	c := parent.addNode(n.name)
+	c.quoted, c.tag, c.block, c.comments = n.quoted, n.tag, n.block, n.comments
+	for _, cn := range n.children {
+		copyConfigNode(c, cn)
+	}
+}
+
+// change the config under the path, e.g. a rule, to exactly the config
+// given, the config already there is not set again
+func (t *VyosConfigTree) ReconcileConfig(path string, config...string) bool {
+	desired := &VyosConfigTree{}
+	desired.init()
+	for _, c := range config {
+		desired.Root.addPath(splitConfigPath(fmt.Sprintf("%s %s", path, c)))
+	}
+
+	return t.Reconcile(path, desired)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func TestDiff(t *testing.T) {
+	current := NewParserFromConfiguration(`
+interfaces {
+    ethernet eth0 {
+        address 172.20.14.209/16
+        address 10.0.0.1/24
+        description main
+    }
+}
+nat {
+    destination {
+        rule 100 {
+            description EIP-1
+            destination {
+                address 172.20.14.100
+            }
+        }
+        rule 101 {
+            description EIP-2
+        }
+    }
+}
+`).Tree
+
+	desired := NewParserFromConfiguration(`
+interfaces {
+    ethernet eth0 {
+        address 172.20.14.209/16
+        address 10.0.0.2/24
+        description main
+    }
+}
+nat {
+    destination {
+        rule 100 {
+            description EIP-1
+            destination {
+                address 172.20.14.101
+            }
+        }
+        rule 102 {
+            description EIP-3
+            inbound-interface eth0
+        }
+    }
+}
+`).Tree
+
+	expected := []string{
+		"$DELETE interfaces ethernet eth0 address 10.0.0.1/24",
+		"$DELETE nat destination rule 100 destination address 172.20.14.100",
+		"$DELETE nat destination rule 101",
+		"$SET interfaces ethernet eth0 address 10.0.0.2/24",
+		"$SET nat destination rule 100 destination address 172.20.14.101",
+		"$SET nat destination rule 102 description EIP-3",
+		"$SET nat destination rule 102 inbound-interface eth0",
+	}
+	commands := Diff(current, desired)
+	utils.Assert(strings.Join(commands, "\n") == strings.Join(expected, "\n"), fmt.Sprintf("wrong diff:\n%s", strings.Join(commands, "\n")))
+
+	utils.Assert(len(Diff(current, current)) == 0, "no diff expected for the same tree")
+	utils.Assert(Diff(nil, desired)[0] == "$SET interfaces ethernet eth0 address 172.20.14.209/16", "the empty tree should get all leaves set")
+	utils.Assert(strings.Join(Diff(current, nil), "\n") == "$DELETE interfaces\n$DELETE nat", "everything should be deleted")
+}
+
+func TestReconcile(t *testing.T) {
+	tree := NewParserFromConfiguration(`
+interfaces {
+    ethernet eth0 {
+        address 172.20.14.209/16
+    }
+}
+nat {
+    destination {
+        rule 100 {
+            description EIP-1
+        }
+        rule 101 {
+            description EIP-2
+        }
+    }
+}
+`).Tree
+
+	desired := &VyosConfigTree{}
+	desired.Set("nat destination rule 100 description EIP-1")
+	desired.Set("nat destination rule 102 description EIP-3")
+
+	// the interfaces are not in the desired tree but out of the path
+	utils.Assert(tree.Reconcile("nat destination", desired), "changes expected")
+	utils.Assert(tree.CommandsAsString() == "$DELETE nat destination rule 101\n$SET nat destination rule 102 description EIP-3", tree.CommandsAsString())
+	utils.Assert(tree.Has("interfaces ethernet eth0 address 172.20.14.209/16"), "the interfaces should be kept")
+	utils.Assert(tree.Has("nat destination rule 102 description EIP-3") && !tree.Has("nat destination rule 101"), "the tree should be changed")
+	utils.Assert(!tree.Reconcile("nat destination", desired), "no changes expected the second time")
+
+	utils.Assert(tree.Reconcile("nat destination", &VyosConfigTree{}), "changes expected")
+	utils.Assert(!tree.Has("nat destination"), "the path should be deleted")
+}
+
+func TestReconcileConfig(t *testing.T) {
+	tree := NewParserFromConfiguration(`
+firewall {
+    name eth0.in {
+        rule 1 {
+            action accept
+            description EIP-1
+            state {
+                new enable
+            }
+        }
+        rule 2 {
+            action accept
+            description 1.1.1.1-22-22-fa:00-22-22-TCP
+            destination {
+                address 10.0.0.2
+            }
+        }
+    }
+}
+`).Tree
+
+	found := tree.FindFirewallRulesByDescription(func(des string) bool { return strings.HasPrefix(des, "EIP") })
+	utils.Assert(len(found) == 1 && found[0].String() == "firewall name eth0.in rule 1", fmt.Sprintf("wrong rules %v", found))
+
+	// the unchanged rule is not set again
+	utils.Assert(!tree.ReconcileConfig("firewall name eth0.in rule 1", "action accept", "description EIP-1", "state new enable"), "no changes expected")
+
+	tree.ReconcileConfig("firewall name eth0.in rule 2", "action accept", "description 1.1.1.1-22-22-fa:00-22-22-TCP", "destination address 10.0.0.3")
+	utils.Assert(tree.CommandsAsString() == "$DELETE firewall name eth0.in rule 2 destination address 10.0.0.2\n$SET firewall name eth0.in rule 2 destination address 10.0.0.3",
+		tree.CommandsAsString())
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sync"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// A command with the header 'dryrun: true' runs as usual except that
+// VyosConfigTree.Apply records the changes instead of committing them.
+// The reply is a DryRunResponse with the changes and the rule numbers
+// allocated. The dry-run command runs alone, like VyosLock. The handlers
+// skip what they change out of the tree unless HasSideEffects(), e.g. the
+// files of the services, and a vyos script run in a dry run is rejected
+
+const (
+	DRY_RUN = "dryrun"
+)
+
+type RuleAllocation struct {
+	// firewall, nat source or nat destination
+	Type string `json:"type"`
+	// the firewall name, e.g. eth0.in
+	Name string `json:"name,omitempty"`
+	Number int `json:"number"`
+	// the feature owning the number, see rules.go
+	Feature string `json:"feature,omitempty"`
+}
+
+type DryRunResponse struct {
+	CommandResponseHeader
+	DryRun bool `json:"dryRun"`
+	Commands []string `json:"commands"`
+	Rules []RuleAllocation `json:"rules"`
+	// what the handler returns
+	Response interface{} `json:"response,omitempty"`
+}
+
+var (
+	dryRunLock = &sync.Mutex{}
+	dryRunRecorder *DryRunResponse
+)
+
+func (ctx *CommandContext) IsDryRun() bool {
+	return ctx.dryRun
+}
+
+// the files and the processes of the services are changed, neither in a
+// dry run nor if the backend runs no service, e.g. the simulated vyos
+func (ctx *CommandContext) HasSideEffects() bool {
+	return !ctx.dryRun && CurrentBackend().RunsServices()
+}
+
+func setDryRunRecorder(r *DryRunResponse) {
+	dryRunLock.Lock()
+	defer dryRunLock.Unlock()
+	dryRunRecorder = r
+}
+
+// record the changes of the tree if a dry-run command is running
+func recordDryRun(t *VyosConfigTree) bool {
+	dryRunLock.Lock()
+	defer dryRunLock.Unlock()
+
+	if dryRunRecorder == nil {
+		return false
+	}
+
+	log.Debugf("[Vyos Configuration] dry run, skip the commit of %v changes", len(t.changeCommands))
+	dryRunRecorder.Commands = append(dryRunRecorder.Commands, t.changeCommands...)
+	dryRunRecorder.Rules = append(dryRunRecorder.Rules, t.allocatedRules...)
+	return true
+}
+
+// for the changes not made by a tree, e.g. loading a config
+func recordDryRunCommands(commands []string) bool {
+	dryRunLock.Lock()
+	defer dryRunLock.Unlock()
+
+	if dryRunRecorder == nil {
+		return false
+	}
+
+	dryRunRecorder.Commands = append(dryRunRecorder.Commands, commands...)
+	return true
+}
+
+// the changes that cannot be recorded must not be made in a dry run
+func panicIfDryRun(what string) {
+	dryRunLock.Lock()
+	running := dryRunRecorder != nil
+	dryRunLock.Unlock()
+
+	utils.AssertArgument(!running, "%s is not supported in a dry run", what)
+}
+
+func dryRun(ctx *CommandContext, fn CommandHandler) interface{} {
+	// no other command may commit while the changes are recorded
+	ctx.lockAll()
+	defer ctx.unlockAll()
+	ctx.PanicIfCancelled()
+
+	rec := &DryRunResponse{
+		CommandResponseHeader: CommandResponseHeader{ Success: true },
+		DryRun: true,
+		Commands: make([]string, 0),
+		Rules: make([]RuleAllocation, 0),
+	}
+	setDryRunRecorder(rec)
+	defer setDryRunRecorder(nil)
+
+	rec.Response = fn(ctx)
+	return *rec
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"zvr/utils"
+)
+
+func TestDryRun(t *testing.T) {
+	path := "/testdryrun"
+	RegisterSyncCommandHandler(path, ResourceLock(func(ctx *CommandContext) interface{} {
+		tree := NewParserFromConfiguration(`firewall {
+    name eth0.in {
+        rule 1 {
+            action accept
+        }
+    }
+}`).Tree
+		tree.SetFirewallOnInterface("eth0", "in", "action drop")
+		tree.Apply(false)
+		return map[string]string{ "hello": "world" }
+	}, FirewallResource("eth0", "in")))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte("{}")))
+	req.Header.Set(DRY_RUN, "true")
+	dispatch(w, req)
+	utils.Assertf(w.Code == http.StatusOK, "unexpected status code %v, %s", w.Code, w.Body.String())
+
+	rsp := DryRunResponse{}
+	utils.PanicOnError(json.Unmarshal(w.Body.Bytes(), &rsp))
+	utils.Assert(rsp.Success && rsp.DryRun, "not a dry run")
+	utils.Assertf(len(rsp.Commands) == 1 && rsp.Commands[0] == "$SET firewall name eth0.in rule 2 action drop",
+		"unexpected commands %v", rsp.Commands)
+	utils.Assertf(len(rsp.Rules) == 1 && rsp.Rules[0] == RuleAllocation{ Type: "firewall", Name: "eth0.in", Number: 2, Feature: RULE_FEATURE_DEFAULT },
+		"unexpected rules %v", rsp.Rules)
+	utils.Assertf(rsp.Response.(map[string]interface{})["hello"] == "world", "unexpected response %v", rsp.Response)
+	utils.Assert(dryRunRecorder == nil, "the recorder is not reset")
+}
+
+func callDryRun(path string, body interface{}, rsp interface{}) {
+	b, err := json.Marshal(body); utils.PanicOnError(err)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+	req.Header.Set(DRY_RUN, "true")
+	dispatch(w, req)
+	utils.PanicOnError(json.Unmarshal(w.Body.Bytes(), rsp))
+}
+
+func TestDryRunSideEffects(t *testing.T) {
+	defer useTempHistoryDir(t)()
+	config := "interfaces {\n}\n"
+	defer func(f func() string) { ConfigurationSourceFunc = f }(ConfigurationSourceFunc)
+	ConfigurationSourceFunc = func() string { return config }
+	configs.invalidate()
+	defer configs.invalidate()
+
+	history.archive([]CommandTrigger{ { Path: "/test" } }, []string{ "$SET test" }, config)
+	config = "interfaces {\n}\nservice {\n    ssh {\n        port 22\n    }\n}\n"
+	configs.invalidate()
+	scripts, restore := mockVyosScript(func(script string) error { return nil })
+	defer restore()
+
+	// the rollback records the changes to the version and loads nothing
+	RegisterSyncCommandHandler("/testdryrun/rollback", VyosLock(configHistoryRollbackHandler))
+	rsp := DryRunResponse{}
+	callDryRun("/testdryrun/rollback", configHistoryRollbackCmd{ Version: 1 }, &rsp)
+	utils.Assertf(rsp.Success && len(rsp.Commands) == 1 && rsp.Commands[0] == "$DELETE service", "unexpected response %v", rsp)
+	utils.Assertf(len(*scripts) == 0 && len(history.versions()) == 1, "the version is loaded, %v", *scripts)
+
+	// a vyos script cannot be recorded, it's rejected
+	RegisterSyncCommandHandler("/testdryrun/script", func(ctx *CommandContext) interface{} {
+		RunVyosScript("$SET service ssh port 2222", nil)
+		return nil
+	})
+	rsp = DryRunResponse{}
+	callDryRun("/testdryrun/script", nil, &rsp)
+	utils.Assertf(!rsp.Success && rsp.ErrorCode == utils.INVALID_ARGUMENT, "the script is not rejected, %v", rsp)
+	utils.Assert(len(*scripts) == 0, fmt.Sprintf("the script is run %v", *scripts))
+}
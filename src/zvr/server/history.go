@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// The running config after every successful commit is archived as a version
+// with the commands that triggered the commit. The last CONFIG_HISTORY_MAX
+// versions are kept, they can be listed, diffed and rolled back to
+
+const (
+	CONFIG_HISTORY_LIST_PATH = "/config/history/list"
+	CONFIG_HISTORY_DIFF_PATH = "/config/history/diff"
+	CONFIG_HISTORY_ROLLBACK_PATH = "/config/history/rollback"
+)
+
+var (
+	CONFIG_HISTORY_DIR = "/home/vyos/zvr/history"
+	CONFIG_HISTORY_MAX = 50
+)
+
+// the command that changed the config
+type CommandTrigger struct {
+	Path string `json:"path"`
+	TaskUuid string `json:"taskUuid,omitempty"`
+}
+
+type ConfigVersion struct {
+	Version int `json:"version"`
+	Time time.Time `json:"time"`
+	Triggers []CommandTrigger `json:"triggers"`
+	Commands []string `json:"commands"`
+	Config string `json:"config,omitempty"`
+}
+
+type configHistory struct {
+	lock sync.Mutex
+}
+
+var history = &configHistory{}
+
+// the trees are built by CommandContext.ConfigTree with the trigger
+func (ctx *CommandContext) trigger() CommandTrigger {
+	if ctx.request == nil {
+		return CommandTrigger{}
+	}
+
+	return CommandTrigger{ Path: ctx.request.URL.Path, TaskUuid: ctx.TaskUuid() }
+}
+
+func (h *configHistory) versionPath(version int) string {
+	return filepath.Join(CONFIG_HISTORY_DIR, fmt.Sprintf("%d.json", version))
+}
+
+// the versions archived, from the oldest
+func (h *configHistory) versions() []int {
+	files, err := ioutil.ReadDir(CONFIG_HISTORY_DIR)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.LogError(err)
+		}
+		return []int{}
+	}
+
+	versions := make([]int, 0)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+
+		if v, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil {
+			versions = append(versions, v)
+		}
+	}
+
+	sort.Ints(versions)
+	return versions
+}
+
+func (h *configHistory) load(version int) (*ConfigVersion, error) {
+	content, err := ioutil.ReadFile(h.versionPath(version))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, utils.NewAgentError(utils.INVALID_ARGUMENT, map[string]interface{}{ "version": version },
+				"the config version[%v] is not found", version)
+		}
+		return nil, err
+	}
+
+	v := &ConfigVersion{}
+	if err = json.Unmarshal(content, v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// archive the config committed, the errors are logged only because the commit has succeeded
+func (h *configHistory) archive(triggers []CommandTrigger, commands []string, config string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	versions := h.versions()
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions) - 1] + 1
+	}
+
+	v := ConfigVersion{
+		Version: next,
+		Time: time.Now(),
+		Triggers: triggers,
+		Commands: commands,
+		Config: config,
+	}
+
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = utils.MkdirForFile(h.versionPath(next), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(h.versionPath(next), b, 0600)
+	}
+	if err != nil {
+		log.Warnf("unable to archive the configuration version[%v], %v", next, err)
+		return
+	}
+
+	versions = append(versions, next)
+	for len(versions) > CONFIG_HISTORY_MAX {
+		utils.LogError(os.Remove(h.versionPath(versions[0])))
+		versions = versions[1:]
+	}
+}
+
+type configHistoryListRsp struct {
+	Versions []ConfigVersion `json:"versions"`
+}
+
+type configHistoryDiffCmd struct {
+	From int `json:"from"`
+	To int `json:"to"`
+}
+
+type configHistoryDiffRsp struct {
+	Commands []string `json:"commands"`
+}
+
+type configHistoryRollbackCmd struct {
+	Version int `json:"version"`
+}
+
+// the versions without the config text, from the newest
+func configHistoryListHandler(ctx *CommandContext) interface{} {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	rsp := configHistoryListRsp{ Versions: make([]ConfigVersion, 0) }
+	versions := history.versions()
+	for i := len(versions) - 1; i >= 0; i-- {
+		v, err := history.load(versions[i])
+		if err != nil {
+			utils.LogError(err)
+			continue
+		}
+
+		v.Config = ""
+		rsp.Versions = append(rsp.Versions, *v)
+	}
+
+	return rsp
+}
+
+func configHistoryDiffHandler(ctx *CommandContext) interface{} {
+	cmd := &configHistoryDiffCmd{}
+	ctx.GetCommand(cmd)
+
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	from, err := history.load(cmd.From); utils.PanicOnError(err)
+	to, err := history.load(cmd.To); utils.PanicOnError(err)
+	return configHistoryDiffRsp{ Commands: Diff(NewParserFromConfiguration(from.Config).Tree, NewParserFromConfiguration(to.Config).Tree) }
+}
+
+func configHistoryRollbackHandler(ctx *CommandContext) interface{} {
+	cmd := &configHistoryRollbackCmd{}
+	ctx.GetCommand(cmd)
+
+	history.lock.Lock()
+	v, err := history.load(cmd.Version)
+	history.lock.Unlock()
+	utils.PanicOnError(err)
+
+	if ctx.IsDryRun() {
+		// the changes to the version, nothing is loaded
+		recordDryRunCommands(Diff(ctx.ConfigTree(), NewParserFromConfiguration(v.Config).Tree))
+		return nil
+	}
+
+	// the running config is restored if the version cannot be loaded
+	commands := []string{ fmt.Sprintf("# load the configuration of version %v", cmd.Version) }
+	err = loadWithRollback(v.Config, commands, false)
+	configs.invalidate()
+	utils.PanicOnError(err)
+	history.archive([]CommandTrigger{ ctx.trigger() }, commands, v.Config)
+
+	return nil
+}
+
+func init() {
+	RegisterSyncCommandHandler(CONFIG_HISTORY_LIST_PATH, configHistoryListHandler)
+	RegisterSyncCommandHandler(CONFIG_HISTORY_DIFF_PATH, configHistoryDiffHandler)
+	RegisterAsyncCommandHandler(CONFIG_HISTORY_ROLLBACK_PATH, VyosLock(configHistoryRollbackHandler))
+}
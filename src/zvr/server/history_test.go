@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func useTempHistoryDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "zvr-history-test"); utils.PanicOnError(err)
+	old := CONFIG_HISTORY_DIR
+	CONFIG_HISTORY_DIR = dir
+	return func() {
+		CONFIG_HISTORY_DIR = old
+		os.RemoveAll(dir)
+	}
+}
+
+func callHistory(path string, body interface{}, rsp interface{}) {
+	b, err := json.Marshal(body); utils.PanicOnError(err)
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b)))
+	utils.PanicOnError(json.Unmarshal(w.Body.Bytes(), rsp))
+}
+
+func TestConfigHistory(t *testing.T) {
+	defer useTempHistoryDir(t)()
+	defer func(m int) { CONFIG_HISTORY_MAX = m }(CONFIG_HISTORY_MAX)
+	CONFIG_HISTORY_MAX = 3
+
+	configs := []string{
+		"interfaces {\n ethernet eth0 {\n  address 1.1.1.1/24\n }\n}\n",
+		"interfaces {\n ethernet eth0 {\n  address 1.1.1.1/24\n }\n}\nservice {\n ssh {\n  port 22\n }\n}\n",
+		"interfaces {\n ethernet eth0 {\n  address 2.2.2.2/24\n }\n}\nservice {\n ssh {\n  port 22\n }\n}\n",
+		"interfaces {\n ethernet eth0 {\n  address 2.2.2.2/24\n }\n}\n",
+	}
+	for i, c := range configs {
+		history.archive([]CommandTrigger{ { Path: "/test", TaskUuid: fmt.Sprintf("task-%v", i) } }, []string{ "$SET test" }, c)
+	}
+
+	// only the last CONFIG_HISTORY_MAX versions are kept, from the newest
+	list := configHistoryListRsp{}
+	callHistory(CONFIG_HISTORY_LIST_PATH, nil, &list)
+	utils.Assert(len(list.Versions) == 3, fmt.Sprintf("wrong versions %v", list.Versions))
+	utils.Assert(list.Versions[0].Version == 4 && list.Versions[2].Version == 2, fmt.Sprintf("wrong versions %v", list.Versions))
+	utils.Assert(list.Versions[0].Triggers[0].TaskUuid == "task-3", fmt.Sprintf("wrong trigger %v", list.Versions[0].Triggers))
+	utils.Assert(list.Versions[0].Config == "", "the list should not carry the config")
+
+	diff := configHistoryDiffRsp{}
+	callHistory(CONFIG_HISTORY_DIFF_PATH, configHistoryDiffCmd{ From: 2, To: 3 }, &diff)
+	utils.Assert(len(diff.Commands) == 2, fmt.Sprintf("wrong diff %v", diff.Commands))
+	utils.Assert(diff.Commands[0] == "$DELETE interfaces ethernet eth0 address 1.1.1.1/24", diff.Commands[0])
+	utils.Assert(diff.Commands[1] == "$SET interfaces ethernet eth0 address 2.2.2.2/24", diff.Commands[1])
+
+	callHistory(CONFIG_HISTORY_DIFF_PATH, configHistoryDiffCmd{ From: 3, To: 4 }, &diff)
+	utils.Assert(len(diff.Commands) == 1 && diff.Commands[0] == "$DELETE service", fmt.Sprintf("wrong diff %v", diff.Commands))
+
+	// the pruned version
+	rsp := CommandResponseHeader{}
+	callHistory(CONFIG_HISTORY_DIFF_PATH, configHistoryDiffCmd{ From: 1, To: 4 }, &rsp)
+	utils.Assert(!rsp.Success && rsp.ErrorCode == utils.INVALID_ARGUMENT, fmt.Sprintf("wrong response %v", rsp))
+}
+
+func TestConfigHistoryArchivesCommits(t *testing.T) {
+	defer useTempHistoryDir(t)()
+	defer withoutPostCommitChecks()()
+	defer func(f func() string) { ConfigurationSourceFunc = f }(ConfigurationSourceFunc)
+	ConfigurationSourceFunc = func() string { return "" }
+
+	loaded := ""
+	scripts, restore := mockVyosScript(func(script string) error {
+		if strings.HasPrefix(script, "$API loadFile") {
+			b, err := ioutil.ReadFile(strings.Fields(script)[2]); utils.PanicOnError(err)
+			loaded = string(b)
+		}
+		return nil
+	})
+	defer restore()
+
+	utils.PanicOnError(commits.commit([]string{ "$SET service ssh port 22" }, false))
+	utils.Assert(len(history.versions()) == 1, fmt.Sprintf("wrong versions %v", history.versions()))
+
+	// roll back to the archived version
+	v, err := history.load(1); utils.PanicOnError(err)
+	v.Config = "service {\n}\n"
+	b, _ := json.Marshal(v)
+	utils.PanicOnError(ioutil.WriteFile(history.versionPath(1), b, 0600))
+
+	// the rollback path is async, run its handler synchronously
+	RegisterSyncCommandHandler("/testhistory/rollback", VyosLock(configHistoryRollbackHandler))
+	rsp := CommandResponseHeader{}
+	callHistory("/testhistory/rollback", configHistoryRollbackCmd{ Version: 1 }, &rsp)
+	utils.Assert(rsp.Success, fmt.Sprintf("wrong response %v", rsp))
+	utils.Assert(loaded == "service {\n}\n", fmt.Sprintf("wrong config loaded %q", loaded))
+	utils.Assert(len(*scripts) == 2, fmt.Sprintf("wrong scripts %v", *scripts))
+
+	versions := history.versions()
+	utils.Assert(len(versions) == 2, fmt.Sprintf("wrong versions %v", versions))
+	v, err = history.load(versions[1]); utils.PanicOnError(err)
+	utils.Assert(v.Triggers[0].Path == "/testhistory/rollback", fmt.Sprintf("wrong trigger %v", v.Triggers))
+}
+
+func TestConfigHistoryTrigger(t *testing.T) {
+	defer func(u bool, f func() string) { UNIT_TEST = u; ConfigurationSourceFunc = f }(UNIT_TEST, ConfigurationSourceFunc)
+	UNIT_TEST = false
+	ConfigurationSourceFunc = func() string { return "" }
+	defer useTempHistoryDir(t)()
+	_, restore := mockVyosCommit(func(commands []string) error { return nil })
+	defer restore()
+
+	// the commit of the tree built by the command is archived with it
+	RegisterSyncCommandHandler("/testhistory/trigger", func(ctx *CommandContext) interface{} {
+		tree := ctx.ConfigTree()
+		tree.Set("service ssh port 22")
+		tree.Apply(false)
+		return nil
+	})
+	rsp := CommandResponseHeader{}
+	callHistory("/testhistory/trigger", nil, &rsp)
+	utils.Assertf(rsp.Success, "the command failed, %s", rsp.Error)
+
+	v, err := history.load(1); utils.PanicOnError(err)
+	utils.Assertf(len(v.Triggers) == 1 && v.Triggers[0].Path == "/testhistory/trigger", "wrong trigger %v", v.Triggers)
+}
+
+func TestConfigHistoryArchivesCommitted(t *testing.T) {
+	defer func(o Options, c *configCache) { commandOptions = o; configs = c }(commandOptions, configs)
+	commandOptions.ConfigCacheTTL = 30
+	configs = &configCache{}
+	defer func(f func() string) { ConfigurationSourceFunc = f }(ConfigurationSourceFunc)
+	ConfigurationSourceFunc = func() string { return CurrentBackend().ShowConfiguration() }
+	defer useTempHistoryDir(t)()
+	_, restore := useSimulatedBackend(t, "service {\n}\n")
+	defer restore()
+	defer useVyosTemplates(t, "nat source rule")()
+
+	// the config shown after the commit is archived, in the format of showCfg
+	utils.PanicOnError(commits.commit([]string{ "$SET service ssh port 22", "$SET nat source rule 100 outbound-interface eth0",
+		"$SET nat source rule 100 translation address masquerade" }, false))
+	v, err := history.load(1); utils.PanicOnError(err)
+	utils.Assertf(v.Config == CurrentBackend().ShowConfiguration(), "wrong config archived:\n%s", v.Config)
+	utils.Assertf(strings.Contains(v.Config, "rule 100 {") && NewParserFromConfiguration(v.Config).Tree.Has("service ssh port 22"), "wrong config archived:\n%s", v.Config)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Every request goes through a chain of interceptors before reaching the
+// command handler. The order from the outermost is:
+//   1. the built-in interceptors: request logging, metrics, panic recovery and auth
+//   2. the global interceptors, in the order they are registered
+//   3. the interceptors of the request path, in the order they are registered
+// An interceptor can stop the request by not calling the next handler.
+
+var (
+	interceptorLock = &sync.Mutex{}
+	builtinInterceptors = []HttpInterceptor{
+		requestLogInterceptor,
+		metricsInterceptor,
+		recoverInterceptor,
+		authInterceptor,
+	}
+	globalInterceptors = make([]HttpInterceptor, 0)
+	pathInterceptors = make(map[string][]HttpInterceptor)
+)
+
+// register an interceptor for all paths
+func RegisterHttpInterceptor(interceptor HttpInterceptor) {
+	utils.Assert(interceptor != nil, "interceptor cannot be nil")
+
+	interceptorLock.Lock()
+	defer interceptorLock.Unlock()
+	globalInterceptors = append(globalInterceptors, interceptor)
+}
+
+// register an interceptor for the path, it runs inside the global ones.
+// The path needs not to be registered yet
+func RegisterPathHttpInterceptor(path string, interceptor HttpInterceptor) {
+	utils.Assert(path != "", "path cannot be nil")
+	utils.Assert(interceptor != nil, "interceptor cannot be nil")
+
+	interceptorLock.Lock()
+	defer interceptorLock.Unlock()
+	pathInterceptors[path] = append(pathInterceptors[path], interceptor)
+}
+
+func intercept(path string, handler http.HandlerFunc) http.HandlerFunc {
+	interceptorLock.Lock()
+	chain := make([]HttpInterceptor, 0, len(builtinInterceptors) + len(globalInterceptors) + len(pathInterceptors[path]))
+	chain = append(chain, builtinInterceptors...)
+	chain = append(chain, globalInterceptors...)
+	chain = append(chain, pathInterceptors[path]...)
+	interceptorLock.Unlock()
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler
+}
+
+// remember the status code so the outer interceptors can see it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) written() bool {
+	return r.status != 0
+}
+
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func recordStatus(w http.ResponseWriter) *statusRecorder {
+	if r, ok := w.(*statusRecorder); ok {
+		return r
+	}
+	return &statusRecorder{ ResponseWriter: w }
+}
+
+// the credentials in the JSON bodies, e.g. the secret /init changes and
+// the IPsec authKey, by the suffix of the keys so a new field like
+// preSharedKey or adminPassword is covered too. json matches the keys
+// case-insensitively
+var bodySecretPattern = regexp.MustCompile(`(?i)("[a-z_]*(?:secret|authkey|sharedkey|privatekey|psk|password|passwd|token)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+func redactBodySecrets(body string) string {
+	return bodySecretPattern.ReplaceAllString(body, `${1}"******"`)
+}
+
+func requestLogInterceptor(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		// drain the body
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Warnf("unable to dump the http request[url:%v], %v", req.URL, err)
+			w.WriteHeader(http.StatusBadRequest)
+			utils.LogError(fmt.Fprint(w, err.Error()))
+			return
+		}
+
+		log.WithFields(log.Fields{
+			CALLBACK_URL: req.Header.Get(CALLBACK_URL),
+			TASK_UUID: req.Header.Get(TASK_UUID),
+			"Host": req.Header.Get("Host"),
+		}).Debugf("[RECV] %v, body: %s", req.URL, redactBodySecrets(string(body)))
+
+		// re-fill the body
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+
+		start := time.Now()
+		rw := recordStatus(w)
+		next(rw, req)
+		log.Debugf("[DONE] %v, status code: %v, took %v", req.URL, rw.statusCode(), time.Now().Sub(start))
+	}
+}
+
+func metricsInterceptor(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rw := recordStatus(w)
+		next(rw, req)
+
+		// don't let unknown paths blow up the label values
+		path := req.URL.Path
+		if _, ok := commandHandlers[path]; !ok {
+			path = "unknown"
+		}
+		httpResponses.Inc(path, strconv.Itoa(rw.statusCode()))
+	}
+}
+
+// async commands recover in their own go routines, this catches
+// the panics of sync commands and the interceptors
+func recoverInterceptor(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rw := recordStatus(w)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+
+			if e, ok := err.(error); ok {
+				log.Warnf("%+v\n", errors.Wrap(e, fmt.Sprintf("command[path:%s] failed", req.URL.Path)))
+			} else {
+				log.Warnf("%+v\n", errors.Wrap(fmt.Errorf("%v", err), fmt.Sprintf("command[path:%s] failed", req.URL.Path)))
+			}
+
+			if rw.written() {
+				// too late to tell the caller
+				return
+			}
+
+			body, _ := json.Marshal(errorResponse(err))
+			rw.WriteHeader(http.StatusInternalServerError)
+			utils.LogError(fmt.Fprint(rw, string(body)))
+		}()
+
+		next(rw, req)
+	}
+}
+
+func authInterceptor(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := authenticate(req); err != nil {
+			log.Warnf("reject the request to the path[%s] from %s, %v", req.URL.Path, req.RemoteAddr, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			utils.LogError(fmt.Fprint(w, err.Error()))
+			return
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func TestInterceptorOrder(t *testing.T) {
+	path := "/testinterceptororder"
+	order := make([]string, 0)
+	RegisterSyncCommandHandler(path, func(ctx *CommandContext) interface{} {
+		order = append(order, "handler")
+		return nil
+	})
+
+	tracer := func(name string) HttpInterceptor {
+		return func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				next(w, req)
+			}
+		}
+	}
+
+	globals := globalInterceptors
+	defer func() {
+		globalInterceptors = globals
+		delete(pathInterceptors, path)
+	}()
+
+	// a path interceptor registered first still runs inside the global ones
+	RegisterPathHttpInterceptor(path, tracer("path1"))
+	RegisterHttpInterceptor(tracer("global1"))
+	RegisterHttpInterceptor(tracer("global2"))
+	RegisterPathHttpInterceptor(path, tracer("path2"))
+	RegisterPathHttpInterceptor("/testinterceptorother", tracer("other"))
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte("{}"))))
+	utils.Assert(w.Code == http.StatusOK, "the command failed")
+
+	got := strings.Join(order, ",")
+	utils.Assertf(got == "global1,global2,path1,path2,handler", "wrong order: %s", got)
+}
+
+func TestInterceptorStopRequest(t *testing.T) {
+	path := "/testinterceptorstop"
+	called := false
+	RegisterSyncCommandHandler(path, func(ctx *CommandContext) interface{} {
+		called = true
+		return nil
+	})
+
+	defer delete(pathInterceptors, path)
+	RegisterPathHttpInterceptor(path, func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte("{}"))))
+	utils.Assert(w.Code == http.StatusForbidden, "the interceptor didn't stop the request")
+	utils.Assert(!called, "the handler is called")
+}
+
+func TestRecoverSyncCommandPanic(t *testing.T) {
+	path := "/testsyncpanic"
+	RegisterSyncCommandHandler(path, func(ctx *CommandContext) interface{} {
+		panic("on purpose")
+	})
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte("{}"))))
+	utils.Assertf(w.Code == http.StatusInternalServerError, "unexpected status code %v", w.Code)
+
+	rsp := CommandResponseHeader{}
+	utils.PanicOnError(json.Unmarshal(w.Body.Bytes(), &rsp))
+	utils.Assert(!rsp.Success, "the command should fail")
+	utils.Assertf(rsp.Error == "on purpose", "unexpected error %s", rsp.Error)
+
+	m := httptest.NewRecorder()
+	dispatch(m, httptest.NewRequest(http.MethodGet, METRICS_PATH, nil))
+	out := m.Body.String()
+	utils.Assert(strings.Contains(out, `zvr_command_failures_total{path="/testsyncpanic"} 1`), out)
+	utils.Assert(strings.Contains(out, `zvr_http_responses_total{path="/testsyncpanic",code="500"} 1`), out)
+}
+
+func TestTypedErrorResponse(t *testing.T) {
+	path := "/testtypederror"
+	RegisterSyncCommandHandler(path, func(ctx *CommandContext) interface{} {
+		cmd := &struct{ Mac string }{}
+		ctx.GetCommand(cmd)
+		_, err := utils.GetNicNameByMac(cmd.Mac); utils.PanicOnError(err)
+		return nil
+	})
+
+	post := func(body string) CommandResponseHeader {
+		w := httptest.NewRecorder()
+		dispatch(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(body))))
+		rsp := CommandResponseHeader{}
+		utils.PanicOnError(json.Unmarshal(w.Body.Bytes(), &rsp))
+		return rsp
+	}
+
+	rsp := post(`{"mac": "ff:ff:ff:ff:ff:fe"}`)
+	utils.Assertf(rsp.ErrorCode == utils.NIC_NOT_FOUND, "unexpected code %s", rsp.ErrorCode)
+	utils.Assertf(rsp.ErrorDetails["mac"] == "ff:ff:ff:ff:ff:fe", "unexpected details %v", rsp.ErrorDetails)
+
+	rsp = post(`not json`)
+	utils.Assertf(rsp.ErrorCode == utils.INVALID_ARGUMENT, "unexpected code %s", rsp.ErrorCode)
+
+	utils.Assert(errorResponse(TaskCancelledError{ "uuid" }).ErrorCode == utils.TASK_CANCELLED, "wrong code of a cancelled task")
+	utils.Assert(errorResponse("boom").ErrorCode == utils.INTERNAL_ERROR, "wrong code of an unknown panic")
+}
+
+func TestRequestLogRedacted(t *testing.T) {
+	body := `{"secret": "abc\"123", "AgentSecret":"s3cret", "mgmtCidr": "10.0.0.0/8"}`
+	s := redactBodySecrets(body)
+	utils.Assertf(!strings.Contains(s, "abc") && !strings.Contains(s, "s3cret"), "the secret is not redacted: %s", s)
+	utils.Assertf(strings.Contains(s, `"secret": "******"`) && strings.Contains(s, `"mgmtCidr": "10.0.0.0/8"`), "unexpected body: %s", s)
+	utils.Assertf(json.Valid([]byte(s)), "the body is broken: %s", s)
+
+	// the IPsec key and other credentials
+	body = `{"infos":[{"uuid":"c1","authKey":"ipsec-psk","authMode":"psk","peerAddress":"1.1.1.1"}],"adminPassword":"p@ss"}`
+	s = redactBodySecrets(body)
+	utils.Assertf(!strings.Contains(s, "ipsec-psk") && !strings.Contains(s, "p@ss"), "the credential is not redacted: %s", s)
+	utils.Assertf(strings.Contains(s, `"authMode":"psk"`) && strings.Contains(s, `"peerAddress":"1.1.1.1"`), "unexpected body: %s", s)
+	utils.Assertf(json.Valid([]byte(s)), "the body is broken: %s", s)
+}
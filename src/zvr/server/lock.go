@@ -0,0 +1,195 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"zvr/utils"
+)
+
+// Resources a command touches are named as paths separated by ':', e.g.
+// "firewall:eth0.in". Locking a resource excludes the commands locking it,
+// its ancestors (e.g. "firewall") or its descendants. Commands locking
+// unrelated resources run in parallel, and only the vyos commit itself is
+// serialized by vyosScriptLock. VyosLock still locks everything.
+
+const (
+	RESOURCE_SEPARATOR = ":"
+
+	RESOURCE_NAT = "nat"
+	RESOURCE_NAT_SOURCE = "nat:source"
+	RESOURCE_NAT_DESTINATION = "nat:destination"
+	RESOURCE_FIREWALL = "firewall"
+	RESOURCE_INTERFACES = "interfaces"
+	RESOURCE_DHCP = "dhcp"
+	RESOURCE_DNS = "dns"
+	RESOURCE_IPSEC = "ipsec"
+	RESOURCE_LB = "lb"
+)
+
+func FirewallResource(ethname, direction string) string {
+	return fmt.Sprintf("%s%s%s.%s", RESOURCE_FIREWALL, RESOURCE_SEPARATOR, ethname, direction)
+}
+
+func InterfaceResource(ethname string) string {
+	return strings.Join([]string{RESOURCE_INTERFACES, ethname}, RESOURCE_SEPARATOR)
+}
+
+// where the firewall is attached to the interface, locked together with the
+// FirewallResource by the commands calling AttachFirewallToInterface
+func InterfaceFirewallResource(ethname, direction string) string {
+	return strings.Join([]string{InterfaceResource(ethname), "firewall", direction}, RESOURCE_SEPARATOR)
+}
+
+func LbListenerResource(lbUuid, listenerUuid string) string {
+	return strings.Join([]string{RESOURCE_LB, lbUuid, listenerUuid}, RESOURCE_SEPARATOR)
+}
+
+type resourceLock struct {
+	lock sync.RWMutex
+	refs int
+}
+
+type resourceLockManager struct {
+	lock sync.Mutex
+	// VyosLock takes it exclusively, the resource locks take it shared
+	global sync.RWMutex
+	locks map[string]*resourceLock
+}
+
+var resourceLocks = &resourceLockManager{ locks: make(map[string]*resourceLock) }
+
+// a resource lock taken by a command, to release it later
+type heldLock struct {
+	name string
+	l *resourceLock
+	exclusive bool
+}
+
+func (m *resourceLockManager) ref(name string) *resourceLock {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	l, ok := m.locks[name]
+	if !ok {
+		l = &resourceLock{}
+		m.locks[name] = l
+	}
+	l.refs++
+	return l
+}
+
+func (m *resourceLockManager) unref(name string, l *resourceLock) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(m.locks, name)
+	}
+}
+
+// the resources are locked exclusively and their ancestors shared. All locks
+// are taken in the order of the names so commands never deadlock
+func (m *resourceLockManager) acquire(resources []string) []heldLock {
+	modes := make(map[string]bool)
+	for _, r := range resources {
+		utils.Assert(r != "", "resource cannot be empty")
+
+		segments := strings.Split(r, RESOURCE_SEPARATOR)
+		for i := 1; i < len(segments); i++ {
+			ancestor := strings.Join(segments[:i], RESOURCE_SEPARATOR)
+			if _, ok := modes[ancestor]; !ok {
+				modes[ancestor] = false
+			}
+		}
+		modes[r] = true
+	}
+
+	names := make([]string, 0, len(modes))
+	for n := range modes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	m.global.RLock()
+	held := make([]heldLock, 0, len(names))
+	for _, n := range names {
+		l := m.ref(n)
+		if modes[n] {
+			l.lock.Lock()
+		} else {
+			l.lock.RLock()
+		}
+		held = append(held, heldLock{ name: n, l: l, exclusive: modes[n] })
+	}
+
+	return held
+}
+
+func (m *resourceLockManager) release(held []heldLock) {
+	for i := len(held) - 1; i >= 0; i-- {
+		h := held[i]
+		if h.exclusive {
+			h.l.lock.Unlock()
+		} else {
+			h.l.lock.RUnlock()
+		}
+		m.unref(h.name, h.l)
+	}
+	m.global.RUnlock()
+}
+
+// lock the resources until the command returns. A command locks its resources
+// only once, all of them together, and not together with VyosLock
+func (ctx *CommandContext) LockResources(resources ...string) {
+	// e.g. a dry-run command
+	if ctx.lockedAll {
+		return
+	}
+
+	utils.Assert(!ctx.locked, "the command has locked its resources")
+	utils.Assert(len(resources) > 0, "no resource to lock")
+
+	start := time.Now()
+	ctx.heldLocks = resourceLocks.acquire(resources)
+	ctx.locked = true
+	vyosLockWait.ObserveSince(start)
+
+	// the task may be cancelled while waiting for the lock
+	ctx.PanicIfCancelled()
+}
+
+func (ctx *CommandContext) unlockResources() {
+	if ctx.heldLocks != nil {
+		resourceLocks.release(ctx.heldLocks)
+		ctx.heldLocks = nil
+	}
+}
+
+// lock everything, the command runs alone and the locks it asks for later
+// are no-ops. It's released by unlockAll
+func (ctx *CommandContext) lockAll() {
+	utils.Assert(!ctx.locked, "the command has locked its resources")
+
+	start := time.Now()
+	resourceLocks.global.Lock()
+	ctx.locked = true
+	ctx.lockedAll = true
+	vyosLockWait.ObserveSince(start)
+}
+
+func (ctx *CommandContext) unlockAll() {
+	resourceLocks.global.Unlock()
+}
+
+// lock the fixed resources of the handler, a handler knowing
+// its resources only from the command calls ctx.LockResources
+func ResourceLock(fn CommandHandler, resources ...string) CommandHandler {
+	return func(ctx *CommandContext) interface{} {
+		ctx.LockResources(resources...)
+		return fn(ctx)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"testing"
+	"time"
+	"zvr/utils"
+)
+
+// return true if the second acquire has to wait for the first one
+func blocks(first, second []string) bool {
+	held := resourceLocks.acquire(first)
+
+	done := make(chan struct{})
+	go func() {
+		resourceLocks.release(resourceLocks.acquire(second))
+		close(done)
+	}()
+
+	blocked := false
+	select {
+	case <-done:
+	case <-time.After(time.Duration(200) * time.Millisecond):
+		blocked = true
+	}
+
+	resourceLocks.release(held)
+	<-done
+	return blocked
+}
+
+func TestResourceLocks(t *testing.T) {
+	utils.Assert(!blocks([]string{ FirewallResource("eth0", "local") }, []string{ FirewallResource("eth0", "in") }),
+		"different firewalls block each other")
+	utils.Assert(!blocks([]string{ LbListenerResource("lb1", "l1"), RESOURCE_DHCP }, []string{ LbListenerResource("lb1", "l2") }),
+		"different listeners block each other")
+	utils.Assert(blocks([]string{ FirewallResource("eth0", "in") }, []string{ RESOURCE_DHCP, FirewallResource("eth0", "in") }),
+		"the same firewall doesn't block")
+	utils.Assert(blocks([]string{ RESOURCE_FIREWALL }, []string{ FirewallResource("eth0", "in") }),
+		"the parent doesn't block the child")
+	utils.Assert(blocks([]string{ FirewallResource("eth1", "in") }, []string{ RESOURCE_FIREWALL }),
+		"the child doesn't block the parent")
+	utils.Assert(blocks([]string{ RESOURCE_NAT_SOURCE }, []string{ RESOURCE_NAT, RESOURCE_NAT_SOURCE }),
+		"the nat source doesn't block")
+	utils.Assert(blocks([]string{ RESOURCE_INTERFACES }, []string{ FirewallResource("eth0", "in"), InterfaceFirewallResource("eth0", "in") }),
+		"the interfaces don't block attaching the firewall")
+	utils.Assert(!blocks([]string{ InterfaceFirewallResource("eth0", "local") }, []string{ InterfaceFirewallResource("eth0", "in") }),
+		"attaching different firewalls block each other")
+
+	resourceLocks.lock.Lock()
+	defer resourceLocks.lock.Unlock()
+	utils.Assertf(len(resourceLocks.locks) == 0, "the locks are not cleaned up: %v", resourceLocks.locks)
+}
+
+func TestVyosLockExcludesResourceLocks(t *testing.T) {
+	entered := make(chan struct{})
+	leave := make(chan struct{})
+	go VyosLock(func(ctx *CommandContext) interface{} {
+		close(entered)
+		<-leave
+		return nil
+	})(&CommandContext{})
+	<-entered
+
+	done := make(chan struct{})
+	go func() {
+		ctx := &CommandContext{}
+		ResourceLock(func(ctx *CommandContext) interface{} { return nil }, RESOURCE_DNS)(ctx)
+		ctx.unlockResources()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the resource lock is taken while VyosLock is held")
+	case <-time.After(time.Duration(200) * time.Millisecond):
+	}
+
+	close(leave)
+	<-done
+}
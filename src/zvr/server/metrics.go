@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"zvr/utils"
+)
+
+const (
+	METRICS_PATH = "/metrics"
+)
+
+var (
+	httpResponses = utils.NewCounter("zvr_http_responses_total", "Number of HTTP responses by path and status code", "path", "code")
+	commandRequests = utils.NewCounter("zvr_command_requests_total", "Number of commands received", "path")
+	commandFailures = utils.NewCounter("zvr_command_failures_total", "Number of commands failed", "path")
+	commandDuration = utils.NewHistogram("zvr_command_duration_seconds", "Time spent in command handlers",
+		utils.DEFAULT_DURATION_BUCKETS, "path")
+
+	vyosLockWait = utils.NewHistogram("zvr_vyos_lock_wait_seconds", "Time spent waiting for the vyos lock",
+		utils.DEFAULT_DURATION_BUCKETS)
+	vyosCommitDuration = utils.NewHistogram("zvr_vyos_commit_duration_seconds", "Time spent running vyos scripts to commit",
+		utils.DEFAULT_DURATION_BUCKETS)
+	vyosCommitFailures = utils.NewCounter("zvr_vyos_commit_failures_total", "Number of vyos scripts failed to commit")
+	vyosCommitBatchSize = utils.NewHistogram("zvr_vyos_commit_batch_size", "Number of config changes merged into one vyos commit",
+		[]float64{1, 2, 5, 10, 20, 50})
+
+	asyncQueueWait = utils.NewHistogram("zvr_async_queue_wait_seconds", "Time async commands wait in the queue for a worker",
+		utils.DEFAULT_DURATION_BUCKETS)
+	asyncRejected = utils.NewCounter("zvr_async_rejected_total", "Number of async commands rejected because the queue is full")
+
+	configCacheHits = utils.NewCounter("zvr_config_cache_hits_total", "Number of commands served by the cached config")
+	configCacheLoads = utils.NewCounter("zvr_config_cache_loads_total", "Number of times the running config is parsed into the cache")
+
+	callbackRetries = utils.NewCounter("zvr_callback_retries_total", "Number of async replies resent to the mgmt server")
+	callbackFailures = utils.NewCounter("zvr_callback_failures_total", "Number of async replies kept in the outbox after retries")
+)
+
+// the metrics tell the networks and the load of the router, so the endpoint
+// requires the same signed requests as the commands once a secret is set,
+// rather than being bound to the management address which the commands
+// share. The metrics are scraped by the mgmt server, or by a Prometheus
+// behind a signing proxy
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	utils.WriteMetrics(w)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	path := "/testmetrics"
+	RegisterSyncCommandHandler(path, func(ctx *CommandContext) interface{} {
+		return nil
+	})
+
+	dispatch(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte("{}"))))
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, METRICS_PATH, nil))
+	utils.Assert(w.Code == http.StatusOK, "failed to get metrics")
+
+	out := w.Body.String()
+	utils.Assert(strings.Contains(out, `zvr_command_requests_total{path="/testmetrics"} 1`), out)
+	utils.Assert(strings.Contains(out, `zvr_command_duration_seconds_count{path="/testmetrics"} 1`), out)
+}
+
+func TestMetricsEndpointSigned(t *testing.T) {
+	SetAuthSecret("secret")
+	defer SetAuthSecret("")
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, METRICS_PATH, nil))
+	utils.Assertf(w.Code == http.StatusUnauthorized, "unexpected status code %v", w.Code)
+
+	headers := make(map[string]string)
+	utils.PanicOnError(utils.SignHttpHeaders([]byte("secret"), METRICS_PATH, nil, headers))
+	req := httptest.NewRequest(http.MethodGet, METRICS_PATH, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w = httptest.NewRecorder()
+	dispatch(w, req)
+	utils.Assertf(w.Code == http.StatusOK && strings.Contains(w.Body.String(), "zvr_command_requests_total"), "unexpected response %v", w.Code)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var (
+	OUTBOX_DIR = "/home/vyos/zvr/outbox"
+	// how often the undelivered replies are resent, a reply
+	// is tried once when it's sent and then retried by this
+	OUTBOX_REDELIVER_INTERVAL = time.Duration(10) * time.Second
+	// the mgmt server has given up the task long before this
+	OUTBOX_EXPIRE = time.Duration(24) * time.Hour
+)
+
+// an async reply that has not been delivered to the mgmt server,
+// it's kept on disk so it survives callback failures and restarts
+type outboxEntry struct {
+	TaskUuid string `json:"taskUuid"`
+	CallbackURL string `json:"callbackURL"`
+	TriggerURL string `json:"triggerURL"`
+	Body json.RawMessage `json:"body"`
+	CreateTime time.Time `json:"createTime"`
+}
+
+func (e *outboxEntry) deliver(ctx context.Context) error {
+	headers := map[string]string{
+		TASK_UUID: e.TaskUuid,
+		utils.HEADER_TRIGGER_URL: e.TriggerURL,
+	}
+
+	// sign at every delivery, a stale timestamp would be rejected
+	if secret := getAuthSecret(); secret != nil {
+		// the same bytes HttpPost sends
+		body, err := json.Marshal(e.Body)
+		if err != nil {
+			return err
+		}
+
+		if err = utils.SignHttpHeaders(secret, e.CallbackURL, body, headers); err != nil {
+			return err
+		}
+	}
+
+	err := utils.HttpPostForObjectWithContext(ctx, e.CallbackURL, headers, e.Body, nil)
+
+	if he, ok := err.(*utils.HttpPostError); ok && he.StatusCode() == 404 {
+		// if a 404 error, that means the mgmt server has received
+		// a previous reply or has been timeout
+		return nil
+	}
+
+	return err
+}
+
+type replyOutbox struct {
+	lock sync.Mutex
+	// entries being delivered by asyncReply or the background
+	// redelivery, the other one must not send them at the same time
+	inflight map[string]bool
+}
+
+var outbox = &replyOutbox{ inflight: make(map[string]bool) }
+
+// a task may have more than one callback URL if the mgmt server
+// retried it with a different one, so both are in the file name
+func (e *outboxEntry) filePath() string {
+	name := strings.Replace(e.TaskUuid, string(filepath.Separator), "_", -1)
+	h := fnv.New32a()
+	h.Write([]byte(e.CallbackURL))
+	return filepath.Join(OUTBOX_DIR, fmt.Sprintf("%s-%x.json", name, h.Sum32()))
+}
+
+func (o *replyOutbox) save(e *outboxEntry) error {
+	path := e.filePath()
+	if err := utils.MkdirForFile(path, 0755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file then rename, a crash never leaves a half entry
+	tmp := fmt.Sprintf("%s.tmp", path)
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (o *replyOutbox) remove(e *outboxEntry) {
+	path := e.filePath()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		utils.LogError(err)
+	}
+}
+
+// mark the entry inflight, false if it's already being delivered
+func (o *replyOutbox) tryMarkInflight(e *outboxEntry) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.inflight[e.filePath()] {
+		return false
+	}
+
+	o.inflight[e.filePath()] = true
+	return true
+}
+
+func (o *replyOutbox) unmarkInflight(e *outboxEntry) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.inflight, e.filePath())
+}
+
+// send the reply once; if the mgmt server cannot be reached, the reply
+// stays in the outbox and is redelivered in the background, so the
+// worker sending it is not blocked by the retries. The reply is
+// kept for redelivery too if the ctx is done before it's delivered
+func (o *replyOutbox) send(ctx context.Context, e *outboxEntry) {
+	if !o.tryMarkInflight(e) {
+		// the same reply is being redelivered, it stays in the
+		// outbox if the redelivery fails
+		log.Debugf("the reply of the task[uuid:%s] is being redelivered to %s, skip it", e.TaskUuid, e.CallbackURL)
+		return
+	}
+	defer o.unmarkInflight(e)
+
+	if err := o.save(e); err != nil {
+		log.Warnf("unable to save the reply of the task[uuid:%s] to the outbox, %v", e.TaskUuid, err)
+	}
+
+	if err := e.deliver(ctx); err != nil {
+		callbackFailures.Inc()
+		log.Warnf("unable to send the reply of the task[uuid:%s] to %s, it's kept in the outbox for redelivery, %v",
+			e.TaskUuid, e.CallbackURL, err)
+		return
+	}
+
+	o.remove(e)
+}
+
+// try once to deliver every entry in the outbox
+func (o *replyOutbox) redeliver() {
+	files, err := ioutil.ReadDir(OUTBOX_DIR)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.LogError(err)
+		}
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(OUTBOX_DIR, f.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			utils.LogError(err)
+			continue
+		}
+
+		e := &outboxEntry{}
+		if err = json.Unmarshal(content, e); err != nil {
+			log.Warnf("drop the broken outbox entry[%s], %v", path, err)
+			utils.LogError(os.Remove(path))
+			continue
+		}
+
+		o.redeliverEntry(e)
+	}
+}
+
+func (o *replyOutbox) redeliverEntry(e *outboxEntry) {
+	if !o.tryMarkInflight(e) {
+		return
+	}
+	defer o.unmarkInflight(e)
+
+	// it may have been delivered by asyncReply since the file is read
+	if ok, _ := utils.PathExists(e.filePath()); !ok {
+		return
+	}
+
+	if time.Now().Sub(e.CreateTime) > OUTBOX_EXPIRE {
+		log.Warnf("drop the reply of the task[uuid:%s], it has not been delivered since %v", e.TaskUuid, e.CreateTime)
+		o.remove(e)
+		return
+	}
+
+	callbackRetries.Inc()
+	if err := e.deliver(context.Background()); err != nil {
+		log.Debugf("failed to redeliver the reply of the task[uuid:%s], %v", e.TaskUuid, err)
+		return
+	}
+
+	log.Debugf("the reply of the task[uuid:%s] is redelivered to %s", e.TaskUuid, e.CallbackURL)
+	o.remove(e)
+}
+
+func (o *replyOutbox) start() {
+	go func() {
+		for {
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						log.Warnf("%+v\n", errors.New(fmt.Sprintf("outbox redelivery failed, %v", err)))
+					}
+				}()
+				o.redeliver()
+			}()
+
+			time.Sleep(OUTBOX_REDELIVER_INTERVAL)
+		}
+	}()
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zvr/utils"
+)
+
+func TestOutboxRedeliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zvr-outbox"); utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	OUTBOX_DIR = dir
+
+	mgmtServerUp := false
+	received := ""
+	attempts := 0
+	mgmt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if !mgmtServerUp {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+		received = req.Header.Get(TASK_UUID) + " " + string(body)
+	}))
+	defer mgmt.Close()
+
+	e := &outboxEntry{
+		TaskUuid: "outbox-task",
+		CallbackURL: mgmt.URL,
+		TriggerURL: "/test",
+		Body: []byte(`{"success":true}`),
+		CreateTime: time.Now(),
+	}
+
+	// the mgmt server is down, the reply is tried once and kept on disk
+	outbox.send(context.Background(), e)
+	ok, _ := utils.PathExists(e.filePath())
+	utils.Assert(ok, "the reply should be kept in the outbox")
+	utils.Assertf(attempts == 1, "the reply is sent %v times", attempts)
+
+	outbox.redeliver()
+	ok, _ = utils.PathExists(e.filePath())
+	utils.Assert(ok, "the reply should still be kept in the outbox")
+
+	mgmtServerUp = true
+	outbox.redeliver()
+	ok, _ = utils.PathExists(e.filePath())
+	utils.Assert(!ok, "the reply should be removed from the outbox")
+	utils.Assert(received == `outbox-task {"success":true}`, received)
+}
+
+func TestOutboxDropExpiredReply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zvr-outbox"); utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	OUTBOX_DIR = dir
+
+	e := &outboxEntry{
+		TaskUuid: "expired-task",
+		CallbackURL: "http://127.0.0.1:1/callback",
+		Body: []byte(`{}`),
+		CreateTime: time.Now().Add(-OUTBOX_EXPIRE * 2),
+	}
+	utils.PanicOnError(outbox.save(e))
+
+	outbox.redeliver()
+	ok, _ := utils.PathExists(e.filePath())
+	utils.Assert(!ok, "the expired reply should be dropped")
+}
+
+func TestOutboxDeliverOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zvr-outbox"); utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	OUTBOX_DIR = dir
+
+	var attempts int32
+	entered := make(chan bool, 2)
+	release := make(chan bool)
+	mgmt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		entered <- true
+		<-release
+	}))
+	defer mgmt.Close()
+
+	e := &outboxEntry{
+		TaskUuid: "once-task",
+		CallbackURL: mgmt.URL,
+		Body: []byte(`{"success":true}`),
+		CreateTime: time.Now(),
+	}
+	utils.PanicOnError(outbox.save(e))
+
+	// the reply is being redelivered, asyncReply doesn't send it again
+	done := make(chan bool)
+	go func() { outbox.redeliver(); done <- true }()
+	<-entered
+	outbox.send(context.Background(), e)
+	close(release)
+	<-done
+	utils.Assertf(atomic.LoadInt32(&attempts) == 1, "the reply is sent %v times", atomic.LoadInt32(&attempts))
+
+	// the reply is being sent by asyncReply, the redelivery skips it
+	release = make(chan bool)
+	go func() { outbox.send(context.Background(), e); done <- true }()
+	<-entered
+	outbox.redeliver()
+	close(release)
+	<-done
+	utils.Assertf(atomic.LoadInt32(&attempts) == 2, "the reply is sent %v times", atomic.LoadInt32(&attempts))
+	ok, _ := utils.PathExists(e.filePath())
+	utils.Assert(!ok, "the reply should be removed from the outbox")
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"zvr/utils"
+)
+
+// Every rule set by zvr carries its owner in the description:
+//
+//   zvr:<feature>:<resource>:v<version>[:<key>]
+//
+// e.g. zvr:eip:172.20.14.100:v1:10.0.0.2-fa:4c:ad:b9:15:00. The resource is
+// the uuid of the resource owning the rule, or what identifies it if the
+// management node sends no uuid, e.g. the vip of an EIP. The key tells apart
+// the rules of one resource, and the version is bumped when the feature
+// changes its rules. ':' and '%' in the feature and the resource are escaped.
+//
+// The descriptions the features used before are parsed by the parsers they
+// register, as the owners of version 0, so the old rules are found and
+// listed the same way. They're collected only if asked
+
+const (
+	RULE_OWNER_PREFIX = "zvr"
+
+	OWNED_RULES_PATH = "/rules/owned"
+	COLLECT_ORPHAN_RULES_PATH = "/rules/gc"
+)
+
+type RuleOwner struct {
+	Feature string `json:"feature"`
+	// empty if unknown, e.g. of the rules shared by the resources of the feature
+	Resource string `json:"resource,omitempty"`
+	Version int `json:"version"`
+	Key string `json:"key,omitempty"`
+}
+
+var (
+	ownerEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+	ownerUnescaper = strings.NewReplacer("%3A", ":", "%25", "%")
+)
+
+func (o RuleOwner) Description() string {
+	utils.Assertf(o.Feature != "" && o.Version > 0, "invalid rule owner %+v", o)
+	des := fmt.Sprintf("%s:%s:%s:v%d", RULE_OWNER_PREFIX, ownerEscaper.Replace(o.Feature), ownerEscaper.Replace(o.Resource), o.Version)
+	if o.Key != "" {
+		des = fmt.Sprintf("%s:%s", des, o.Key)
+	}
+	return des
+}
+
+// the owner of any version
+func (o RuleOwner) Id() string {
+	return fmt.Sprintf("%s:%s:%s", ownerEscaper.Replace(o.Feature), ownerEscaper.Replace(o.Resource), o.Key)
+}
+
+type legacyRuleOwner struct {
+	feature string
+	parse func(des string) (resource, key string, ok bool)
+}
+
+var legacyRuleOwners = make([]legacyRuleOwner, 0)
+
+// the parser of the descriptions the feature used before the owners
+func RegisterLegacyRuleOwner(feature string, parse func(des string) (resource, key string, ok bool)) {
+	legacyRuleOwners = append(legacyRuleOwners, legacyRuleOwner{ feature: feature, parse: parse })
+}
+
+func ParseRuleOwner(des string) (RuleOwner, bool) {
+	fs := strings.SplitN(des, ":", 5)
+	if len(fs) >= 4 && fs[0] == RULE_OWNER_PREFIX && strings.HasPrefix(fs[3], "v") {
+		if v, err := strconv.Atoi(fs[3][1:]); err == nil && v > 0 {
+			o := RuleOwner{ Feature: ownerUnescaper.Replace(fs[1]), Resource: ownerUnescaper.Replace(fs[2]), Version: v }
+			if len(fs) == 5 {
+				o.Key = fs[4]
+			}
+			return o, true
+		}
+	}
+
+	for _, l := range legacyRuleOwners {
+		if resource, key, ok := l.parse(des); ok {
+			return RuleOwner{ Feature: l.feature, Resource: resource, Key: key }, true
+		}
+	}
+	return RuleOwner{}, false
+}
+
+type OwnedRule struct {
+	RuleAllocation
+	Owner RuleOwner `json:"owner"`
+	node *VyosConfigNode
+}
+
+func (r OwnedRule) Node() *VyosConfigNode {
+	return r.node
+}
+
+// the rules of the firewalls and the nat with the owners matched, all owned rules if match is nil
+func (t *VyosConfigTree) FindRulesByOwner(match func(o RuleOwner) bool) []OwnedRule {
+	rules := make([]OwnedRule, 0)
+	for _, set := range RULE_SETS {
+		layout := layoutRuleRanges(t.ruleRangesOf(set))
+		for _, m := range t.FindAll(ruleSetQuery(set) + " * description") {
+			if m.Node.ValueSize() != 1 {
+				continue
+			}
+			o, ok := ParseRuleOwner(m.Node.Value())
+			if !ok || (match != nil && !match(o)) {
+				continue
+			}
+
+			// the firewall name and the rule number, or the number only
+			name := ""
+			if len(m.Captures) == 2 {
+				name = m.Captures[0]
+			}
+			n, _ := strconv.Atoi(m.Captures[len(m.Captures) - 1])
+			rules = append(rules, OwnedRule{
+				RuleAllocation: RuleAllocation{ Type: set, Name: name, Number: n, Feature: ruleOwnerOf(layout, n) },
+				Owner: o,
+				node: m.Node.Parent(),
+			})
+		}
+	}
+	return rules
+}
+
+func (t *VyosConfigTree) ListOwnedRules() []OwnedRule {
+	return t.FindRulesByOwner(nil)
+}
+
+// the rule of the owner of any version under the path, e.g. 'nat source rule'
+func (t *VyosConfigTree) FindRuleByOwner(path string, owner RuleOwner) *VyosConfigNode {
+	d := t.FindFirst(path + " * description", func(d *VyosConfigNode) bool {
+		if d.ValueSize() != 1 {
+			return false
+		}
+		o, ok := ParseRuleOwner(d.Value())
+		return ok && o.Id() == owner.Id()
+	})
+	if d == nil {
+		return nil
+	}
+	return d.Parent()
+}
+
+func (t *VyosConfigTree) FindFirewallRuleByOwner(ethname, direction string, owner RuleOwner) *VyosConfigNode {
+	return t.FindRuleByOwner(fmt.Sprintf("firewall name %s.%s rule", ethname, direction), owner)
+}
+
+func (t *VyosConfigTree) FindSnatRuleByOwner(owner RuleOwner) *VyosConfigNode {
+	return t.FindRuleByOwner("nat source rule", owner)
+}
+
+func (t *VyosConfigTree) FindDnatRuleByOwner(owner RuleOwner) *VyosConfigNode {
+	return t.FindRuleByOwner("nat destination rule", owner)
+}
+
+// change the description of the rule found by the owner of another version, or of the legacy one
+func (t *VyosConfigTree) SetRuleOwner(rule *VyosConfigNode, owner RuleOwner) bool {
+	return t.SetPath(append(rule.words(), "description", owner.Description())...)
+}
+
+// the rules of the feature whose resources are not alive, e.g. left by the
+// failed or crashed commands. The rules of the unknown resources are kept, so
+// are the legacy ones unless asked, their resources are parsed from the
+// descriptions and may be wrong
+func (t *VyosConfigTree) FindOrphanRules(feature string, alive func(resource string) bool, legacy bool) []OwnedRule {
+	return t.FindRulesByOwner(func(o RuleOwner) bool {
+		return o.Feature == feature && o.Resource != "" && (legacy || o.Version > 0) && !alive(o.Resource)
+	})
+}
+
+func (t *VyosConfigTree) DeleteOrphanRules(feature string, alive func(resource string) bool, legacy bool) []OwnedRule {
+	orphans := t.FindOrphanRules(feature, alive, legacy)
+	for _, r := range orphans {
+		r.node.Delete()
+	}
+	return orphans
+}
+
+type ownedRulesRsp struct {
+	Rules []OwnedRule `json:"rules"`
+}
+
+type collectOrphanRulesCmd struct {
+	Feature string `json:"feature"`
+	// the resources of the feature alive, the rules of others are deleted
+	Resources []string `json:"resources"`
+	// no resource of the feature is alive, required if the resources are empty
+	NoResourceAlive bool `json:"noResourceAlive"`
+	// collect the rules of the legacy owners too
+	IncludeLegacy bool `json:"includeLegacy"`
+	// list the orphans only, nothing is deleted
+	Preview bool `json:"preview"`
+}
+
+type collectOrphanRulesRsp struct {
+	// the orphans to delete if it's a preview
+	Deleted []OwnedRule `json:"deleted"`
+	Preview bool `json:"preview,omitempty"`
+}
+
+func ownedRulesHandler(ctx *CommandContext) interface{} {
+	return ownedRulesRsp{ Rules: NewParserFromShowConfiguration().Tree.ListOwnedRules() }
+}
+
+func collectOrphanRulesHandler(ctx *CommandContext) interface{} {
+	cmd := &collectOrphanRulesCmd{}
+	ctx.GetCommand(cmd)
+	utils.AssertArgument(cmd.Feature != "", "the feature of the rules is required")
+	// a command missing the resources would delete all rules of the feature
+	utils.AssertArgument(len(cmd.Resources) != 0 || cmd.NoResourceAlive, "the resources alive are required, or noResourceAlive if there is none")
+	utils.AssertArgument(len(cmd.Resources) == 0 || !cmd.NoResourceAlive, "noResourceAlive is set with the resources %v", cmd.Resources)
+
+	alive := make(map[string]bool)
+	for _, r := range cmd.Resources {
+		alive[r] = true
+	}
+	isAlive := func(resource string) bool { return alive[resource] }
+
+	tree := ctx.ConfigTree()
+	if cmd.Preview {
+		return collectOrphanRulesRsp{ Deleted: tree.FindOrphanRules(cmd.Feature, isAlive, cmd.IncludeLegacy), Preview: true }
+	}
+
+	deleted := tree.DeleteOrphanRules(cmd.Feature, isAlive, cmd.IncludeLegacy)
+	tree.Apply(false)
+
+	return collectOrphanRulesRsp{ Deleted: deleted }
+}
+
+func init() {
+	RegisterSyncCommandHandler(OWNED_RULES_PATH, ownedRulesHandler)
+	RegisterAsyncCommandHandler(COLLECT_ORPHAN_RULES_PATH, ResourceLock(collectOrphanRulesHandler, RESOURCE_NAT, RESOURCE_FIREWALL))
+	RegisterBatchCommand(COLLECT_ORPHAN_RULES_PATH)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func TestRuleOwner(t *testing.T) {
+	o := RuleOwner{ Feature: RULE_FEATURE_EIP, Resource: "fd00::1", Version: 2, Key: "10.0.0.2-fa:4c:ad:b9:15:00" }
+	utils.Assert(o.Description() == "zvr:eip:fd00%3A%3A1:v2:10.0.0.2-fa:4c:ad:b9:15:00", o.Description())
+
+	p, ok := ParseRuleOwner(o.Description())
+	utils.Assertf(ok && p == o, "wrong owner %+v", p)
+
+	p, ok = ParseRuleOwner("zvr:dns:eth0:v1")
+	utils.Assertf(ok && p == RuleOwner{ Feature: RULE_FEATURE_DNS, Resource: "eth0", Version: 1 }, "wrong owner %+v", p)
+
+	for _, des := range []string{ "main", "zvr:eip:1.1.1.1", "zvr:eip:1.1.1.1:v0", "zvr:eip:1.1.1.1:x1" } {
+		_, ok = ParseRuleOwner(des)
+		utils.Assertf(!ok, "the description[%s] is not of an owner", des)
+	}
+}
+
+func TestOwnedRules(t *testing.T) {
+	defer useTempRuleRanges(t)()
+	defer func(l []legacyRuleOwner) { legacyRuleOwners = l }(legacyRuleOwners)
+	RegisterLegacyRuleOwner(RULE_FEATURE_EIP, func(des string) (string, string, bool) {
+		if fs := strings.SplitN(des, "-", 3); len(fs) == 3 && fs[0] == "EIP" {
+			return fs[1], fs[2], true
+		}
+		return "", "", false
+	})
+
+	tree := NewParserFromConfiguration(`
+firewall {
+    name eth0.in {
+        rule 1 {
+            action accept
+            description EIP-172.20.14.100-10.0.0.2-fa:00
+        }
+        rule 2 {
+            action accept
+            description zvr:eip:172.20.14.101:v1:10.0.0.3-fa:01
+        }
+        rule 3 {
+            action accept
+            description main
+        }
+        rule 4 {
+            action accept
+            description zvr:ipsec::v1:esp
+        }
+    }
+}
+nat {
+    source {
+        rule 1001 {
+            description zvr:eip:172.20.14.101:v1:10.0.0.3-fa:01
+        }
+    }
+}
+`).Tree
+
+	owned := make([]string, 0)
+	for _, r := range tree.ListOwnedRules() {
+		owned = append(owned, fmt.Sprintf("%s %s %v %s %s", r.Type, r.Name, r.Number, r.Owner.Id(), r.Feature))
+	}
+	expected := []string{
+		"firewall eth0.in 1 eip:172.20.14.100:10.0.0.2-fa:00 default",
+		"firewall eth0.in 2 eip:172.20.14.101:10.0.0.3-fa:01 default",
+		"firewall eth0.in 4 ipsec::esp default",
+		"nat source  1001 eip:172.20.14.101:10.0.0.3-fa:01 eip",
+	}
+	utils.Assertf(strings.Join(owned, "\n") == strings.Join(expected, "\n"), "wrong owned rules:\n%s", strings.Join(owned, "\n"))
+
+	// the legacy rule is found by its owner of any version, and its description is changed
+	owner := RuleOwner{ Feature: RULE_FEATURE_EIP, Resource: "172.20.14.100", Version: 1, Key: "10.0.0.2-fa:00" }
+	r := tree.FindFirewallRuleByOwner("eth0", "in", owner)
+	utils.Assert(r != nil && r.String() == "firewall name eth0.in rule 1", "the legacy rule is not found")
+	utils.Assert(tree.SetRuleOwner(r, owner), "the description is not changed")
+	utils.Assert(!tree.SetRuleOwner(r, owner), "the description is changed again")
+	utils.Assert(tree.Has("firewall name eth0.in rule 1 description zvr:eip:172.20.14.100:v1:10.0.0.2-fa:00"), tree.String())
+	utils.Assert(tree.FindSnatRuleByOwner(owner) == nil, "the snat rule of the owner doesn't exist")
+
+	// only the rules of the dead resources of the feature are collected, the legacy ones if asked
+	tree.SetPath("firewall", "name", "eth0.in", "rule", "5", "description", "EIP-172.20.14.102-10.0.0.4-fa:02")
+	alive := func(resource string) bool { return resource == "172.20.14.100" }
+	utils.Assertf(len(tree.FindOrphanRules(RULE_FEATURE_EIP, alive, true)) == 3, "wrong orphans %v", tree.FindOrphanRules(RULE_FEATURE_EIP, alive, true))
+	deleted := tree.DeleteOrphanRules(RULE_FEATURE_EIP, alive, false)
+	utils.Assertf(len(deleted) == 2, "wrong orphans %v", deleted)
+	utils.Assert(!tree.Has("firewall name eth0.in rule 2") && !tree.Has("nat source rule 1001"), "the orphans are not deleted")
+	utils.Assert(tree.Has("firewall name eth0.in rule 1") && tree.Has("firewall name eth0.in rule 3") && tree.Has("firewall name eth0.in rule 4"), "the others are deleted")
+	utils.Assert(tree.Get("firewall name eth0.in rule 5") != nil, "the legacy orphan is deleted")
+	deleted = tree.DeleteOrphanRules(RULE_FEATURE_EIP, alive, true)
+	utils.Assertf(len(deleted) == 1 && deleted[0].Number == 5, "wrong orphans %v", deleted)
+	utils.Assert(len(tree.DeleteOrphanRules(RULE_FEATURE_IPSEC, func(string) bool { return false }, true)) == 0, "the shared rules have no resource to collect by")
+}
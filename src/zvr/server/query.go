@@ -0,0 +1,87 @@
+package server
+
+import (
+	"strings"
+)
+
+// FindAll matches the nodes of a path with '*' for any word, e.g.
+//
+//   tree.FindAll("firewall name * rule * description", Prefix("EIP"))
+//
+// returns the descriptions starting with EIP of the rules of all firewalls,
+// each with the firewall name and the rule number the wildcards matched. A
+// quoted "*" matches the word * only. The nodes are in the order of the tree
+
+type ConfigQueryMatch struct {
+	Node *VyosConfigNode
+	// the words matched by the wildcards, in order
+	Captures []string
+}
+
+// the matched node is returned only if all predicates are true
+type NodePredicate func(n *VyosConfigNode) bool
+
+// any value of the node matched
+func ValueMatches(match func(value string) bool) NodePredicate {
+	return func(n *VyosConfigNode) bool {
+		for _, v := range n.Values() {
+			if match(v) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func Prefix(prefix string) NodePredicate {
+	return ValueMatches(func(v string) bool { return strings.HasPrefix(v, prefix) })
+}
+
+func Equals(value string) NodePredicate {
+	return ValueMatches(func(v string) bool { return v == value })
+}
+
+func (n *VyosConfigNode) FindAll(path string, predicates ...NodePredicate) []ConfigQueryMatch {
+	matches := make([]ConfigQueryMatch, 0)
+	n.findAll(splitConfigPath(path), nil, predicates, &matches)
+	return matches
+}
+
+// the first node matched, nil if none
+func (n *VyosConfigNode) FindFirst(path string, predicates ...NodePredicate) *VyosConfigNode {
+	if ms := n.FindAll(path, predicates...); len(ms) > 0 {
+		return ms[0].Node
+	}
+	return nil
+}
+
+func (n *VyosConfigNode) findAll(words []vyosToken, captures []string, predicates []NodePredicate, matches *[]ConfigQueryMatch) {
+	if len(words) == 0 {
+		for _, p := range predicates {
+			if !p(n) {
+				return
+			}
+		}
+		*matches = append(*matches, ConfigQueryMatch{ Node: n, Captures: append([]string{}, captures...) })
+		return
+	}
+
+	w := words[0]
+	if w.text == "*" && !w.quoted {
+		for _, c := range n.Children() {
+			c.findAll(words[1:], append(captures, c.name), predicates, matches)
+		}
+	} else if c := n.getNode(w.text); c != nil {
+		c.findAll(words[1:], captures, predicates, matches)
+	}
+}
+
+func (t *VyosConfigTree) FindAll(path string, predicates ...NodePredicate) []ConfigQueryMatch {
+	t.init()
+	return t.Root.FindAll(path, predicates...)
+}
+
+func (t *VyosConfigTree) FindFirst(path string, predicates ...NodePredicate) *VyosConfigNode {
+	t.init()
+	return t.Root.FindFirst(path, predicates...)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func TestQuery(t *testing.T) {
+	tree := NewParserFromConfiguration(`
+firewall {
+    name eth0.in {
+        rule 1 {
+            description EIP-172.20.14.100
+        }
+        rule 2 {
+            description main
+        }
+    }
+    name eth1.local {
+        rule 3 {
+            description EIP-172.20.14.101
+        }
+    }
+    name "*" {
+        rule 4 {
+            description other
+        }
+    }
+}
+`).Tree
+
+	found := make([]string, 0)
+	for _, m := range tree.FindAll("firewall name * rule * description", Prefix("EIP")) {
+		found = append(found, fmt.Sprintf("%s %s", strings.Join(m.Captures, " "), m.Node.Value()))
+	}
+	expected := []string{
+		"eth0.in 1 EIP-172.20.14.100",
+		"eth1.local 3 EIP-172.20.14.101",
+	}
+	utils.Assertf(strings.Join(found, "\n") == strings.Join(expected, "\n"), "wrong matches:\n%s", strings.Join(found, "\n"))
+
+	// all the children without predicates, a quoted "*" for the word only
+	utils.Assert(len(tree.FindAll("firewall name * rule *")) == 4, "wrong number of rules")
+	ms := tree.FindAll(`firewall name "*" rule *`)
+	utils.Assertf(len(ms) == 1 && ms[0].Node.String() == `firewall name "*" rule 4` && ms[0].Captures[0] == "4", "wrong matches %v", ms)
+
+	r := tree.FindFirewallRuleByDescription("eth1", "local", "EIP-172.20.14.101")
+	utils.Assert(r != nil && r.String() == "firewall name eth1.local rule 3", "the rule is not found")
+	utils.Assert(tree.FindFirst("firewall name * rule * description", Equals("none")) == nil, "no rule should be found")
+	utils.Assert(len((&VyosConfigTree{}).FindAll("firewall name *")) == 0, "no node in an empty tree")
+}
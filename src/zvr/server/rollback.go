@@ -0,0 +1,270 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Before a commit the running config is saved as a snapshot. If the
+// commit or a post-commit check fails, the snapshot is loaded back and
+// the error tells both why the commit failed and how the rollback went.
+// The built-in check makes sure the changes are in the config shown after
+// the commit, see checkCommandsCommitted
+
+// a check run after a successful commit with the config shown after it,
+// an error rolls the commit back
+type PostCommitCheck func(commands []string, config string) error
+
+var (
+	postCommitLock = &sync.Mutex{}
+	postCommitChecks = make([]PostCommitCheck, 0)
+
+	// the snapshot, commit and rollback of one commit are not interleaved with others
+	transactionLock = &sync.Mutex{}
+)
+
+func RegisterPostCommitCheck(check PostCommitCheck) {
+	utils.Assert(check != nil, "check cannot be nil")
+
+	postCommitLock.Lock()
+	defer postCommitLock.Unlock()
+	postCommitChecks = append(postCommitChecks, check)
+}
+
+func runPostCommitChecks(commands []string, config string) error {
+	postCommitLock.Lock()
+	checks := make([]PostCommitCheck, len(postCommitChecks))
+	copy(checks, postCommitChecks)
+	postCommitLock.Unlock()
+
+	for _, check := range checks {
+		if err := check(commands, config); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type scriptChange struct {
+	set bool
+	words []string
+}
+
+func isPathPrefix(prefix, words []string) bool {
+	if len(prefix) > len(words) {
+		return false
+	}
+	for i, w := range prefix {
+		if words[i] != w {
+			return false
+		}
+	}
+	return true
+}
+
+// the path is changed again by the later commands, e.g. deleted with its
+// parent, or the value of the leaf set is replaced by another one
+func (c scriptChange) changedBy(later []scriptChange) bool {
+	for _, l := range later {
+		if isPathPrefix(l.words, c.words) {
+			return true
+		}
+		if c.set && l.set && len(l.words) == len(c.words) && isPathPrefix(c.words[:len(c.words)-1], l.words) {
+			return true
+		}
+		if !c.set && isPathPrefix(c.words, l.words) {
+			return true
+		}
+	}
+	return false
+}
+
+// vyos prints some values in its own form, e.g. the macs in lower case
+// and the ipv6 addresses compressed, so the words are compared in a normal form
+func normalizeConfigWord(w string) string {
+	if ip := net.ParseIP(w); ip != nil {
+		return ip.String()
+	}
+	if ip, n, err := net.ParseCIDR(w); err == nil {
+		ones, _ := n.Mask.Size()
+		return fmt.Sprintf("%s/%v", ip.String(), ones)
+	}
+	return strings.ToLower(w)
+}
+
+// the node of the path in the config shown, the words are compared in the normal form
+func findShownPath(n *VyosConfigNode, words []string) *VyosConfigNode {
+	if len(words) == 0 {
+		return n
+	}
+
+	w := normalizeConfigWord(words[0])
+	for _, c := range n.children {
+		if normalizeConfigWord(c.name) != w {
+			continue
+		}
+		if found := findShownPath(c, words[1:]); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// every path set by the commands is in the config committed, and every
+// path deleted is not, unless it's changed again by a later command
+func checkCommandsCommitted(commands []string, config string) error {
+	changes := make([]scriptChange, 0, len(commands))
+	for _, c := range commands {
+		op, words, err := parseScriptCommand(c)
+		if err != nil || len(words) == 0 || (op != "$SET" && op != "$DELETE") {
+			continue
+		}
+		changes = append(changes, scriptChange{ set: op == "$SET", words: words })
+	}
+
+	tree := NewParserFromConfiguration(config).Tree
+	errs := make([]string, 0)
+	for i, c := range changes {
+		if c.changedBy(changes[i+1:]) {
+			continue
+		}
+
+		n := findShownPath(tree.Root, c.words)
+		if c.set && n == nil {
+			errs = append(errs, fmt.Sprintf("the path[%s] set is not in the configuration", ConfigPath(c.words...)))
+		} else if !c.set && n != nil {
+			errs = append(errs, fmt.Sprintf("the path[%s] deleted is still in the configuration", ConfigPath(c.words...)))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func panicToError(e interface{}) error {
+	if err, ok := e.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", e)
+}
+
+// run the script of the vyos backend and return the panic as an error, it's replaced in unit tests
+var execVyosScript = func(script string, asVyosUser bool) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = panicToError(e)
+		}
+	}()
+
+	if asVyosUser {
+		runVyosScriptAsUserVyos(script)
+	} else {
+		runVyosScript(script, nil)
+	}
+
+	return nil
+}
+
+// the config is shown from the backend, it panics if it cannot be shown
+func takeConfigSnapshot() (snapshot string, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = panicToError(e)
+		}
+	}()
+
+	return VyosShowConfiguration(), nil
+}
+
+// the snapshot is taken under the transaction lock, it's printed from the
+// cache if nothing is committed since the cache is loaded, the commits out
+// of zvr are found by the config revision
+func takeSnapshotBeforeCommit() (string, error) {
+	if config, ok := configs.currentConfig(); ok {
+		return config, nil
+	}
+	return takeConfigSnapshot()
+}
+
+// keep the code and details of the commit error, add the rollback result
+func makeRollbackError(cause, rollbackErr error) error {
+	code := utils.VYOS_COMMIT_FAILED
+	details := make(map[string]interface{})
+	if ae := utils.AsAgentError(cause); ae != nil {
+		code = ae.Code
+		for k, v := range ae.Details {
+			details[k] = v
+		}
+	}
+
+	if rollbackErr == nil {
+		details["rollback"] = "succeeded"
+		return utils.NewAgentError(code, details, "%v, the configuration is rolled back", cause)
+	}
+
+	details["rollback"] = "failed"
+	details["rollbackError"] = rollbackErr.Error()
+	return utils.NewAgentError(utils.VYOS_ROLLBACK_FAILED, details,
+		"%v, and the configuration cannot be rolled back, %v", cause, rollbackErr)
+}
+
+// the config shown after the commit is returned, shown is false if it cannot be shown
+func commitWithRollback(commands []string, asVyosUser bool) (config string, shown bool, err error) {
+	return commitTransaction(commands, asVyosUser, func(b Backend) error {
+		return commitScriptCommands(b, commands, asVyosUser)
+	})
+}
+
+// replace the running config, e.g. with an archived version, the commands tell what's loaded
+func loadWithRollback(config string, commands []string, asVyosUser bool) error {
+	_, _, err := commitTransaction(commands, asVyosUser, func(b Backend) error {
+		return b.Load(config, asVyosUser)
+	})
+	return err
+}
+
+// the commands are passed to the post-commit checks
+func commitTransaction(commands []string, asVyosUser bool, commit func(b Backend) error) (config string, shown bool, err error) {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+
+	b := CurrentBackend()
+	snapshot, err := takeSnapshotBeforeCommit()
+	if err != nil {
+		return "", false, utils.NewAgentError(utils.VYOS_COMMIT_FAILED, nil, "unable to save the running configuration before the commit, %v", err)
+	}
+
+	err = commit(b)
+	if err == nil {
+		// shown once for the checks and the archive. If it cannot be
+		// shown, the commit has succeeded but it cannot be checked
+		if config, err = takeConfigSnapshot(); err != nil {
+			log.Warnf("unable to show the configuration after the commit, skip the post-commit checks, %v", err)
+			return "", false, nil
+		}
+
+		if err = runPostCommitChecks(commands, config); err == nil {
+			return config, true, nil
+		}
+		err = utils.NewAgentError(utils.VYOS_COMMIT_FAILED, nil, "the post-commit check failed, %v", err)
+	}
+
+	log.Warnf("the commit failed, roll back the configuration, %v", err)
+	rollbackErr := b.Load(snapshot, asVyosUser)
+	if rollbackErr != nil {
+		log.Warnf("unable to roll back the configuration, %v", rollbackErr)
+	}
+
+	return "", false, makeRollbackError(err, rollbackErr)
+}
+
+func init() {
+	RegisterPostCommitCheck(checkCommandsCommitted)
+}
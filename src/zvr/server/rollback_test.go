@@ -0,0 +1,185 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func mockVyosScript(fn func(script string) error) (*[]string, func()) {
+	scripts := make([]string, 0)
+	old := execVyosScript
+	execVyosScript = func(script string, asVyosUser bool) error {
+		scripts = append(scripts, script)
+		return fn(script)
+	}
+
+	return &scripts, func() { execVyosScript = old }
+}
+
+// the mocked scripts change nothing, so the changes are not found after the commit
+func withoutPostCommitChecks() func() {
+	old := postCommitChecks
+	postCommitChecks = make([]PostCommitCheck, 0)
+	return func() { postCommitChecks = old }
+}
+
+func TestRollbackOnCommitFailure(t *testing.T) {
+	defer withoutPostCommitChecks()()
+	defer func(f func() string) { ConfigurationSourceFunc = f }(ConfigurationSourceFunc)
+	ConfigurationSourceFunc = func() string { return "interfaces {\n}\n" }
+
+	loadedMode := ""
+	scripts, restore := mockVyosScript(func(script string) error {
+		if strings.Contains(script, "broken") {
+			return utils.NewAgentError(utils.VYOS_COMMIT_FAILED, map[string]interface{}{ "returnCode": 1 }, "commit failed")
+		}
+		if strings.HasPrefix(script, "$API loadFile ") {
+			// the snapshot is private
+			path := strings.Fields(script)[2]
+			d, err := os.Stat(filepath.Dir(path)); utils.PanicOnError(err)
+			f, err := os.Stat(path); utils.PanicOnError(err)
+			loadedMode = fmt.Sprintf("%v %v", d.Mode().Perm(), f.Mode().Perm())
+		}
+		return nil
+	})
+	defer restore()
+
+	_, _, err := commitWithRollback([]string{ "$SET good" }, false)
+	utils.PanicOnError(err)
+	utils.Assertf(len(*scripts) == 1, "a successful commit is rolled back: %v", *scripts)
+
+	_, _, err = commitWithRollback([]string{ "$SET broken" }, false)
+	ae := utils.AsAgentError(err)
+	utils.Assertf(ae != nil && ae.Code == utils.VYOS_COMMIT_FAILED, "unexpected error %v", err)
+	utils.Assertf(ae.Details["rollback"] == "succeeded" && ae.Details["returnCode"] == 1, "unexpected details %v", ae.Details)
+	utils.Assertf(len(*scripts) == 3 && strings.HasPrefix((*scripts)[2], "$API loadFile "), "no rollback: %v", *scripts)
+	utils.Assertf(loadedMode == "-rwx------ -rw-------", "the snapshot is not private: %s", loadedMode)
+
+	// the rollback fails too
+	restore()
+	_, restore = mockVyosScript(func(script string) error { return fmt.Errorf("vyos is broken") })
+	_, _, err = commitWithRollback([]string{ "$SET broken" }, false)
+	ae = utils.AsAgentError(err)
+	utils.Assertf(ae != nil && ae.Code == utils.VYOS_ROLLBACK_FAILED, "unexpected error %v", ae)
+}
+
+func TestRollbackOnPostCommitCheckFailure(t *testing.T) {
+	defer func(f func() string) { ConfigurationSourceFunc = f }(ConfigurationSourceFunc)
+	ConfigurationSourceFunc = func() string { return "" }
+	scripts, restore := mockVyosScript(func(script string) error { return nil })
+	defer restore()
+
+	defer withoutPostCommitChecks()()
+	RegisterPostCommitCheck(func(commands []string, config string) error {
+		if commands[0] == "$SET unchecked" {
+			return fmt.Errorf("not there")
+		}
+		return nil
+	})
+
+	_, _, err := commitWithRollback([]string{ "$SET checked" }, false)
+	utils.PanicOnError(err)
+	_, _, err = commitWithRollback([]string{ "$SET unchecked" }, false)
+	utils.Assertf(err != nil && strings.Contains(err.Error(), "not there") && strings.Contains(err.Error(), "rolled back"), "unexpected error %v", err)
+	utils.Assertf(len(*scripts) == 3, "unexpected scripts %v", *scripts)
+}
+
+// a backend losing the changes of some paths silently
+type lossyBackend struct {
+	*SimulatedBackend
+	loaded []string
+}
+
+func (b *lossyBackend) Set(words []string) error {
+	if words[len(words)-1] == "lost" {
+		return nil
+	}
+	return b.SimulatedBackend.Set(words)
+}
+
+func (b *lossyBackend) Load(config string, asVyosUser bool) error {
+	b.loaded = append(b.loaded, config)
+	return b.SimulatedBackend.Load(config, asVyosUser)
+}
+
+func TestRollbackWhenChangesNotCommitted(t *testing.T) {
+	defer func(f func() string) { ConfigurationSourceFunc = f }(ConfigurationSourceFunc)
+	ConfigurationSourceFunc = func() string { return CurrentBackend().ShowConfiguration() }
+	b := &lossyBackend{ SimulatedBackend: NewSimulatedBackend(simulatedConfig) }
+	old := CurrentBackend()
+	SetBackend(b)
+	defer SetBackend(old)
+
+	config, shown, err := commitWithRollback([]string{ "$SET interfaces ethernet eth0 description lan",
+		"$DELETE interfaces ethernet eth0 address 10.0.0.1/24", "$SET interfaces ethernet eth0 address 10.0.0.2/24" }, false)
+	utils.PanicOnError(err)
+	utils.Assertf(shown && strings.Contains(config, "description lan") && len(b.loaded) == 0, "the commit is not checked right:\n%s", config)
+
+	// the change lost is found after the commit, the snapshot is loaded back
+	snapshot := b.ShowConfiguration()
+	_, _, err = commitWithRollback([]string{ "$SET interfaces ethernet eth0 description wan", "$SET interfaces ethernet eth0 description lost" }, false)
+	ae := utils.AsAgentError(err)
+	utils.Assertf(ae != nil && ae.Details["rollback"] == "succeeded" && strings.Contains(err.Error(), "description lost"), "unexpected error %v", err)
+	utils.Assertf(len(b.loaded) == 1 && b.loaded[0] == snapshot, "the snapshot is not loaded: %v", b.loaded)
+	utils.Assertf(b.ShowConfiguration() == snapshot, "the configuration is not rolled back:\n%s", b.ShowConfiguration())
+}
+
+// a backend counting the configs shown
+type countingBackend struct {
+	*SimulatedBackend
+	shows int
+}
+
+func (b *countingBackend) ShowConfiguration() string {
+	b.shows++
+	return b.SimulatedBackend.ShowConfiguration()
+}
+
+func TestSnapshotFromCache(t *testing.T) {
+	defer func(o Options, c *configCache) { commandOptions = o; configs = c }(commandOptions, configs)
+	commandOptions.ConfigCacheTTL = 30
+	configs = &configCache{}
+	defer func(f func() string) { ConfigurationSourceFunc = f }(ConfigurationSourceFunc)
+	ConfigurationSourceFunc = func() string { return CurrentBackend().ShowConfiguration() }
+	defer useTempHistoryDir(t)()
+	b := &countingBackend{ SimulatedBackend: NewSimulatedBackend(simulatedConfig) }
+	old := CurrentBackend()
+	SetBackend(b)
+	defer SetBackend(old)
+
+	// the config is shown once after the commit, the snapshot is printed from the cache
+	NewParserFromShowConfiguration()
+	b.shows = 0
+	utils.PanicOnError(commits.commit([]string{ "$SET interfaces ethernet eth0 description lan" }, false))
+	utils.Assertf(b.shows == 1, "the config is shown %v times", b.shows)
+
+	// the snapshot printed is loaded back when the commit fails
+	snapshot := b.ShowConfiguration()
+	b.shows = 0
+	err := commits.commit([]string{ "$SET firewall name eth0.in rule 1 description broken" }, false)
+	ae := utils.AsAgentError(err)
+	utils.Assertf(ae != nil && ae.Details["rollback"] == "succeeded", "unexpected error %v", err)
+	utils.Assertf(b.shows == 0 && b.ShowConfiguration() == snapshot, "the configuration is not rolled back:\n%s", b.ShowConfiguration())
+}
+
+func TestCheckCommandsCommitted(t *testing.T) {
+	config := "service {\n    ssh {\n        port 2222\n    }\n}\n"
+	utils.PanicOnError(checkCommandsCommitted([]string{ "$SET service ssh port 2222", "$DELETE service dns" }, config))
+	// the paths changed again later are not checked
+	utils.PanicOnError(checkCommandsCommitted([]string{ "$SET service ssh port 22", "$DELETE service ssh port",
+		"$SET service ssh port 2222", "$SET service dns forwarding cache-size 0", "$DELETE service dns",
+		"$DELETE service ssh", "$SET service ssh port 2222", "# not a change" }, config))
+
+	// the values are printed by vyos in its own form
+	shown := "service {\n    dhcp-server {\n        static-mapping vm {\n            mac-address fa:62:6b:d9:10:00\n        }\n    }\n}\n" +
+		"interfaces {\n    ethernet eth0 {\n        address 2001:db8::1/64\n    }\n}\n"
+	utils.PanicOnError(checkCommandsCommitted([]string{ "$SET service dhcp-server static-mapping vm mac-address FA:62:6B:D9:10:00",
+		"$SET interfaces ethernet eth0 address 2001:0db8:0:0::1/64" }, shown))
+
+	err := checkCommandsCommitted([]string{ "$SET service ssh port 22", "$DELETE service ssh port 2222" }, config)
+	utils.Assertf(err != nil && strings.Contains(err.Error(), "port 22]") && strings.Contains(err.Error(), "still"), "unexpected error %v", err)
+}
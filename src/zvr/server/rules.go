@@ -0,0 +1,500 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Each feature gets its own range of the numbers of a rule set, so the order
+// of the rules no longer depends on which feature sets its rules first, e.g.
+// the IPsec exclusions always come before the SNAT of the EIPs. The ranges of
+// a rule set are laid out from 1 by priority, the lower first. The free
+// numbers of a range are collected once per tree and handed out in O(1), the
+// lowest first. An exhausted range grows at the cost of the lowest priority
+// range with enough free numbers, the rules of the ranges moved in between
+// are renumbered in the tree in their order. The new ranges are saved once
+// the tree is committed
+
+const (
+	RULE_SET_FIREWALL = "firewall"
+	RULE_SET_NAT_DESTINATION = "nat destination"
+	RULE_SET_NAT_SOURCE = "nat source"
+
+	// the range of the rules of the features without their own range
+	RULE_FEATURE_DEFAULT = "default"
+	RULE_FEATURE_EIP = "eip"
+	RULE_FEATURE_IPSEC = "ipsec"
+	RULE_FEATURE_PORT_FORWARDING = "portforwarding"
+	RULE_FEATURE_SNAT = "snat"
+	RULE_FEATURE_DHCP = "dhcp"
+	RULE_FEATURE_DNS = "dns"
+	RULE_FEATURE_LB = "lb"
+
+	MAX_RULE_NUMBER = 9999
+
+	RULE_OWNERS_PATH = "/rules/owners"
+)
+
+var (
+	RULE_SETS = []string{ RULE_SET_FIREWALL, RULE_SET_NAT_DESTINATION, RULE_SET_NAT_SOURCE }
+
+	RULE_RANGES_FILE = "/home/vyos/zvr/rule-ranges.json"
+
+	// the ranges of the rule sets not configured in RULE_RANGES_FILE
+	DEFAULT_RULE_RANGES = map[string][]RuleRange{
+		RULE_SET_FIREWALL: {
+			{ Feature: RULE_FEATURE_DEFAULT, Priority: 50, Size: MAX_RULE_NUMBER },
+		},
+		RULE_SET_NAT_DESTINATION: {
+			{ Feature: RULE_FEATURE_PORT_FORWARDING, Priority: 10, Size: 4000 },
+			{ Feature: RULE_FEATURE_EIP, Priority: 20, Size: 4000 },
+			{ Feature: RULE_FEATURE_DEFAULT, Priority: 90, Size: 1999 },
+		},
+		RULE_SET_NAT_SOURCE: {
+			{ Feature: RULE_FEATURE_IPSEC, Priority: 10, Size: 1000 },
+			{ Feature: RULE_FEATURE_EIP, Priority: 20, Size: 7000 },
+			{ Feature: RULE_FEATURE_DEFAULT, Priority: 90, Size: 1998 },
+			// the SNAT of the public network is rule 9999, see plugin/snat.go
+			{ Feature: RULE_FEATURE_SNAT, Priority: 100, Size: 1, Fixed: true },
+		},
+	}
+)
+
+type RuleRange struct {
+	Feature string `json:"feature"`
+	// the range with the lower priority comes first
+	Priority int `json:"priority"`
+	Size int `json:"size"`
+	// the numbers are chosen by the feature, the range is never moved or shrunk
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+type RuleRangeLayout struct {
+	RuleRange
+	Start int `json:"start"`
+	End int `json:"end"`
+}
+
+type rangesByPriority []RuleRange
+
+func (rs rangesByPriority) Len() int { return len(rs) }
+func (rs rangesByPriority) Less(i, j int) bool { return rs[i].Priority < rs[j].Priority }
+func (rs rangesByPriority) Swap(i, j int) { rs[i], rs[j] = rs[j], rs[i] }
+
+func layoutRuleRanges(ranges []RuleRange) []RuleRangeLayout {
+	sorted := append(rangesByPriority{}, ranges...)
+	sort.Stable(sorted)
+
+	layout := make([]RuleRangeLayout, len(sorted))
+	start := 1
+	for i, r := range sorted {
+		layout[i] = RuleRangeLayout{ RuleRange: r, Start: start, End: start + r.Size - 1 }
+		start += r.Size
+	}
+	return layout
+}
+
+func findRuleRange(layout []RuleRangeLayout, feature string) *RuleRangeLayout {
+	for i := range layout {
+		if layout[i].Feature == feature {
+			return &layout[i]
+		}
+	}
+	return nil
+}
+
+// the feature owning the number, empty if it's out of all ranges
+func ruleOwnerOf(layout []RuleRangeLayout, number int) string {
+	for _, r := range layout {
+		if number >= r.Start && number <= r.End {
+			return r.Feature
+		}
+	}
+	return ""
+}
+
+func validateRuleRanges(set string, ranges []RuleRange) {
+	total := 0
+	features := make(map[string]bool)
+	for _, r := range ranges {
+		utils.Assertf(r.Size > 0, "the range of the feature[%s] in %s is empty", r.Feature, set)
+		utils.Assertf(!features[r.Feature], "the feature[%s] has more than one range in %s", r.Feature, set)
+		features[r.Feature] = true
+		total += r.Size
+	}
+
+	utils.Assertf(features[RULE_FEATURE_DEFAULT], "no range of the feature[%s] in %s", RULE_FEATURE_DEFAULT, set)
+	utils.Assertf(total <= MAX_RULE_NUMBER, "the ranges of %s have %v numbers, more than %v", set, total, MAX_RULE_NUMBER)
+}
+
+type ruleRangeConfig struct {
+	lock sync.Mutex
+	// loaded from RULE_RANGES_FILE the first time they're used
+	ranges map[string][]RuleRange
+}
+
+var ruleRanges = &ruleRangeConfig{}
+
+func loadRuleRanges() map[string][]RuleRange {
+	ranges := make(map[string][]RuleRange)
+	for set, rs := range DEFAULT_RULE_RANGES {
+		ranges[set] = rs
+	}
+
+	content, err := ioutil.ReadFile(RULE_RANGES_FILE)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("unable to read the rule ranges, the default ones are used, %v", err)
+		}
+		return ranges
+	}
+
+	saved := make(map[string][]RuleRange)
+	if err = json.Unmarshal(content, &saved); err != nil {
+		log.Warnf("unable to parse the rule ranges, the default ones are used, %v", err)
+		return ranges
+	}
+	for set, rs := range saved {
+		ranges[set] = rs
+	}
+	return ranges
+}
+
+func (c *ruleRangeConfig) get(set string) []RuleRange {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ranges == nil {
+		c.ranges = loadRuleRanges()
+	}
+
+	rs, ok := c.ranges[set]
+	utils.Assertf(ok, "unknown rule set[%s]", set)
+	return append([]RuleRange{}, rs...)
+}
+
+func (c *ruleRangeConfig) set(set string, ranges []RuleRange) {
+	validateRuleRanges(set, ranges)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ranges == nil {
+		c.ranges = loadRuleRanges()
+	}
+	c.ranges[set] = append([]RuleRange{}, ranges...)
+
+	b, err := json.Marshal(c.ranges)
+	if err == nil {
+		err = utils.MkdirForFile(RULE_RANGES_FILE, 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(RULE_RANGES_FILE, b, 0644)
+	}
+	if err != nil {
+		log.Warnf("unable to save the rule ranges, %v", err)
+	}
+}
+
+// configure the ranges of the rule set, the rules already set are not moved
+func SetRuleRanges(set string, ranges ...RuleRange) {
+	ruleRanges.set(set, ranges)
+}
+
+func RuleRangesOf(set string) []RuleRangeLayout {
+	return layoutRuleRanges(ruleRanges.get(set))
+}
+
+// the ranges of the rule set, the ones grown by the tree until it's committed
+func (t *VyosConfigTree) ruleRangesOf(set string) []RuleRange {
+	if rs, ok := t.ruleRanges[set]; ok {
+		return append([]RuleRange{}, rs...)
+	}
+	return ruleRanges.get(set)
+}
+
+// save the ranges grown by the tree, it's committed
+func (t *VyosConfigTree) commitRuleRanges() {
+	for set, rs := range t.ruleRanges {
+		log.Debugf("[Vyos Configuration] the rule ranges of %s are changed to %v", set, layoutRuleRanges(rs))
+		ruleRanges.set(set, rs)
+	}
+	t.ruleRanges = nil
+}
+
+// the rule nodes of the rule set, e.g. 'nat source rule' or 'firewall name eth0.in rule' of each firewall
+// the query of the rules of the set, the firewall name is captured
+func ruleSetQuery(set string) string {
+	if set == RULE_SET_FIREWALL {
+		return "firewall name * rule"
+	}
+	return set + " rule"
+}
+
+func (t *VyosConfigTree) ruleSetNodes(set string) []*VyosConfigNode {
+	nodes := make([]*VyosConfigNode, 0)
+	for _, m := range t.FindAll(ruleSetQuery(set)) {
+		nodes = append(nodes, m.Node)
+	}
+	return nodes
+}
+
+// the numbers of the rules, from the lowest
+func ruleNumbers(rules *VyosConfigNode) []int {
+	numbers := make([]int, 0)
+	for _, c := range rules.Children() {
+		if n, err := strconv.Atoi(c.name); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+func ruleNumbersIn(rules *VyosConfigNode, r RuleRangeLayout) []int {
+	numbers := make([]int, 0)
+	for _, n := range ruleNumbers(rules) {
+		if n >= r.Start && n <= r.End {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers
+}
+
+func ruleWords(path []string, number int, words ...string) []string {
+	ws := make([]string, 0, len(path) + 1 + len(words))
+	ws = append(ws, path...)
+	ws = append(ws, strconv.Itoa(number))
+	return append(ws, words...)
+}
+
+type ruleAllocator struct {
+	layout []RuleRangeLayout
+	// the free numbers of each feature, the lowest at the end
+	free map[string][]int
+}
+
+// the allocator of the rules under the path, e.g. 'nat source rule'
+func (t *VyosConfigTree) ruleAllocator(set string, path []string) *ruleAllocator {
+	key := ConfigPath(path...)
+	if a := t.allocators[key]; a != nil {
+		return a
+	}
+
+	a := &ruleAllocator{
+		layout: layoutRuleRanges(t.ruleRangesOf(set)),
+		free: make(map[string][]int),
+	}
+	rules := t.GetPath(path...)
+	for _, r := range a.layout {
+		free := make([]int, 0)
+		for i := r.End; i >= r.Start; i-- {
+			if rules == nil || rules.getNode(strconv.Itoa(i)) == nil {
+				free = append(free, i)
+			}
+		}
+		a.free[r.Feature] = free
+	}
+
+	if t.allocators == nil {
+		t.allocators = make(map[string]*ruleAllocator)
+	}
+	t.allocators[key] = a
+	return a
+}
+
+func (a *ruleAllocator) featureOf(feature string) string {
+	if findRuleRange(a.layout, feature) == nil {
+		return RULE_FEATURE_DEFAULT
+	}
+	return feature
+}
+
+func (a *ruleAllocator) next(t *VyosConfigTree, path []string, feature string) (int, bool) {
+	feature = a.featureOf(feature)
+	free := a.free[feature]
+	defer func() { a.free[feature] = free }()
+
+	for len(free) > 0 {
+		n := free[len(free) - 1]
+		free = free[:len(free) - 1]
+		// the number may be set by others after the allocator is created
+		if t.GetPath(ruleWords(path, n)...) == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// the lowest free number in the range of the feature, the range is grown if it's exhausted
+func (t *VyosConfigTree) allocateRule(set string, path []string, feature string) int {
+	a := t.ruleAllocator(set, path)
+	if n, ok := a.next(t, path, feature); ok {
+		return n
+	}
+
+	t.growRuleRange(set, a.featureOf(feature))
+	n, ok := t.ruleAllocator(set, path).next(t, path, feature)
+	utils.Assertf(ok, "no rule number available in %s for the feature[%s]", ConfigPath(path...), feature)
+	return n
+}
+
+// grow the range of the feature by its size, or the half and so on, at the cost of the
+// numbers out of all ranges or the lowest priority range with enough free numbers
+func (t *VyosConfigTree) growRuleRange(set, feature string) {
+	ranges := t.ruleRangesOf(set)
+	old := layoutRuleRanges(ranges)
+	sets := t.ruleSetNodes(set)
+
+	grown := findRuleRange(old, feature)
+	utils.Assertf(!grown.Fixed, "the range of the feature[%s] in %s is exhausted", feature, set)
+
+	// the most numbers used in a rule set, e.g. of all firewalls
+	used := make(map[string]int)
+	total := 0
+	for _, r := range old {
+		for _, rules := range sets {
+			if n := len(ruleNumbersIn(rules, r)); n > used[r.Feature] {
+				used[r.Feature] = n
+			}
+		}
+		total += r.Size
+	}
+
+	// from the lowest priority
+	lenders := make([]string, 0)
+	for i := len(old) - 1; i >= 0; i-- {
+		if old[i].Feature != feature && !old[i].Fixed {
+			lenders = append(lenders, old[i].Feature)
+		}
+	}
+
+	for size := grown.Size; size > 0; size /= 2 {
+		if total + size <= MAX_RULE_NUMBER && t.resizeRuleRanges(set, ranges, sets, feature, "", size) {
+			return
+		}
+
+		for _, lender := range lenders {
+			if findRuleRange(old, lender).Size - size >= used[lender] + 1 && t.resizeRuleRanges(set, ranges, sets, feature, lender, size) {
+				return
+			}
+		}
+	}
+
+	panic(fmt.Errorf("the range of the feature[%s] in %s is exhausted and no other range has free numbers", feature, set))
+}
+
+// move the numbers from the lender to the feature, false if a fixed range would be moved
+func (t *VyosConfigTree) resizeRuleRanges(set string, ranges []RuleRange, sets []*VyosConfigNode, feature, lender string, size int) bool {
+	resized := make([]RuleRange, len(ranges))
+	for i, r := range ranges {
+		if r.Feature == feature {
+			r.Size += size
+		} else if r.Feature == lender {
+			r.Size -= size
+		}
+		resized[i] = r
+	}
+
+	old := layoutRuleRanges(ranges)
+	layout := layoutRuleRanges(resized)
+	for i := range old {
+		if old[i].Fixed && old[i].Start != layout[i].Start {
+			return false
+		}
+	}
+
+	log.Debugf("[Vyos Configuration] the range of the feature[%s] in %s is exhausted, grow it by %v numbers", feature, set, size)
+	for _, rules := range sets {
+		t.renumberRules(rules, old, layout)
+	}
+
+	if t.ruleRanges == nil {
+		t.ruleRanges = make(map[string][]RuleRange)
+	}
+	t.ruleRanges[set] = resized
+	// the free numbers are changed
+	t.allocators = nil
+	return true
+}
+
+// renumber the rules of each moved range from its new start, in their order
+func (t *VyosConfigTree) renumberRules(rules *VyosConfigNode, old, layout []RuleRangeLayout) {
+	type movedRule struct {
+		leaves [][]string
+		to int
+	}
+
+	path := rules.words()
+	moved := make([]movedRule, 0)
+	for i, r := range old {
+		numbers := ruleNumbersIn(rules, r)
+		if len(numbers) == 0 || (layout[i].Start == r.Start && numbers[len(numbers) - 1] <= layout[i].End) {
+			continue
+		}
+
+		for j, n := range numbers {
+			to := layout[i].Start + j
+			if to == n {
+				continue
+			}
+
+			m := movedRule{ to: to }
+			for _, l := range leafNodes(rules.getNode(strconv.Itoa(n))) {
+				m.leaves = append(m.leaves, l.words()[len(path) + 1:])
+			}
+			t.DeletePath(ruleWords(path, n)...)
+			moved = append(moved, m)
+		}
+	}
+
+	// set after all are deleted, the new numbers may be the old ones of others
+	for _, m := range moved {
+		for _, l := range m.leaves {
+			t.AddValuePath(ruleWords(path, m.to, l...)...)
+		}
+	}
+}
+
+// the feature owning each rule number in the tree, by the ranges of the rule sets
+func (t *VyosConfigTree) RuleNumberOwners() []RuleAllocation {
+	owners := make([]RuleAllocation, 0)
+	for _, set := range RULE_SETS {
+		layout := layoutRuleRanges(t.ruleRangesOf(set))
+		for _, rules := range t.ruleSetNodes(set) {
+			name := ""
+			if set == RULE_SET_FIREWALL {
+				name = rules.parent.name
+			}
+			for _, n := range ruleNumbers(rules) {
+				owners = append(owners, RuleAllocation{ Type: set, Name: name, Number: n, Feature: ruleOwnerOf(layout, n) })
+			}
+		}
+	}
+	return owners
+}
+
+type ruleOwnersRsp struct {
+	Ranges map[string][]RuleRangeLayout `json:"ranges"`
+	Rules []RuleAllocation `json:"rules"`
+}
+
+func ruleOwnersHandler(ctx *CommandContext) interface{} {
+	rsp := ruleOwnersRsp{ Ranges: make(map[string][]RuleRangeLayout) }
+	for _, set := range RULE_SETS {
+		rsp.Ranges[set] = RuleRangesOf(set)
+	}
+	rsp.Rules = NewParserFromShowConfiguration().Tree.RuleNumberOwners()
+	return rsp
+}
+
+func init() {
+	RegisterSyncCommandHandler(RULE_OWNERS_PATH, ruleOwnersHandler)
+}
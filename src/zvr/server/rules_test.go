@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func useTempRuleRanges(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "zvr-rules-test"); utils.PanicOnError(err)
+	oldFile, oldRanges := RULE_RANGES_FILE, ruleRanges
+	RULE_RANGES_FILE = filepath.Join(dir, "rule-ranges.json")
+	ruleRanges = &ruleRangeConfig{}
+	return func() {
+		RULE_RANGES_FILE = oldFile
+		ruleRanges = oldRanges
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRuleAllocator(t *testing.T) {
+	defer useTempRuleRanges(t)()
+
+	tree := NewParserFromConfiguration(`
+nat {
+    destination {
+        rule 1 {
+            description pf-1
+        }
+    }
+    source {
+        rule 1 {
+            description ipsec-1
+        }
+        rule 3 {
+            description ipsec-3
+        }
+        rule 1001 {
+            description EIP-1
+        }
+        rule 9999 {
+            description snat
+        }
+    }
+}
+`).Tree
+
+	// the gaps are filled first and the features don't compete for the numbers
+	n := tree.SetSnatFor(RULE_FEATURE_IPSEC, "description ipsec-2")
+	utils.Assertf(n == 2, "wrong rule number %v", n)
+	n = tree.SetSnatFor(RULE_FEATURE_IPSEC, "description ipsec-4")
+	utils.Assertf(n == 4, "wrong rule number %v", n)
+	n = tree.SetSnatFor(RULE_FEATURE_EIP, "description EIP-2")
+	utils.Assertf(n == 1002, "wrong rule number %v", n)
+	n = tree.SetSnat("description other")
+	utils.Assertf(n == 8001, "wrong rule number %v", n)
+	n = tree.SetDnatFor(RULE_FEATURE_PORT_FORWARDING, "description pf-2")
+	utils.Assertf(n == 2, "wrong rule number %v", n)
+
+	// the source rules are checked, not the destination ones
+	n = tree.SetSnatFor(RULE_FEATURE_IPSEC, "description ipsec-5")
+	utils.Assertf(n == 5, "wrong rule number %v", n)
+	n = tree.SetSnatFor(RULE_FEATURE_IPSEC, "description ipsec-6")
+	utils.Assertf(n == 6, "wrong rule number %v", n)
+
+	owners := make([]string, 0)
+	for _, o := range tree.RuleNumberOwners() {
+		owners = append(owners, fmt.Sprintf("%s %v %s", o.Type, o.Number, o.Feature))
+	}
+	expected := []string{
+		"nat destination 1 portforwarding",
+		"nat destination 2 portforwarding",
+		"nat source 1 ipsec",
+		"nat source 2 ipsec",
+		"nat source 3 ipsec",
+		"nat source 4 ipsec",
+		"nat source 5 ipsec",
+		"nat source 6 ipsec",
+		"nat source 1001 eip",
+		"nat source 1002 eip",
+		"nat source 8001 default",
+		"nat source 9999 snat",
+	}
+	utils.Assertf(strings.Join(owners, "\n") == strings.Join(expected, "\n"), "wrong owners:\n%s", strings.Join(owners, "\n"))
+}
+
+func TestRuleRangeGrowth(t *testing.T) {
+	defer useTempRuleRanges(t)()
+	SetRuleRanges(RULE_SET_NAT_DESTINATION,
+		RuleRange{ Feature: RULE_FEATURE_PORT_FORWARDING, Priority: 10, Size: 2 },
+		RuleRange{ Feature: RULE_FEATURE_EIP, Priority: 20, Size: 3 },
+		RuleRange{ Feature: RULE_FEATURE_DEFAULT, Priority: 90, Size: MAX_RULE_NUMBER - 5 },
+	)
+
+	tree := NewParserFromConfiguration(`
+nat {
+    destination {
+        rule 1 {
+            description pf-1
+        }
+        rule 2 {
+            description pf-2
+        }
+        rule 3 {
+            description EIP-1
+            translation {
+                address 10.0.0.1
+            }
+        }
+        rule 5 {
+            description EIP-2
+        }
+        rule 6 {
+            description other
+        }
+    }
+}
+`).Tree
+
+	// the range of port forwarding is doubled at the cost of the default one,
+	// the rules in between are renumbered in their order
+	n := tree.SetDnatFor(RULE_FEATURE_PORT_FORWARDING, "description pf-3")
+	utils.Assertf(n == 3, "wrong rule number %v", n)
+	expected := []string{
+		"$DELETE nat destination rule 3",
+		"$DELETE nat destination rule 5",
+		"$DELETE nat destination rule 6",
+		"$SET nat destination rule 5 description EIP-1",
+		"$SET nat destination rule 5 translation address 10.0.0.1",
+		"$SET nat destination rule 6 description EIP-2",
+		"$SET nat destination rule 8 description other",
+		"$SET nat destination rule 3 description pf-3",
+	}
+	utils.Assertf(tree.CommandsAsString() == strings.Join(expected, "\n"), "wrong commands:\n%s", tree.CommandsAsString())
+	n = tree.SetDnatFor(RULE_FEATURE_PORT_FORWARDING, "description pf-4")
+	utils.Assertf(n == 4, "wrong rule number %v", n)
+
+	// the grown ranges are saved once the tree is committed
+	utils.Assert(RuleRangesOf(RULE_SET_NAT_DESTINATION)[0].End == 2, "the ranges are changed before the commit")
+
+	defer func(u bool) { UNIT_TEST = u }(UNIT_TEST)
+	UNIT_TEST = false
+	defer useTempHistoryDir(t)()
+	_, restore := mockVyosCommit(func(commands []string) error { return nil })
+	defer restore()
+	tree.Apply(false)
+
+	ruleRanges = &ruleRangeConfig{}
+	layout := RuleRangesOf(RULE_SET_NAT_DESTINATION)
+	utils.Assertf(layout[0].End == 4 && layout[1].Start == 5 && layout[1].End == 7 && layout[2].Start == 8, "wrong ranges %v", layout)
+}
+
+func TestRuleRangeFixed(t *testing.T) {
+	defer useTempRuleRanges(t)()
+	SetRuleRanges(RULE_SET_NAT_SOURCE,
+		RuleRange{ Feature: RULE_FEATURE_IPSEC, Priority: 10, Size: 1 },
+		RuleRange{ Feature: RULE_FEATURE_DEFAULT, Priority: 90, Size: 1 },
+		RuleRange{ Feature: RULE_FEATURE_SNAT, Priority: 100, Size: 1, Fixed: true },
+	)
+
+	tree := &VyosConfigTree{}
+	tree.SetSnatFor(RULE_FEATURE_IPSEC, "description ipsec-1")
+	tree.SetSnat("description other")
+
+	// no range can lend a number without moving the fixed one
+	err := func() (err interface{}) {
+		defer func() { err = recover() }()
+		tree.SetSnatFor(RULE_FEATURE_IPSEC, "description ipsec-2")
+		return nil
+	}()
+	utils.Assertf(err != nil && strings.Contains(fmt.Sprintf("%v", err), "exhausted"), "the range should be exhausted, %v", err)
+	utils.Assert(tree.Has("nat source rule 2 description other") && !tree.Has("nat source rule 3"), "the rules should not be moved")
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"net/http"
 	"fmt"
 	"zvr/utils"
@@ -8,13 +10,13 @@ import (
 	"encoding/json"
 	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
-	"bytes"
-	"io/ioutil"
 )
 
 type commandHandlerWrap struct {
 	path string
 	handler http.HandlerFunc
+	// the plugin handler, /batch runs it directly
+	chandler CommandHandler
 	async bool
 }
 
@@ -24,27 +26,105 @@ type Options struct {
 	ReadTimeout  uint
 	WriteTimeout uint
 	LogFile      string
+
+	// the server runs HTTPS if the certificate is set, and
+	// requires client certificates if the client CA is set
+	TlsCertFile     string
+	TlsKeyFile      string
+	TlsClientCaFile string
+
+	// TLS options to send async replies to the mgmt server
+	CallbackCaFile   string
+	CallbackCertFile string
+	CallbackKeyFile  string
+
+	// the number of async commands running at the same time and
+	// waiting for a worker, the defaults are used if zero
+	AsyncWorkers   uint
+	AsyncQueueSize uint
+
+	// seconds the parsed running config is cached, zero disables the cache
+	ConfigCacheTTL uint
 }
 
 
 type CommandResponseHeader struct {
 	Success bool `json:"success"`
 	Error string `json:"error"`
+	ErrorCode utils.ErrorCode `json:"errorCode,omitempty"`
+	ErrorDetails map[string]interface{} `json:"errorDetails,omitempty"`
+}
+
+// the failure reply of a panic, the code is INTERNAL_ERROR
+// unless the panic carries an AgentError
+func errorResponse(err interface{}) CommandResponseHeader {
+	rsp := CommandResponseHeader{
+		Success: false,
+		Error: fmt.Sprintf("%v", err),
+		ErrorCode: utils.INTERNAL_ERROR,
+	}
+
+	switch e := err.(type) {
+	case TaskCancelledError:
+		rsp.ErrorCode = utils.TASK_CANCELLED
+	case error:
+		if ae := utils.AsAgentError(e); ae != nil {
+			rsp.ErrorCode = ae.Code
+			rsp.ErrorDetails = ae.Details
+		}
+	}
+
+	return rsp
 }
 
 type CommandContext struct {
 	responseWriter http.ResponseWriter
 	request *http.Request
+	task *Task
+
+	// the resource locks held by the command
+	locked bool
+	lockedAll bool
+	heldLocks []heldLock
+
+	// set by the header 'dryrun', see dryrun.go
+	dryRun bool
+	// the tree shared by the entries of a batch, see batch.go
+	batchTree *VyosConfigTree
+}
+
+// the uuid of the async task, empty for sync commands
+func (ctx *CommandContext) TaskUuid() string {
+	if ctx.task == nil {
+		return ""
+	}
+	return ctx.task.Uuid
+}
+
+// handlers doing long work can poll this to stop early
+// after the task is cancelled through /task/cancel
+func (ctx *CommandContext) IsCancelled() bool {
+	if ctx.task == nil {
+		return false
+	}
+	return tasks.isCancelRequested(ctx.task)
+}
+
+func (ctx *CommandContext) PanicIfCancelled() {
+	if ctx.IsCancelled() {
+		panic(TaskCancelledError{ ctx.task.Uuid })
+	}
 }
 
 func (ctx *CommandContext) GetCommand(cmd interface{}) {
 	if err := utils.JsonDecodeHttpRequest(ctx.request, cmd); err != nil {
-		panic(err)
+		panic(utils.NewAgentError(utils.INVALID_ARGUMENT, nil, "unable to decode the command, %v", err))
 	}
 }
 
 type CommandHandler func(ctx *CommandContext) interface{}
 
+// registered by RegisterHttpInterceptor and RegisterPathHttpInterceptor
 type HttpInterceptor func(http.HandlerFunc) http.HandlerFunc
 
 var (
@@ -80,6 +160,7 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 
 	w := &commandHandlerWrap{
 		path: path,
+		chandler: chandler,
 		async: async,
 	}
 
@@ -103,36 +184,50 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 	}
 
 	asyncReply := func(rsp interface{}, req *http.Request) {
-		callbackURL := req.Header.Get(CALLBACK_URL)
-		taskUuid := req.Header.Get(TASK_UUID)
-		err := utils.Retry(func() error {
-			if e := utils.HttpPostForObject(callbackURL, map[string]string{
-				TASK_UUID: taskUuid,
-				utils.HEADER_TRIGGER_URL: req.URL.String(),
-			}, rsp, nil); e != nil {
-				if he, ok := e.(utils.HttpPostError); ok {
-					if he.StatusCode() == 404 {
-						// if a 404 error, that means the mgmt server has received
-						// a previous reply or has been timeout
-						return nil
-					}
-				}
+		body, err := json.Marshal(rsp)
+		if err != nil {
+			utils.LogError(err)
+			body, _ = json.Marshal(errorResponse(fmt.Errorf("unable to marshal the reply, %v", err)))
+		}
 
-				return e
-			} else {
-				return nil
+		outbox.send(context.Background(), &outboxEntry{
+			TaskUuid: req.Header.Get(TASK_UUID),
+			CallbackURL: req.Header.Get(CALLBACK_URL),
+			TriggerURL: req.URL.String(),
+			Body: body,
+			CreateTime: time.Now(),
+		})
+	}
+
+	// a panic is counted as a failure and raised again
+	meteredHandler := func(ctx *CommandContext) interface{} {
+		start := time.Now()
+		commandRequests.Inc(path)
+		defer ctx.unlockResources()
+		defer func() {
+			commandDuration.ObserveSince(start, path)
+			if err := recover(); err != nil {
+				commandFailures.Inc(path)
+				panic(err)
 			}
-		}, 60, 1); utils.LogError(err)
+		}()
+
+		if ctx.dryRun {
+			return dryRun(ctx, chandler)
+		}
+
+		return chandler(ctx)
 	}
 
 	handler := func(w http.ResponseWriter, req *http.Request) {
 		ctx := &CommandContext{
 			responseWriter: w,
 			request: req,
+			dryRun: req.Header.Get(DRY_RUN) == "true",
 		}
 
 		if !async {
-			rsp := chandler(ctx)
+			rsp := meteredHandler(ctx)
 			if rsp == nil {
 				rsp = CommandResponseHeader{ Success: true }
 			}
@@ -141,72 +236,121 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 			return
 		}
 
-		// reply first, and the response body is ignored
-		// this is an ack that we have received the request
-		syncReply("", w, req)
+		// the agent waits for the task and its reply before shutting down
+		if !running.enter() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			utils.LogError(fmt.Fprintf(w, "the agent is shutting down, reject the request to the path[%s]", path))
+			return
+		}
 
-		// do the real work and then send the response
-		// this must be done in a go routine, otherwise it
-		// will block the preceding syncReply method
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					reply := CommandResponseHeader{
-						Success: false,
-						Error: fmt.Sprintf("%v", err),
-					}
+		task, snapshot, duplicate, err := tasks.addOrAttach(req.Header.Get(TASK_UUID), path, req)
+		if err != nil {
+			running.leave()
+			log.Warn(err.Error())
+			w.WriteHeader(http.StatusConflict)
+			utils.LogError(fmt.Fprint(w, err.Error()))
+			return
+		}
+		ctx.task = task
+
+		// the job waits for the ack below, the reply must not go
+		// to the mgmt server before the ack
+		acked := make(chan struct{})
+		if !duplicate {
+			// the result goes to the original request and the retries attached
+			replyAll := func(rsp interface{}, attached []*http.Request) {
+				asyncReply(rsp, req)
+				for _, a := range attached {
+					asyncReply(rsp, a)
+				}
+			}
+
+			// the task reported as failed on shutdown has been replied
+			finishAndReply := func(state TaskState, rsp interface{}, err string) {
+				if attached, ok := tasks.finish(task, state, rsp, err); ok {
+					replyAll(rsp, attached)
+				} else {
+					log.Warnf("the task[uuid:%s] has been reported as %s, drop the result", task.Uuid, task.State)
+				}
+			}
 
-					if e, ok := err.(error); ok {
-						log.Warnf("%+v\n", errors.Wrap(e, fmt.Sprintf("command[path:%s] failed", path)))
-					} else {
-						log.Warnf("%+v\n", errors.Wrap(errors.New(err.(string)), fmt.Sprintf("command[path:%s] failed", path)))
+			// do the real work and then send the response
+			// this must be done in a worker, otherwise it
+			// will block the preceding syncReply method
+			job := func() {
+				<-acked
+				defer running.leave()
+				defer func() {
+					if err := recover(); err != nil {
+						reply := errorResponse(err)
+
+						if e, ok := err.(error); ok {
+							log.Warnf("%+v\n", errors.Wrap(e, fmt.Sprintf("command[path:%s] failed", path)))
+						} else {
+							log.Warnf("%+v\n", errors.Wrap(fmt.Errorf("%v", err), fmt.Sprintf("command[path:%s] failed", path)))
+						}
+
+						state := TASK_FAILED
+						if _, ok := err.(TaskCancelledError); ok {
+							state = TASK_CANCELLED
+						}
+						finishAndReply(state, reply, reply.Error)
 					}
+				}()
 
+				if ok, attached, reply := tasks.start(task); !ok {
+					if reply {
+						replyAll(errorResponse(TaskCancelledError{ task.Uuid }), attached)
+					}
+					return
+				}
 
-					asyncReply(reply, req)
+				rsp := meteredHandler(ctx)
+				if rsp == nil {
+					rsp = CommandResponseHeader{Success: true }
 				}
-			}()
 
-			rsp := chandler(ctx)
-			if rsp == nil {
-				rsp = CommandResponseHeader{Success: true }
+				finishAndReply(TASK_SUCCEEDED, rsp, "")
 			}
 
-			asyncReply(rsp, req)
-		}()
-	}
-
-	w.handler = func(w http.ResponseWriter, req *http.Request) {
-		// drain the body
-		body, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			log.Warnf("unable to dump the http request[url:%v], %v", req.URL, err)
+			if !getWorkerPool().submit(task.Uuid, job) {
+				running.leave()
+				err := fmt.Sprintf("too many async commands are waiting, reject the task[uuid:%s]", task.Uuid)
+				// a retry attached in the meantime has been acked, it needs a reply
+				for _, a := range tasks.remove(task) {
+					go asyncReply(errorResponse(utils.NewAgentError(utils.AGENT_BUSY, nil, "%s", err)), a)
+				}
 
-			reply := CommandResponseHeader{
-				Success: false,
-				Error: fmt.Sprintf("%v", err),
+				log.Warn(err)
+				w.Header().Set("Retry-After", fmt.Sprintf("%v", int(ASYNC_RETRY_AFTER.Seconds())))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				utils.LogError(fmt.Fprint(w, err))
+				return
 			}
+		}
 
-			if async  {
-				asyncReply(reply, req)
+		// reply first, and the response body is ignored
+		// this is an ack that we have received the request
+		syncReply("", w, req)
+		close(acked)
+
+		if duplicate {
+			// the mgmt server retried the task, don't run it again
+			if snapshot.isDone() {
+				log.Debugf("the task[uuid:%s] has finished, send the cached result", task.Uuid)
+				go func() {
+					defer running.leave()
+					asyncReply(snapshot.Result, req)
+				}()
 			} else {
-				syncReply(reply, w, req)
+				log.Debugf("the task[uuid:%s] is still %s, the retry is attached to it", task.Uuid, snapshot.State)
+				running.leave()
 			}
-
-			return
 		}
-
-		log.WithFields(log.Fields{
-			CALLBACK_URL: req.Header.Get(CALLBACK_URL),
-			TASK_UUID: req.Header.Get(TASK_UUID),
-			"Host": req.Header.Get("Host"),
-		}).Debugf("[RECV] %v, body: %s", req.URL, string(body))
-
-		// re-fill the body
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-		handler(w, req)
 	}
 
+	w.handler = handler
+
 	log.Debugf("a command path[%s] is registered", path)
 	commandHandlers[path] = w
 }
@@ -214,7 +358,18 @@ func registerCommandHandler(path string, chandler CommandHandler, async bool) {
 
 
 func Start()  {
-	startServer()
+	// resend the replies undelivered before the agent restarted
+	outbox.start()
+
+	server := newServer()
+	shutdownDone := handleShutdownSignals(server)
+	if err := serve(server); err != http.ErrServerClosed {
+		utils.LogError(err)
+		return
+	}
+
+	// the listener is closed, wait for the running commands
+	<-shutdownDone
 }
 
 type dispatcher func(w http.ResponseWriter, req *http.Request)
@@ -223,8 +378,35 @@ func (d dispatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	d(w, req)
 }
 
+// the handler of the API the agent serves, e.g. to serve it on a test server
+func Handler() http.Handler {
+	return dispatcher(dispatch)
+}
+
 func dispatch(w http.ResponseWriter, req *http.Request) {
 	path := req.URL.Path
+
+	// not a command, it skips the request log and the command metrics
+	// but not the auth, see metricsHandler
+	if path == METRICS_PATH {
+		recoverInterceptor(authInterceptor(metricsHandler))(w, req)
+		return
+	}
+
+	intercept(path, handle)(w, req)
+}
+
+// the innermost of the interceptor chain
+func handle(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+
+	if running.isShuttingDown() {
+		log.Warnf("the agent is shutting down, reject the request to the path[%s]", path)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		utils.LogError(fmt.Fprintf(w, "the agent is shutting down, reject the request to the path[%s]", path))
+		return
+	}
+
 	wrap, ok := commandHandlers[path]
 	if !ok {
 		log.Warnf("no plugin registered the path[%s], drop it", path)
@@ -262,14 +444,48 @@ func dispatch(w http.ResponseWriter, req *http.Request) {
 	wrap.handler(w, req)
 }
 
-func startServer() {
-	server := &http.Server{
+func makeServerTlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if commandOptions.TlsClientCaFile != "" {
+		pool, err := utils.LoadCertPool(commandOptions.TlsClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+func newServer() *http.Server {
+	return &http.Server{
 		Addr: fmt.Sprintf("%v:%v", commandOptions.Ip, commandOptions.Port),
 		ReadTimeout: time.Duration(commandOptions.ReadTimeout) * time.Second,
 		WriteTimeout: time.Duration(commandOptions.WriteTimeout) * time.Second,
-		Handler: dispatcher(dispatch),
+		Handler: Handler(),
+	}
+}
+
+// block until the server fails or is shut down
+func serve(server *http.Server) error {
+	if commandOptions.TlsCertFile == "" {
+		log.Debugln("everything looks good, the agent starts ...")
+		return server.ListenAndServe()
 	}
 
-	log.Debugln("everything looks good, the agent starts ...")
-	server.ListenAndServe()
+	cfg, err := makeServerTlsConfig(); utils.PanicOnError(err)
+	server.TLSConfig = cfg
+
+	log.Debugf("everything looks good, the agent starts with TLS[client certificate required: %v] ...",
+		commandOptions.TlsClientCaFile != "")
+	return server.ListenAndServeTLS(commandOptions.TlsCertFile, commandOptions.TlsKeyFile)
+}
+
+func startServer() {
+	utils.LogError(serve(newServer()))
 }
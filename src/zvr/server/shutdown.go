@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// how long the agent waits for running commands when it's asked to stop
+	SHUTDOWN_TIMEOUT = time.Duration(60) * time.Second
+	// the part of the shutdown timeout kept for reporting the unfinished
+	// tasks, at most half of the timeout
+	SHUTDOWN_REPLY_TIMEOUT = time.Duration(5) * time.Second
+)
+
+// tracks async commands and their replies, which are not
+// covered by http.Server.Shutdown as they run in go routines
+type runningTracker struct {
+	lock sync.Mutex
+	count int
+	shuttingDown bool
+}
+
+var running = &runningTracker{}
+
+// return false if the agent is shutting down
+func (r *runningTracker) enter() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.shuttingDown {
+		return false
+	}
+
+	r.count++
+	return true
+}
+
+func (r *runningTracker) leave() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.count--
+}
+
+func (r *runningTracker) size() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.count
+}
+
+func (r *runningTracker) isShuttingDown() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.shuttingDown
+}
+
+func (r *runningTracker) setShuttingDown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.shuttingDown = true
+}
+
+// report the tasks not finished in time as failed, the replies
+// that cannot be sent before the ctx is done are kept in the outbox
+// for the next start
+func failUnfinishedTasks(ctx context.Context, reason string) {
+	for _, u := range tasks.failUnfinished(reason) {
+		body, _ := json.Marshal(u.task.Result)
+		// the callback URL and the URL of each request
+		replies := [][2]string{ { u.task.callbackURL, u.task.triggerURL } }
+		for _, a := range u.attached {
+			replies = append(replies, [2]string{ a.Header.Get(CALLBACK_URL), a.URL.String() })
+		}
+
+		for _, r := range replies {
+			log.Warnf("the task[uuid:%s, path:%s] is not finished before shutting down, report it as failed to %s",
+				u.task.Uuid, u.task.Path, r[0])
+			outbox.send(ctx, &outboxEntry{
+				TaskUuid: u.task.Uuid,
+				CallbackURL: r[0],
+				TriggerURL: r[1],
+				Body: body,
+				CreateTime: time.Now(),
+			})
+		}
+	}
+}
+
+// stop accepting requests, then wait for the running commands
+// and their replies at most the timeout
+func shutdown(server *http.Server, timeout time.Duration) {
+	log.Infof("the agent is shutting down, waiting for running commands at most %v", timeout)
+	running.setShuttingDown()
+
+	deadline := time.Now().Add(timeout)
+	replyTimeout := SHUTDOWN_REPLY_TIMEOUT
+	if replyTimeout > timeout / 2 {
+		replyTimeout = timeout / 2
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(-replyTimeout))
+	defer cancel()
+	// wait for the sync commands
+	utils.LogError(server.Shutdown(ctx))
+
+	// then the async commands, in the rest of the time
+	drainDeadline, _ := ctx.Deadline()
+	err := utils.LoopRunUntilSuccessOrTimeout(func() bool {
+		return running.size() <= 0
+	}, time.Until(drainDeadline), time.Duration(200) * time.Millisecond)
+
+	if err != nil {
+		log.Warnf("%v async commands are still running after %v", running.size(), timeout - replyTimeout)
+		// a mgmt server not answering must not hold the shutdown past the timeout
+		replyCtx, replyCancel := context.WithDeadline(context.Background(), deadline)
+		defer replyCancel()
+		failUnfinishedTasks(replyCtx, fmt.Sprintf("the agent is shut down before the task finished in %v", timeout))
+	}
+
+	log.Infof("the agent is shut down")
+}
+
+// return a channel closed after the shutdown completes
+func handleShutdownSignals(server *http.Server) chan struct{} {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-sigs
+		log.Infof("received the signal %v", sig)
+		// the init script sends SIGINT then SIGTERM, the second one is ignored
+		signal.Ignore(syscall.SIGTERM, syscall.SIGINT)
+		shutdown(server, SHUTDOWN_TIMEOUT)
+		close(done)
+	}()
+
+	return done
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zvr/utils"
+)
+
+func TestShutdownDrainsAsyncCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zvr-outbox"); utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	OUTBOX_DIR = dir
+	defer func() { running = &runningTracker{} }()
+
+	lock := &sync.Mutex{}
+	replies := make(map[string]string)
+	triggers := make(map[string]string)
+	count := make(map[string]int)
+	mgmt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		replies[req.Header.Get(TASK_UUID)] = string(body)
+		triggers[req.Header.Get(TASK_UUID)] = req.Header.Get(utils.HEADER_TRIGGER_URL)
+		count[req.Header.Get(TASK_UUID)]++
+	}))
+	defer mgmt.Close()
+
+	RegisterAsyncCommandHandler("/testshutdown/fast", func(ctx *CommandContext) interface{} {
+		time.Sleep(time.Duration(1) * time.Second)
+		return nil
+	})
+	RegisterAsyncCommandHandler("/testshutdown/slow", func(ctx *CommandContext) interface{} {
+		time.Sleep(time.Duration(5) * time.Second)
+		return nil
+	})
+
+	server := &http.Server{ Addr: "127.0.0.1:8990", Handler: dispatcher(dispatch) }
+	go server.ListenAndServe()
+	time.Sleep(time.Duration(500) * time.Millisecond)
+
+	for _, name := range []string{"fast", "slow"} {
+		_, err = utils.HttpPost(fmt.Sprintf("http://127.0.0.1:8990/testshutdown/%s?from=test", name), map[string]string{
+			CALLBACK_URL: mgmt.URL,
+			TASK_UUID: name,
+		}, nil); utils.PanicOnError(err)
+	}
+
+	// half of the time is kept for the replies, the fast one finishes in the other half
+	shutdown(server, time.Duration(3) * time.Second)
+	// the slow one finishes after it's reported as failed
+	time.Sleep(time.Duration(4) * time.Second)
+
+	lock.Lock()
+	defer lock.Unlock()
+	utils.Assert(strings.Contains(replies["fast"], `"success":true`), replies["fast"])
+	utils.Assert(strings.Contains(replies["slow"], `"success":false`), replies["slow"])
+	utils.Assertf(count["slow"] == 1, "the slow task is replied %v times", count["slow"])
+	utils.Assertf(triggers["slow"] == "/testshutdown/slow?from=test", "wrong trigger URL %s", triggers["slow"])
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, "/testshutdown/fast", nil))
+	utils.Assert(w.Code == http.StatusServiceUnavailable, fmt.Sprintf("unexpected status code %v", w.Code))
+}
+
+func TestShutdownWithHangingCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zvr-outbox"); utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	OUTBOX_DIR = dir
+	defer func() { running = &runningTracker{} }()
+
+	// the mgmt server never answers
+	hang := make(chan struct{})
+	mgmt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer mgmt.Close()
+	defer close(hang)
+
+	release := make(chan struct{})
+	RegisterAsyncCommandHandler("/testshutdown/hanging", func(ctx *CommandContext) interface{} {
+		<-release
+		return nil
+	})
+
+	server := &http.Server{ Addr: "127.0.0.1:8991", Handler: dispatcher(dispatch) }
+	go server.ListenAndServe()
+	time.Sleep(time.Duration(500) * time.Millisecond)
+
+	_, err = utils.HttpPost("http://127.0.0.1:8991/testshutdown/hanging", map[string]string{
+		CALLBACK_URL: mgmt.URL,
+		TASK_UUID: "hanging",
+	}, nil); utils.PanicOnError(err)
+
+	start := time.Now()
+	shutdown(server, time.Duration(2) * time.Second)
+	elapsed := time.Since(start)
+	utils.Assertf(elapsed < time.Duration(2500) * time.Millisecond, "the shutdown takes %v", elapsed)
+
+	// the reply not delivered is kept for the next start
+	files, err := ioutil.ReadDir(dir); utils.PanicOnError(err)
+	utils.Assertf(len(files) == 1 && strings.HasPrefix(files[0].Name(), "hanging-"), "the reply is not kept, %v", files)
+
+	// let the task finish before the outbox dir is removed
+	close(release)
+	utils.PanicOnError(utils.LoopRunUntilSuccessOrTimeout(func() bool {
+		return running.size() <= 0
+	}, time.Duration(5) * time.Second, time.Duration(100) * time.Millisecond))
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+	"zvr/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// The simulated backend keeps the running config in memory. The changes are
+// staged on a copy of it and committed as vyos does: a path with an invalid
+// word is rejected when it's set, and a commit is rejected if the config
+// breaks the rules vyos checks, e.g. a firewall rule without an action. Like
+// VyosConfigTree it knows no schema, a value set is added to the leaf and the
+// empty nodes are kept after a delete, so the running config is what the
+// committed trees have. The vyos scripts run on it are limited to the $SET
+// and $DELETE lines. The nics are the ethernet interfaces of the running
+// config, and no service runs, so the handlers change nothing out of it
+
+type SimulatedBackend struct {
+	lock sync.Mutex
+	running *VyosConfigTree
+	// the copy of the running config changed by Set and Delete, nil if nothing staged
+	staged *VyosConfigTree
+	commits int
+}
+
+func NewSimulatedBackend(config string) *SimulatedBackend {
+	return &SimulatedBackend{ running: NewParserFromConfiguration(config).Tree }
+}
+
+func (b *SimulatedBackend) ShowConfiguration() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.running.Config()
+}
+
+func (b *SimulatedBackend) ConfigRevision() string {
+	return strconv.Itoa(b.Commits())
+}
+
+// the number of commits succeeded
+func (b *SimulatedBackend) Commits() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.commits
+}
+
+func (b *SimulatedBackend) stagedLocked() *VyosConfigTree {
+	if b.staged == nil {
+		b.staged = b.running.copy()
+	}
+	return b.staged
+}
+
+func (b *SimulatedBackend) Set(words []string) error {
+	if err := checkSimulatedPath(words); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.stagedLocked().setWords(words)
+	return nil
+}
+
+// vyos complains about the path not found but the script goes on, so it's not an error
+func (b *SimulatedBackend) Delete(words []string) error {
+	if len(words) == 0 {
+		return fmt.Errorf("the path to delete is empty")
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.stagedLocked().deleteWords(words) {
+		log.Debugf("[Simulated VYOS] nothing to delete at %s", ConfigPath(words...))
+	}
+	return nil
+}
+
+func (b *SimulatedBackend) Commit(asVyosUser bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	staged := b.staged
+	b.staged = nil
+	if staged == nil {
+		return nil
+	}
+
+	if errs := checkSimulatedConfig(staged); len(errs) != 0 {
+		vyosCommitFailures.Inc()
+		return utils.NewAgentError(utils.VYOS_COMMIT_FAILED, map[string]interface{}{ "errors": errs },
+			"failed to commit the vyos configuration, %s", strings.Join(errs, "; "))
+	}
+
+	b.running = staged
+	b.commits++
+	return nil
+}
+
+func (b *SimulatedBackend) Discard() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.staged = nil
+}
+
+func (b *SimulatedBackend) Load(config string, asVyosUser bool) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = panicToError(e)
+		}
+	}()
+
+	t := NewParserFromConfiguration(config).Tree
+	if errs := checkSimulatedConfig(t); len(errs) != 0 {
+		return fmt.Errorf("unable to load the configuration, %s", strings.Join(errs, "; "))
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.running = t
+	b.staged = nil
+	b.commits++
+	return nil
+}
+
+func (b *SimulatedBackend) RunScript(script string, args map[string]string, asVyosUser bool) error {
+	if args != nil {
+		tmpl, err := template.New("script").Parse(script)
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		if err = tmpl.Execute(buf, args); err != nil {
+			return err
+		}
+		script = buf.String()
+	}
+
+	commands := make([]string, 0)
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || line == "$SAVE" {
+			continue
+		}
+		commands = append(commands, line)
+	}
+
+	return commitScriptCommands(b, commands, asVyosUser)
+}
+
+func (b *SimulatedBackend) NicNameByIp(ip string) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if name, ok := b.running.nicNameByIp(ip); ok {
+		return name, nil
+	}
+	return "", utils.NewAgentError(utils.NIC_NOT_FOUND, map[string]interface{}{ "ip": ip }, "no nic with the IP[%s] found in the simulated vyos", ip)
+}
+
+func (b *SimulatedBackend) NicNameByMac(mac string) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if name, ok := b.running.nicNameByMac(mac); ok {
+		return name, nil
+	}
+	return "", utils.NewAgentError(utils.NIC_NOT_FOUND, map[string]interface{}{ "mac": mac }, "cannot find any nic with the mac[%s] in the simulated vyos", mac)
+}
+
+func (b *SimulatedBackend) RunsServices() bool {
+	return false
+}
+
+// the word of a rule number, e.g. 'rule 10' of 'firewall name eth0.in rule 10 action accept'
+func ruleNumberWordOf(words []string) (string, bool) {
+	if len(words) > 4 && words[0] == "firewall" && words[1] == "name" && words[3] == "rule" {
+		return words[4], true
+	}
+	if len(words) > 3 && words[0] == "nat" && (words[1] == "source" || words[1] == "destination") && words[2] == "rule" {
+		return words[3], true
+	}
+	return "", false
+}
+
+func checkSimulatedPath(words []string) error {
+	if len(words) == 0 {
+		return fmt.Errorf("the path to set is empty")
+	}
+
+	for _, w := range words {
+		if w == "" {
+			return fmt.Errorf("the path[%s] has an empty word", ConfigPath(words...))
+		}
+		if strings.IndexFunc(w, unicode.IsControl) >= 0 {
+			return fmt.Errorf("the word %q has control characters", w)
+		}
+	}
+
+	if w, ok := ruleNumberWordOf(words); ok {
+		if n, err := strconv.Atoi(w); err != nil || n < 1 || n > MAX_RULE_NUMBER {
+			return fmt.Errorf("the rule number[%s] is not in 1-%v", w, MAX_RULE_NUMBER)
+		}
+	}
+
+	return nil
+}
+
+// the errors vyos reports when committing the config
+func checkSimulatedConfig(t *VyosConfigTree) []string {
+	errs := make([]string, 0)
+
+	for _, m := range t.FindAll("firewall name * rule *") {
+		if m.Node.getNode("action") == nil {
+			errs = append(errs, fmt.Sprintf("the rule[%s] has no action", m.Node.String()))
+		}
+	}
+
+	for _, set := range []string{ RULE_SET_NAT_SOURCE, RULE_SET_NAT_DESTINATION } {
+		nic := "outbound-interface"
+		if set == RULE_SET_NAT_DESTINATION {
+			nic = "inbound-interface"
+		}
+
+		for _, m := range t.FindAll(set + " rule *") {
+			if m.Node.getNode(nic) == nil {
+				errs = append(errs, fmt.Sprintf("the rule[%s] has no %s", m.Node.String(), nic))
+			}
+			if m.Node.Get("translation address") == nil && m.Node.getNode("exclude") == nil {
+				errs = append(errs, fmt.Sprintf("the rule[%s] has no translation address", m.Node.String()))
+			}
+		}
+	}
+
+	for _, m := range t.FindAll("interfaces ethernet * firewall * name") {
+		for _, name := range m.Node.Values() {
+			if t.GetPath("firewall", "name", name) == nil {
+				errs = append(errs, fmt.Sprintf("the firewall[%s] of %s doesn't exist", name, m.Node.String()))
+			}
+		}
+	}
+
+	return errs
+}
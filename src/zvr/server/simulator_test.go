@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+func useSimulatedBackend(t *testing.T, config string) (*SimulatedBackend, func()) {
+	b := NewSimulatedBackend(config)
+	old := CurrentBackend()
+	SetBackend(b)
+	return b, func() { SetBackend(old) }
+}
+
+const simulatedConfig = `interfaces {
+    ethernet eth0 {
+        address 10.0.0.1/24
+    }
+}
+`
+
+func TestSimulatedBackend(t *testing.T) {
+	b := NewSimulatedBackend(simulatedConfig)
+	rule := []string{ "firewall", "name", "eth0.in", "rule", "1" }
+	utils.PanicOnError(b.Set(append(rule, "action", "accept")))
+	utils.PanicOnError(b.Set(append(rule, "description", "with spaces")))
+	utils.Assert(!strings.Contains(b.ShowConfiguration(), "firewall"), "the staged changes are shown")
+	utils.PanicOnError(b.Commit(false))
+
+	running := NewParserFromConfiguration(b.ShowConfiguration()).Tree
+	utils.Assertf(running.Has(`firewall name eth0.in rule 1 description "with spaces"`), "the changes are not committed:\n%s", b.ShowConfiguration())
+
+	// the invalid words are rejected when set
+	utils.Assert(b.Set([]string{ "firewall", "name", "eth0.in", "rule", "0", "action", "accept" }) != nil, "the rule number 0 is set")
+	utils.Assert(b.Set([]string{ "interfaces", "ethernet", "eth0", "description", "a\nb" }) != nil, "the newline is set")
+
+	// the config is checked when committed
+	utils.PanicOnError(b.Set([]string{ "firewall", "name", "eth0.in", "rule", "2", "description", "no action" }))
+	utils.PanicOnError(b.Set([]string{ "interfaces", "ethernet", "eth0", "firewall", "in", "name", "eth0.out" }))
+	ae := utils.AsAgentError(b.Commit(false))
+	utils.Assertf(ae != nil && ae.Code == utils.VYOS_COMMIT_FAILED && len(ae.Details["errors"].([]string)) == 2, "the commit is not rejected, %v", ae)
+	utils.Assert(b.Commits() == 1 && !strings.Contains(b.ShowConfiguration(), "no action"), "the rejected changes are committed")
+
+	// deleting what doesn't exist is not an error, like vyos
+	utils.PanicOnError(b.RunScript("$DELETE firewall name eth0.in rule 1\n$DELETE firewall name eth0.in rule 3\n$SET interfaces ethernet eth0 description {{.des}}\n$SAVE",
+		map[string]string{ "des": "'lan side'" }, false))
+	running = NewParserFromConfiguration(b.ShowConfiguration()).Tree
+	utils.Assertf(running.Get("firewall name eth0.in rule 1") == nil && running.Has(`interfaces ethernet eth0 description "lan side"`),
+		"the script is not run:\n%s", b.ShowConfiguration())
+}
+
+func TestSimulatedCommits(t *testing.T) {
+	defer func(u bool) { UNIT_TEST = u }(UNIT_TEST)
+	UNIT_TEST = false
+	defer useTempHistoryDir(t)()
+	defer useTempRuleRanges(t)()
+	b, restore := useSimulatedBackend(t, simulatedConfig)
+	defer restore()
+
+	owner := RuleOwner{ Feature: RULE_FEATURE_DNS, Resource: "eth0", Version: 1 }
+	tree := NewParserFromShowConfiguration().Tree
+	tree.SetFirewallOnInterface("eth0", "local", "action accept", fmt.Sprintf("description %s", owner.Description()))
+	tree.AttachFirewallToInterface("eth0", "local")
+	tree.Apply(false)
+	utils.Assertf(NewParserFromShowConfiguration().Tree.Has("firewall name eth0.local rule 1 action accept"), "the tree is not committed:\n%s", b.ShowConfiguration())
+
+	// the rejected commit is rolled back
+	tree = NewParserFromShowConfiguration().Tree
+	tree.Set("firewall name eth0.local rule 2 description broken")
+	err := func() (err interface{}) {
+		defer func() { err = recover() }()
+		tree.Apply(false)
+		return nil
+	}()
+	utils.Assertf(err != nil && strings.Contains(fmt.Sprintf("%v", err), "has no action") && strings.Contains(fmt.Sprintf("%v", err), "rolled back"), "unexpected error %v", err)
+	utils.Assert(NewParserFromShowConfiguration().Tree.Get("firewall name eth0.local rule 2") == nil, "the broken rule is committed")
+
+	// a command through the API, the resources alive are required
+	RegisterSyncCommandHandler("/testsimulator/gc", ResourceLock(collectOrphanRulesHandler, RESOURCE_NAT, RESOURCE_FIREWALL))
+	header := CommandResponseHeader{}
+	callHistory("/testsimulator/gc", collectOrphanRulesCmd{ Feature: RULE_FEATURE_DNS }, &header)
+	utils.Assertf(!header.Success && header.ErrorCode == utils.INVALID_ARGUMENT, "wrong response %v", header)
+
+	// the preview deletes nothing
+	rsp := collectOrphanRulesRsp{}
+	callHistory("/testsimulator/gc", collectOrphanRulesCmd{ Feature: RULE_FEATURE_DNS, NoResourceAlive: true, Preview: true }, &rsp)
+	utils.Assertf(rsp.Preview && len(rsp.Deleted) == 1 && rsp.Deleted[0].Owner == owner, "wrong orphans %v", rsp.Deleted)
+	utils.Assertf(NewParserFromShowConfiguration().Tree.Has("firewall name eth0.local rule 1"), "the orphan is deleted in a preview:\n%s", b.ShowConfiguration())
+
+	// the rules of the dead resources are collected
+	rsp = collectOrphanRulesRsp{}
+	callHistory("/testsimulator/gc", collectOrphanRulesCmd{ Feature: RULE_FEATURE_DNS, NoResourceAlive: true }, &rsp)
+	utils.Assertf(!rsp.Preview && len(rsp.Deleted) == 1 && rsp.Deleted[0].Owner == owner, "wrong deleted rules %v", rsp.Deleted)
+	utils.Assertf(!NewParserFromShowConfiguration().Tree.Has("firewall name eth0.local rule 1"), "the orphan is not deleted:\n%s", b.ShowConfiguration())
+}
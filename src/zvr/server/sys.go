@@ -1,16 +1,19 @@
 package server
 
 import (
+	"regexp"
 	"strings"
 	"zvr/utils"
 	"fmt"
 	"sync"
 	"io/ioutil"
 	"os"
+	"time"
 	"github.com/Sirupsen/logrus"
 )
 
 var (
+	// serialize the vyos commits, see lock.go for the command locks
 	vyosScriptLock = &sync.Mutex{}
 )
 
@@ -41,7 +44,29 @@ func FindNicNameByMac(mac string) (string, bool) {
 	return FindNicNameByMacFromConfiguration(mac, VyosShowConfiguration())
 }
 
+// the scripts committed out of VyosConfigTree.Apply make the cached config stale
 func RunVyosScriptAsUserVyos(command string) {
+	runBackendScript(command, nil, true)
+}
+
+func RunVyosScript(command string, args map[string]string) {
+	runBackendScript(command, args, false)
+}
+
+func runBackendScript(command string, args map[string]string, asVyosUser bool) {
+	panicIfDryRun("running a vyos script")
+	defer configs.invalidate()
+
+	// not interleaved with the changes staged by a commit
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+
+	if err := CurrentBackend().RunScript(command, args, asVyosUser); err != nil {
+		panic(err)
+	}
+}
+
+func runVyosScriptAsUserVyos(command string) {
 	template := `export vyatta_sbindir=/opt/vyatta/sbin
 SET=${vyatta_sbindir}/my_set
 DELETE=${vyatta_sbindir}/my_delete
@@ -86,11 +111,17 @@ trap atexit EXIT SIGHUP SIGINT SIGTERM
 	bash := utils.Bash{
 		Command: fmt.Sprintf(`chown vyos:users %s; chmod +x %s; su - vyos -c %v`, tmpfile.Name(), tmpfile.Name(), tmpfile.Name()),
 	}
-	bash.Run()
-	bash.PanicIfError()
+	// commands run in parallel, but vyos commits one at a time
+	vyosScriptLock.Lock()
+	defer vyosScriptLock.Unlock()
+
+	start := time.Now()
+	ret, so, se, err := bash.RunWithReturn()
+	vyosCommitDuration.ObserveSince(start)
+	panicIfVyosCommitFailed(ret, so, se, err)
 }
 
-func RunVyosScript(command string, args map[string]string) {
+func runVyosScript(command string, args map[string]string) {
 	template := `export vyatta_sbindir=/opt/vyatta/sbin
 SET=${vyatta_sbindir}/my_set
 DELETE=${vyatta_sbindir}/my_delete
@@ -130,14 +161,70 @@ trap atexit EXIT SIGHUP SIGINT SIGTERM
 		NoLog: true,
 	}
 	logrus.Debugf("[Configure VYOS]: %s\n", command)
-	bash.Run()
-	bash.PanicIfError()
+	// commands run in parallel, but vyos commits one at a time
+	vyosScriptLock.Lock()
+	defer vyosScriptLock.Unlock()
+
+	start := time.Now()
+	ret, so, se, err := bash.RunWithReturn()
+	vyosCommitDuration.ObserveSince(start)
+	panicIfVyosCommitFailed(ret, so, se, err)
+}
+
+const (
+	// the tail of stderr reported, the errors of a commit are at the end
+	MAX_COMMIT_ERROR_LENGTH = 2048
+)
+
+// a secret follows the word in the vyos commands and their output, e.g. 'pre-shared-secret xxx'
+var secretPattern = regexp.MustCompile(`(?i)\b(pre-shared-secret|encrypted-password|plaintext-password|password|secret|key)(\s*[=:]\s*|\s+)('[^']*'|"[^"]*"|[^\s'"]+)`)
+
+func redactSecrets(s string) string {
+	return secretPattern.ReplaceAllString(s, "${1}${2}******")
+}
+
+// the stderr reported to the mgmt server and kept in the outbox, the
+// secrets are masked and only the tail is kept
+func commitErrorOutput(stderr string) string {
+	stderr = redactSecrets(strings.TrimSpace(stderr))
+	if len(stderr) > MAX_COMMIT_ERROR_LENGTH {
+		stderr = "..." + stderr[len(stderr)-MAX_COMMIT_ERROR_LENGTH:]
+	}
+	return stderr
 }
 
+func panicIfVyosCommitFailed(ret int, stdout, stderr string, err error) {
+	if err == nil && ret == 0 {
+		return
+	}
+
+	vyosCommitFailures.Inc()
+	// stdout echoes the commands, it's not reported
+	stderr = commitErrorOutput(stderr)
+	details := map[string]interface{}{
+		"returnCode": ret,
+		"stderr": stderr,
+	}
+
+	if err != nil {
+		panic(utils.NewAgentError(utils.VYOS_COMMIT_FAILED, details, "unable to run the vyos script, %s", redactSecrets(err.Error())))
+	}
+	panic(utils.NewAgentError(utils.VYOS_COMMIT_FAILED, details, "failed to commit the vyos configuration, return code: %v, stderr: %v", ret, stderr))
+}
+
+// lock all resources, the command runs alone
 func VyosLock(fn CommandHandler) CommandHandler {
 	return func(ctx *CommandContext) interface{} {
-		vyosScriptLock.Lock()
-		defer vyosScriptLock.Unlock()
+		if ctx.lockedAll {
+			return fn(ctx)
+		}
+
+		ctx.lockAll()
+		defer ctx.unlockAll()
+
+		// the task may be cancelled while waiting for the lock
+		ctx.PanicIfCancelled()
+
 		return fn(ctx)
 	}
 }
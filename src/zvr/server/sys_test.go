@@ -1,6 +1,7 @@
 package server
 
 import (
+	"strings"
 	"testing"
 	"zvr/utils"
 )
@@ -41,3 +42,25 @@ interfaces {
 	utils.Assert(!ok, "wrong found")
 }
 
+
+
+func TestCommitFailureRedacted(t *testing.T) {
+	stderr := strings.Repeat("noise\n", 1000) +
+		"set vpn ipsec site-to-site peer 1.1.1.1 authentication pre-shared-secret 'my secret'\n" +
+		"set system login user vyos authentication plaintext-password abc123\n" +
+		"Commit failed"
+	ae := func() (ae *utils.AgentError) {
+		defer func() { ae = utils.AsAgentError(panicToError(recover())) }()
+		panicIfVyosCommitFailed(1, "stdout with pre-shared-secret plain", stderr, nil)
+		return nil
+	}()
+
+	utils.Assertf(ae != nil && ae.Code == utils.VYOS_COMMIT_FAILED, "unexpected error %v", ae)
+	_, hasStdout := ae.Details["stdout"]
+	reported := ae.Details["stderr"].(string)
+	utils.Assert(!hasStdout, "stdout is reported")
+	utils.Assertf(len(reported) <= MAX_COMMIT_ERROR_LENGTH+3 && strings.HasSuffix(reported, "Commit failed"), "stderr is not truncated: %d", len(reported))
+	for _, s := range []string{ reported, ae.Error() } {
+		utils.Assertf(!strings.Contains(s, "my secret") && !strings.Contains(s, "abc123") && strings.Contains(s, "pre-shared-secret ******"), "the secret is not redacted: %s", s)
+	}
+}
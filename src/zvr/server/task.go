@@ -0,0 +1,332 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type TaskState string
+
+const (
+	TASK_QUEUED TaskState = "queued"
+	TASK_RUNNING TaskState = "running"
+	TASK_SUCCEEDED TaskState = "succeeded"
+	TASK_FAILED TaskState = "failed"
+	TASK_CANCELLED TaskState = "cancelled"
+
+	TASK_STATUS_PATH = "/task/status"
+	TASK_CANCEL_PATH = "/task/cancel"
+)
+
+var (
+	// how long a finished task is kept in the registry
+	TASK_RETENTION = time.Duration(1) * time.Hour
+	// the max number of finished tasks kept in the registry
+	TASK_MAX_FINISHED = 1000
+)
+
+type Task struct {
+	Uuid string `json:"uuid"`
+	Path string `json:"path"`
+	State TaskState `json:"state"`
+	QueueTime time.Time `json:"queueTime"`
+	// when a worker starts to run it, nil while it's queued
+	StartTime *time.Time `json:"startTime,omitempty"`
+	FinishTime *time.Time `json:"finishTime,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+	Error string `json:"error,omitempty"`
+	CancelRequested bool `json:"cancelRequested"`
+
+	// retries of this task from the mgmt server with a different callback URL
+	attached []*http.Request
+	callbackURL string
+	// the URL of the request, the replies go with it
+	triggerURL string
+}
+
+func (t *Task) isDone() bool {
+	return t.State == TASK_SUCCEEDED || t.State == TASK_FAILED || t.State == TASK_CANCELLED
+}
+
+// raised at a cancellation point once the task is cancelled
+type TaskCancelledError struct {
+	TaskUuid string
+}
+
+func (e TaskCancelledError) Error() string {
+	return fmt.Sprintf("task[uuid:%s] is cancelled", e.TaskUuid)
+}
+
+type taskRegistry struct {
+	lock sync.Mutex
+	tasks map[string]*Task
+}
+
+var tasks = &taskRegistry{ tasks: make(map[string]*Task) }
+
+func (r *taskRegistry) addLocked(uuid, path, callbackURL, triggerURL string) *Task {
+	r.gc()
+	t := &Task{
+		Uuid: uuid,
+		Path: path,
+		State: TASK_QUEUED,
+		QueueTime: time.Now(),
+		callbackURL: callbackURL,
+		triggerURL: triggerURL,
+	}
+	r.tasks[uuid] = t
+	return t
+}
+
+// register the task of the request. If the task uuid is known, the request
+// is a retry from the mgmt server and must not run again: the existing task
+// is returned with duplicate = true and a snapshot of it. A retry of an
+// unfinished task is attached to it and gets the reply when the task finishes
+func (r *taskRegistry) addOrAttach(uuid, path string, req *http.Request) (task *Task, snapshot Task, duplicate bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	callbackURL := req.Header.Get(CALLBACK_URL)
+	t, ok := r.tasks[uuid]
+	if !ok {
+		t = r.addLocked(uuid, path, callbackURL, req.URL.String())
+		return t, *t, false, nil
+	}
+
+	if t.Path != path {
+		return nil, Task{}, false, fmt.Errorf("the task[uuid:%s] is already used by the path[%s]", uuid, t.Path)
+	}
+
+	if !t.isDone() && callbackURL != t.callbackURL {
+		attached := false
+		for _, a := range t.attached {
+			if a.Header.Get(CALLBACK_URL) == callbackURL {
+				attached = true
+				break
+			}
+		}
+
+		if !attached {
+			t.attached = append(t.attached, req)
+		}
+	}
+
+	return t, *t, true, nil
+}
+
+// forget a task that is never run, return the retries attached
+func (r *taskRegistry) remove(t *Task) []*http.Request {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.tasks[t.Uuid] == t {
+		delete(r.tasks, t.Uuid)
+	}
+
+	attached := t.attached
+	t.attached = nil
+	return attached
+}
+
+// must be called with the lock held
+func (r *taskRegistry) gc() {
+	now := time.Now()
+	finished := make([]*Task, 0)
+	for uuid, t := range r.tasks {
+		if !t.isDone() {
+			continue
+		}
+
+		if now.Sub(*t.FinishTime) > TASK_RETENTION {
+			delete(r.tasks, uuid)
+		} else {
+			finished = append(finished, t)
+		}
+	}
+
+	// drop the oldest finished tasks if there are too many
+	for len(finished) > TASK_MAX_FINISHED {
+		oldest := 0
+		for i, t := range finished {
+			if t.FinishTime.Before(*finished[oldest].FinishTime) {
+				oldest = i
+			}
+		}
+
+		delete(r.tasks, finished[oldest].Uuid)
+		finished = append(finished[:oldest], finished[oldest+1:]...)
+	}
+}
+
+// move the task from queued to running. If it's not to run, return false with
+// the attached retries, and whether it's cancelled now and needs the reply. A
+// task reported as failed on shutdown before it runs needs no reply
+func (r *taskRegistry) start(t *Task) (bool, []*http.Request, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if t.isDone() {
+		return false, nil, false
+	}
+
+	if t.CancelRequested {
+		rsp := errorResponse(TaskCancelledError{ t.Uuid })
+		attached, _ := r.finishLocked(t, TASK_CANCELLED, rsp, rsp.Error)
+		return false, attached, true
+	}
+
+	now := time.Now()
+	t.State = TASK_RUNNING
+	t.StartTime = &now
+	return true, nil, false
+}
+
+// return the retries attached to the task, they need the result too. Return
+// false if the task was done before, e.g. reported as failed on shutdown, the
+// result is dropped and must not be replied
+func (r *taskRegistry) finish(t *Task, state TaskState, result interface{}, err string) ([]*http.Request, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.finishLocked(t, state, result, err)
+}
+
+func (r *taskRegistry) finishLocked(t *Task, state TaskState, result interface{}, err string) ([]*http.Request, bool) {
+	if t.isDone() {
+		return nil, false
+	}
+
+	now := time.Now()
+	t.State = state
+	t.Result = result
+	t.Error = err
+	t.FinishTime = &now
+
+	attached := t.attached
+	t.attached = nil
+	return attached, true
+}
+
+type unfinishedTask struct {
+	task Task
+	attached []*http.Request
+}
+
+// mark the queued and running tasks as failed, return them with the retries
+// attached. It's used when the agent cannot wait for them anymore
+func (r *taskRegistry) failUnfinished(reason string) []unfinishedTask {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ret := make([]unfinishedTask, 0)
+	for _, t := range r.tasks {
+		if t.isDone() {
+			continue
+		}
+
+		attached, _ := r.finishLocked(t, TASK_FAILED, errorResponse(reason), reason)
+		ret = append(ret, unfinishedTask{ task: *t, attached: attached })
+	}
+
+	return ret
+}
+
+func (r *taskRegistry) isCancelRequested(t *Task) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return t.CancelRequested
+}
+
+// request a cancellation. A queued task will not run; a running task
+// is stopped at the next cancellation point, e.g. before it gets the
+// vyos lock. Return false if the task has finished
+func (r *taskRegistry) cancel(uuid string) (Task, bool, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	t, ok := r.tasks[uuid]
+	if !ok {
+		return Task{}, false, false
+	}
+
+	if t.isDone() {
+		return *t, true, false
+	}
+
+	t.CancelRequested = true
+	return *t, true, true
+}
+
+func (r *taskRegistry) get(uuid string) (Task, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if t, ok := r.tasks[uuid]; ok {
+		return *t, true
+	}
+
+	return Task{}, false
+}
+
+func (r *taskRegistry) list() []Task {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ret := make([]Task, 0, len(r.tasks))
+	for _, t := range r.tasks {
+		ret = append(ret, *t)
+	}
+	return ret
+}
+
+type taskStatusCmd struct {
+	TaskUuid string `json:"taskUuid"`
+}
+
+type taskStatusRsp struct {
+	Tasks []Task `json:"tasks"`
+}
+
+type cancelTaskCmd struct {
+	TaskUuid string `json:"taskUuid"`
+}
+
+type cancelTaskRsp struct {
+	Found bool `json:"found"`
+	Cancelled bool `json:"cancelled"`
+	Task *Task `json:"task,omitempty"`
+}
+
+// return the task of the uuid, or all tasks if the uuid is empty
+func taskStatusHandler(ctx *CommandContext) interface{} {
+	cmd := &taskStatusCmd{}
+	ctx.GetCommand(cmd)
+
+	if cmd.TaskUuid == "" {
+		return taskStatusRsp{ Tasks: tasks.list() }
+	}
+
+	if t, ok := tasks.get(cmd.TaskUuid); ok {
+		return taskStatusRsp{ Tasks: []Task{ t } }
+	}
+
+	return taskStatusRsp{ Tasks: []Task{} }
+}
+
+func cancelTaskHandler(ctx *CommandContext) interface{} {
+	cmd := &cancelTaskCmd{}
+	ctx.GetCommand(cmd)
+
+	t, found, cancelled := tasks.cancel(cmd.TaskUuid)
+	rsp := cancelTaskRsp{ Found: found, Cancelled: cancelled }
+	if found {
+		rsp.Task = &t
+	}
+	return rsp
+}
+
+func init() {
+	RegisterSyncCommandHandler(TASK_STATUS_PATH, taskStatusHandler)
+	RegisterSyncCommandHandler(TASK_CANCEL_PATH, cancelTaskHandler)
+}
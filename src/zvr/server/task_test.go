@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"zvr/utils"
+)
+
+func newTaskRequest(callbackURL string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/test", nil)
+	req.Header.Set(CALLBACK_URL, callbackURL)
+	return req
+}
+
+// register a new task as a request does
+func addTask(r *taskRegistry, uuid string) *Task {
+	task, _, duplicate, err := r.addOrAttach(uuid, "/test", newTaskRequest(""))
+	utils.PanicOnError(err)
+	utils.Assertf(!duplicate, "the task[%s] is a duplicate", uuid)
+	return task
+}
+
+func TestTaskRegistry(t *testing.T) {
+	r := &taskRegistry{ tasks: make(map[string]*Task) }
+
+	task := addTask(r, "task1")
+	utils.Assert(task.State == TASK_QUEUED, string(task.State))
+	utils.Assert(!task.QueueTime.IsZero() && task.StartTime == nil, "a queued task has no start time")
+	ok, _, _ := r.start(task)
+	utils.Assert(ok, "task1 should start")
+	utils.Assert(task.State == TASK_RUNNING, string(task.State))
+	utils.Assert(task.StartTime != nil && !task.StartTime.Before(task.QueueTime), "the start time is not set when it runs")
+
+	r.finish(task, TASK_SUCCEEDED, "hello", "")
+	tt, ok := r.get("task1")
+	utils.Assert(ok, "task1 not found")
+	utils.Assert(tt.State == TASK_SUCCEEDED, string(tt.State))
+	utils.Assert(tt.Result.(string) == "hello", "wrong result")
+
+	// a finished task cannot be cancelled
+	_, found, cancelled := r.cancel("task1")
+	utils.Assert(found && !cancelled, "task1 should not be cancelled")
+
+	// a queued task never runs once cancelled
+	task = addTask(r, "task2")
+	_, found, cancelled = r.cancel("task2")
+	utils.Assert(found && cancelled, "task2 should be cancelled")
+	ok, _, reply := r.start(task)
+	utils.Assert(!ok && reply, "task2 should not start")
+	utils.Assert(task.State == TASK_CANCELLED, string(task.State))
+	utils.Assert(task.StartTime == nil, "task2 never runs but has a start time")
+
+	// a task reported as failed on shutdown is not run or replied again
+	task = addTask(r, "task4")
+	utils.Assert(len(r.failUnfinished("shutdown")) == 1, "task4 should be failed")
+	ok, _, reply = r.start(task)
+	utils.Assert(!ok && !reply, "task4 should not start")
+	_, ok = r.finish(task, TASK_SUCCEEDED, "hello", "")
+	utils.Assert(!ok && task.State == TASK_FAILED, "task4 should not be finished again")
+
+	_, found, _ = r.cancel("task3")
+	utils.Assert(!found, "task3 should not be found")
+	utils.Assert(len(r.list()) == 3, "there should be three tasks")
+}
+
+func TestTaskRegistryGC(t *testing.T) {
+	r := &taskRegistry{ tasks: make(map[string]*Task) }
+	max := TASK_MAX_FINISHED
+	TASK_MAX_FINISHED = 2
+	defer func() { TASK_MAX_FINISHED = max }()
+
+	for i, uuid := range []string{"a", "b", "c"} {
+		task := addTask(r, uuid)
+		r.finish(task, TASK_FAILED, nil, "on purpose")
+		finishTime := task.FinishTime.Add(time.Duration(i) * time.Second)
+		task.FinishTime = &finishTime
+	}
+	addTask(r, "d")
+
+	_, ok := r.get("a")
+	utils.Assert(!ok, "the oldest finished task should be dropped")
+	_, ok = r.get("d")
+	utils.Assert(ok, "a queued task should never be dropped")
+}
+
+func TestAttachRetryToTask(t *testing.T) {
+	r := &taskRegistry{ tasks: make(map[string]*Task) }
+
+	task, _, duplicate, err := r.addOrAttach("task1", "/test", newTaskRequest("http://a"))
+	utils.Assert(!duplicate && err == nil, "task1 is new")
+
+	// retries with the same callback URL get the reply of the task
+	_, _, duplicate, err = r.addOrAttach("task1", "/test", newTaskRequest("http://a"))
+	utils.Assert(duplicate && err == nil, "task1 is a duplicate")
+	_, _, _, _ = r.addOrAttach("task1", "/test", newTaskRequest("http://b"))
+	_, _, _, _ = r.addOrAttach("task1", "/test", newTaskRequest("http://b"))
+	_, _, _, err = r.addOrAttach("task1", "/other", newTaskRequest("http://a"))
+	utils.Assert(err != nil, "task1 cannot be used by another path")
+
+	attached, ok := r.finish(task, TASK_SUCCEEDED, "hello", "")
+	utils.Assert(ok && len(attached) == 1, fmt.Sprintf("%v", attached))
+	utils.Assert(attached[0].Header.Get(CALLBACK_URL) == "http://b", "wrong callback URL")
+
+	_, snapshot, duplicate, _ := r.addOrAttach("task1", "/test", newTaskRequest("http://c"))
+	utils.Assert(duplicate && snapshot.isDone(), "task1 has finished")
+	utils.Assert(snapshot.Result.(string) == "hello", "wrong cached result")
+}
+
+func TestIdempotentAsyncCommand(t *testing.T) {
+	startMockServer()
+
+	dir, err := ioutil.TempDir("", "zvr-outbox"); utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	OUTBOX_DIR = dir
+
+	lock := &sync.Mutex{}
+	replies := 0
+	mgmt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		replies++
+	}))
+	defer mgmt.Close()
+
+	runs := 0
+	path := "/testidempotent"
+	RegisterAsyncCommandHandler(path, func(ctx *CommandContext) interface{} {
+		lock.Lock()
+		runs++
+		lock.Unlock()
+		time.Sleep(time.Duration(1) * time.Second)
+		return nil
+	})
+
+	headers := map[string]string{
+		CALLBACK_URL: mgmt.URL,
+		TASK_UUID: "idempotent-task",
+	}
+
+	// the retry comes when the task is running
+	utils.HttpPost(makeURL(path), headers, nil)
+	utils.HttpPost(makeURL(path), headers, nil)
+	time.Sleep(time.Duration(2) * time.Second)
+
+	// the retry comes after the task finished
+	utils.HttpPost(makeURL(path), headers, nil)
+	time.Sleep(time.Duration(1) * time.Second)
+
+	lock.Lock()
+	defer lock.Unlock()
+	utils.Assert(runs == 1, fmt.Sprintf("the handler runs %v times", runs))
+	utils.Assert(replies == 2, fmt.Sprintf("the mgmt server receives %v replies", replies))
+}
@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"strings"
-	"bufio"
+	"sync"
 	"github.com/pkg/errors"
 	"fmt"
 	"zvr/utils"
@@ -14,52 +17,14 @@ type VyosParser struct {
 	Tree   *VyosConfigTree
 }
 
-type role int
-const (
-	ROOT role = iota
-	ROOT_ATTRIBUTE
-	KEY_VALUE
-	CLOSE
-	IGNORE
-	VALUE
-)
-
 var (
 	UNIT_TEST = false
-)
-
-func matchToken(words []string) (int, role, []string, string) {
-	ws := make([]string, 0)
-	next := 0
-
-	// find until \n
-	for next = 0; next < len(words); next++ {
-		w := words[next]
-		if w == "\n" {
-			break
-		}
-
-		ws = append(ws, w)
-	}
-
-	length := len(ws)
-	if length == 2 && ws[length-1] == "{" {
-		return next, ROOT, []string{ws[0]}, ""
-	} else if  length > 2 && ws[length-1] == "{" {
-		return next, ROOT_ATTRIBUTE, ws[:length-1], ""
-	} else if length >= 2 && ws[length-1] != "{" && ws[length-1] != "}" {
-		return next, KEY_VALUE, []string{ws[0]}, strings.Join(ws[1:], " ")
-	} else if length == 1 && ws[0] == "}" {
-		return next, CLOSE, nil, ""
-	} else if length == 1 && ws[0] != "{" && ws[0] != "}" {
-		return next, VALUE, nil, ws[0]
-	} else if length == 0 {
-		return next+1, IGNORE, nil, ""
-	} else {
-		panic(errors.New(fmt.Sprintf("unable to parser the words: %s", strings.Join(words, " "))))
-	}
-}
+	// the templates of the vyos config nodes
+	VYOS_TEMPLATE_DIR = "/opt/vyatta/share/vyatta-cfg/templates"
 
+	// the template paths checked by isVyosTagNode
+	vyosTagTemplates = &sync.Map{}
+)
 
 func (parser *VyosParser) GetValue(key string) (string, bool) {
 	if c := parser.Tree.Get(key); c == nil {
@@ -69,79 +34,139 @@ func (parser *VyosParser) GetValue(key string) (string, bool) {
 	}
 }
 
+// the tokens of the config are parsed line by line, a line is one of
+//   key {              a block
+//   key tag {          a tag node, e.g. 'ethernet eth0 {'
+//   key value          a leaf, repeated for the values of a multi-value leaf
+//   key                a leaf without value
+//   }
+// a comment is kept with the node after it
 func (parser *VyosParser) Parse(text string) *VyosConfigTree {
 	parser.parsed = true
 
-	words := make([]string, 0)
-	for _, s := range strings.Split(text, "\n") {
-		scanner := bufio.NewScanner(strings.NewReader(s))
-		scanner.Split(bufio.ScanWords)
-		ws := make([]string, 0)
-		for scanner.Scan() {
-			ws = append(ws, scanner.Text())
-		}
-		ws = append(ws, "\n")
-		words = append(words, ws...)
-	}
-
-	offset := 0
 	tree := &VyosConfigTree{ Root: &VyosConfigNode{} }
 	tree.Root.tree = tree
 	tstack := &utils.Stack{}
 
 	currentNode := tree.Root
-	for i := 0; i < len(words); i += offset {
-		o, role, keys, value := matchToken(words[i:])
-		offset = o
-		if role == ROOT {
-			tstack.Push(currentNode)
-			currentNode = currentNode.addNode(keys[0])
-		} else if role == KEY_VALUE {
-			currentNode.addNode(keys[0]).addNode(value)
-		} else if role == VALUE {
-			currentNode.addNode(value)
-		} else if role == ROOT_ATTRIBUTE {
-			tstack.Push(currentNode)
+	comments := make([]string, 0)
+	line := make([]vyosToken, 0)
 
-			for _, key := range keys {
-				if n := currentNode.getNode(key); n == nil {
-					currentNode = currentNode.addNode(key)
-				} else {
-					currentNode = n
-				}
+	parseLine := func() {
+		if len(line) == 0 {
+			return
+		}
+
+		last := line[len(line) - 1]
+		words := line
+		if last.kind == TOKEN_OPEN || last.kind == TOKEN_CLOSE {
+			words = line[:len(line) - 1]
+		}
+		for _, w := range words {
+			if w.kind != TOKEN_WORD {
+				panic(errors.New(fmt.Sprintf("unable to parser the line: %s", tokensToString(line))))
+			}
+		}
+
+		// the node the comments before the line belong to
+		var commented *VyosConfigNode
+		if last.kind == TOKEN_CLOSE {
+			if len(words) != 0 || tstack.Len() == 0 {
+				panic(errors.New(fmt.Sprintf("unable to parser the line: %s", tokensToString(line))))
 			}
-		} else if role == CLOSE {
 			currentNode = tstack.Pop().(*VyosConfigNode)
+		} else if last.kind == TOKEN_OPEN {
+			if len(words) == 0 {
+				panic(errors.New(fmt.Sprintf("unable to parser the line: %s", tokensToString(line))))
+			}
+			tstack.Push(currentNode)
+			for i, w := range words {
+				currentNode = currentNode.addWord(w)
+				if i == 0 && len(words) == 2 {
+					currentNode.tag = true
+				}
+			}
+			currentNode.block = true
+			commented = currentNode
+		} else if len(words) == 1 {
+			commented = currentNode.addWord(words[0])
+		} else {
+			key := currentNode.addWord(words[0])
+			value := words[1]
+			if len(words) > 2 {
+				// an unquoted value with spaces
+				ws := make([]string, 0)
+				for _, w := range words[1:] {
+					ws = append(ws, w.text)
+				}
+				value = vyosToken{ kind: TOKEN_WORD, text: strings.Join(ws, " ") }
+			}
+			commented = key.addWord(value)
 		}
+
+		if commented != nil && len(comments) != 0 {
+			commented.comments = append(commented.comments, comments...)
+			comments = comments[:0]
+		}
+		line = line[:0]
 	}
 
-	//txt, _ := json.Marshal(parser.data)
-	//fmt.Println(string(txt))
+	for _, t := range tokenizeVyosConfig(text) {
+		if t.kind == TOKEN_NEWLINE {
+			parseLine()
+		} else if t.kind == TOKEN_COMMENT {
+			comments = append(comments, t.text)
+		} else {
+			line = append(line, t)
+			if t.kind == TOKEN_OPEN || t.kind == TOKEN_CLOSE {
+				parseLine()
+			}
+		}
+	}
+	parseLine()
+	tree.comments = comments
 
-	//fmt.Println(tree.String())
 	parser.Tree = tree
 	return tree
 }
 
-var ConfigurationSourceFunc = func() string {
-	bash := utils.Bash{
-		Command: "/bin/cli-shell-api showCfg",
-		NoLog: true,
+func tokensToString(tokens []vyosToken) string {
+	ss := make([]string, 0)
+	for _, t := range tokens {
+		if t.kind == TOKEN_WORD {
+			ss = append(ss, quoteConfigWord(t.text, t.quoted))
+		} else {
+			ss = append(ss, t.text)
+		}
 	}
+	return strings.Join(ss, " ")
+}
 
-	_, o, _, _ := bash.RunWithReturn()
-	bash.PanicIfError()
-	return o
+// the running config, it's replaced in unit tests
+var ConfigurationSourceFunc = func() string {
+	return CurrentBackend().ShowConfiguration()
 }
 
 func VyosShowConfiguration() string {
 	return ConfigurationSourceFunc()
 }
 
+// a private clone of the cached config, see cache.go
 func NewParserFromShowConfiguration() *VyosParser {
-	p := &VyosParser{}
-	p.Parse(ConfigurationSourceFunc())
-	return p
+	return &VyosParser{ parsed: true, Tree: configs.clone() }
+}
+
+// the running config to be changed by the command, the commit of the
+// tree is archived with the command, see history.go. The commands of a
+// batch share the tree of the batch, which is archived with the batch
+func (ctx *CommandContext) ConfigTree() *VyosConfigTree {
+	if ctx.batchTree != nil {
+		return ctx.batchTree
+	}
+
+	t := NewParserFromShowConfiguration().Tree
+	t.trigger = ctx.trigger()
+	return t
 }
 
 func NewParserFromConfiguration(text string) *VyosParser {
@@ -156,13 +181,52 @@ type VyosConfigNode struct {
 	childrenIndex map[string]*VyosConfigNode
 	parent        *VyosConfigNode
 	tree *VyosConfigTree
+
+	// how the node is printed, see VyosConfigTree.Config
+	quoted bool
+	tag bool
+	block bool
+	comments []string
 }
 
 
 func (n *VyosConfigNode) Children() []*VyosConfigNode {
+	for i, c := range n.children {
+		if c.tree != n.tree {
+			n.children[i] = n.adopt(c)
+		}
+	}
 	return n.children
 }
 
+// the nodes of a tree cloned from the cache are shared with the cached tree
+// until they are reached from the clone. A shared node is copied into the
+// clone then, so the nodes the clone returns and changes are its own ones
+func (n *VyosConfigNode) adopt(c *VyosConfigNode) *VyosConfigNode {
+	cp := &VyosConfigNode{
+		name: c.name,
+		parent: n,
+		tree: n.tree,
+		quoted: c.quoted,
+		tag: c.tag,
+		block: c.block,
+		comments: c.comments,
+	}
+	if c.children != nil {
+		cp.children = make([]*VyosConfigNode, len(c.children))
+		copy(cp.children, c.children)
+	}
+	if c.childrenIndex != nil {
+		cp.childrenIndex = make(map[string]*VyosConfigNode, len(c.childrenIndex))
+		for k, v := range c.childrenIndex {
+			cp.childrenIndex[k] = v
+		}
+	}
+
+	n.childrenIndex[c.name] = cp
+	return cp
+}
+
 func (n *VyosConfigNode) ChildNodeKeys() []string {
 	keys := make([]string, 0)
 	for k := range n.childrenIndex {
@@ -186,11 +250,26 @@ func (n *VyosConfigNode) String() string {
 			}()
 		}
 
-		stack.Push(p.name)
+		if p.parent != nil {
+			stack.Push(quoteConfigWord(p.name, p.quoted))
+		}
 		p = p.parent
 	}
 }
 
+// the words of the path from the root
+func (n *VyosConfigNode) words() []string {
+	words := make([]string, 0)
+	for p := n; p != nil && p.parent != nil; p = p.parent {
+		words = append([]string{ p.name }, words...)
+	}
+	return words
+}
+
+func (n *VyosConfigNode) Parent() *VyosConfigNode {
+	return n.parent
+}
+
 func (n *VyosConfigNode) isValueNode() bool {
 	return n.childrenIndex == nil && n.children == nil
 }
@@ -218,6 +297,11 @@ func (n *VyosConfigNode) ValueSize() int {
 	return len(n.Values())
 }
 
+func (n *VyosConfigNode) HasValue(value string) bool {
+	c := n.childrenIndex[value]
+	return c != nil && c.isValueNode()
+}
+
 func (n *VyosConfigNode) Value() string {
 	values := n.Values()
 	utils.Assert(len(values) != 0, fmt.Sprintf("the node[%s] doesn't have any value", n.String()))
@@ -258,11 +342,10 @@ func (n *VyosConfigNode) Getf(f string, args...interface{}) *VyosConfigNode {
 }
 
 func (n *VyosConfigNode) Get(config string) *VyosConfigNode {
-	cs := strings.Split(config, " ")
 	current := n
 
-	for _, c := range cs {
-		current = current.getNode(c)
+	for _, c := range splitConfigPath(config) {
+		current = current.getNode(c.text)
 		if current == nil {
 			return nil
 		}
@@ -272,11 +355,44 @@ func (n *VyosConfigNode) Get(config string) *VyosConfigNode {
 }
 
 func (n *VyosConfigNode) getNode(name string) *VyosConfigNode {
-	return n.childrenIndex[name]
+	c := n.childrenIndex[name]
+	if c == nil || c.tree == n.tree {
+		return c
+	}
+
+	cp := n.adopt(c)
+	for i, cc := range n.children {
+		if cc == c {
+			n.children[i] = cp
+			break
+		}
+	}
+	return cp
+}
+
+func (n *VyosConfigNode) addWord(w vyosToken) *VyosConfigNode {
+	c := n.addNode(w.text)
+	c.quoted = c.quoted || w.quoted
+	return c
+}
+
+// the tag nodes of a parsed config are known by their lines, a node added
+// is recorded as a tag node by the vyos templates, so it's printed as
+// 'key tag {' like showCfg does
+func (n *VyosConfigNode) addPath(words []vyosToken) *VyosConfigNode {
+	current := n
+	for _, w := range words {
+		added := current.getNode(w.text) == nil
+		current = current.addWord(w)
+		if added {
+			current.tag = isVyosTagNode(current)
+		}
+	}
+	return current
 }
 
 func (n *VyosConfigNode) addNode(name string) *VyosConfigNode {
-	if c, ok := n.childrenIndex[name]; ok {
+	if c := n.getNode(name); c != nil {
 		return c
 	}
 
@@ -303,6 +419,85 @@ func (n *VyosConfigNode) addNode(name string) *VyosConfigNode {
 type VyosConfigTree struct {
 	Root *VyosConfigNode
 	changeCommands []string
+	// the rule numbers allocated by SetFirewallOnInterface, SetDnat and SetSnat
+	allocatedRules []RuleAllocation
+	// the allocators of the rule sets and the ranges grown, see rules.go
+	allocators map[string]*ruleAllocator
+	ruleRanges map[string][]RuleRange
+	// the generation of the cache the tree is cloned from, zero if not a clone
+	generation uint64
+	// the comments at the end of the config
+	comments []string
+	// the command changing the tree, archived with the commit
+	trigger CommandTrigger
+	// the tree of a running batch, committed when the batch ends, see batch.go
+	inBatch bool
+}
+
+// a tree sharing the nodes with this one until they are reached, this
+// tree must not be changed any more
+func (t *VyosConfigTree) clone() *VyosConfigTree {
+	c := &VyosConfigTree{}
+	c.init()
+	for _, n := range t.Root.children {
+		c.Root.children = append(c.Root.children, n)
+		c.Root.childrenIndex[n.name] = n
+	}
+	return c
+}
+
+// a tree with the copies of all nodes of this one
+func (t *VyosConfigTree) copy() *VyosConfigTree {
+	c := &VyosConfigTree{}
+	c.init()
+	for _, n := range t.Root.children {
+		copyConfigNode(c.Root, n)
+	}
+	return c
+}
+
+// replay the $SET and $DELETE lines made by the trees, the tree is
+// then the config vyos has after committing them
+func (t *VyosConfigTree) applyScriptCommands(commands []string) error {
+	t.init()
+	for _, c := range commands {
+		op, words, err := parseScriptCommand(c)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case "$SET":
+			t.setWords(words)
+		case "$DELETE":
+			t.deleteWords(words)
+		default:
+			return fmt.Errorf("unsupported command %s", op)
+		}
+	}
+	return nil
+}
+
+// like vyos, the value set is added to the leaf, no change is recorded
+func (t *VyosConfigTree) setWords(words []string) {
+	tokens := make([]vyosToken, len(words))
+	for i, w := range words {
+		tokens[i] = vyosToken{ kind: TOKEN_WORD, text: w }
+	}
+	t.Root.addPath(tokens)
+}
+
+func (t *VyosConfigTree) deleteWords(words []string) bool {
+	if len(words) == 0 {
+		return false
+	}
+
+	n := t.GetPath(words...)
+	if n == nil {
+		return false
+	}
+	n.deleteSelf()
+	return true
 }
 
 func (t *VyosConfigTree) HasChanges() bool {
@@ -310,6 +505,14 @@ func (t *VyosConfigTree) HasChanges() bool {
 }
 
 func (t *VyosConfigTree) Apply(asVyosUser bool) {
+	if t.inBatch {
+		return
+	}
+
+	if recordDryRun(t) {
+		return
+	}
+
 	if (UNIT_TEST) {
 		fmt.Println(strings.Join(t.changeCommands, "\n"))
 		return
@@ -320,10 +523,9 @@ func (t *VyosConfigTree) Apply(asVyosUser bool) {
 		return
 	}
 
-	if asVyosUser {
-		RunVyosScriptAsUserVyos(strings.Join(t.changeCommands, "\n"))
-	} else {
-		RunVyosScript(strings.Join(t.changeCommands, "\n"), nil)
+	// merged with the changes of other commands, see commit.go
+	if err := commits.commitTree(t, asVyosUser); err != nil {
+		panic(err)
 	}
 }
 
@@ -340,14 +542,14 @@ func (t *VyosConfigTree) init() {
 	}
 }
 
-func (t *VyosConfigTree) has(config...string) bool {
+func (t *VyosConfigTree) Has(config string) bool {
 	if t.Root == nil || t.Root.children == nil {
 		return false
 	}
 
 	current := t.Root
-	for _, c := range config {
-		current = current.childrenIndex[c]
+	for _, c := range splitConfigPath(config) {
+		current = current.childrenIndex[c.text]
 		if current == nil {
 			return false
 		}
@@ -356,106 +558,92 @@ func (t *VyosConfigTree) has(config...string) bool {
 	return true
 }
 
-func (t *VyosConfigTree) Has(config string) bool {
-	return t.has(strings.Split(config, " ")...)
-}
-
+// it changes the interface, the command locks the InterfaceFirewallResource
 func (t *VyosConfigTree) AttachFirewallToInterface(ethname, direction string) {
-	t.Setf("interfaces ethernet %v firewall %s name %v.%v", ethname, direction, ethname, direction)
+	t.SetPath("interfaces", "ethernet", ethname, "firewall", direction, "name", ethname + "." + direction)
 }
 
 func (t *VyosConfigTree) FindFirewallRuleByDescription(ethname, direction, des string) *VyosConfigNode {
-	rs := t.Getf("firewall name %v.%v rule", ethname, direction)
-
-	if rs == nil {
-		return nil
-	}
-
-	for _, r := range rs.children {
-		if d := r.Get("description"); d != nil && d.Value() == des {
-			return r
-		}
+	if d := t.FindFirst(fmt.Sprintf("firewall name %v.%v rule * description", ethname, direction), Equals(des)); d != nil {
+		return d.Parent()
 	}
 
 	return nil
 }
 
+// the rules under the path, e.g. "nat destination rule", with the description matched
+func (t *VyosConfigTree) FindRulesByDescription(path string, match func(des string) bool) []*VyosConfigNode {
+	return parentsOf(t.FindAll(path + " * description", ValueMatches(match)))
+}
+
+// the rules of all firewalls with the description matched
+func (t *VyosConfigTree) FindFirewallRulesByDescription(match func(des string) bool) []*VyosConfigNode {
+	return parentsOf(t.FindAll("firewall name * rule * description", ValueMatches(match)))
+}
+
+func parentsOf(matches []ConfigQueryMatch) []*VyosConfigNode {
+	nodes := make([]*VyosConfigNode, 0, len(matches))
+	for _, m := range matches {
+		nodes = append(nodes, m.Node.Parent())
+	}
+	return nodes
+}
+
 func (t *VyosConfigTree) SetFirewallDefaultAction(ethname, direction, action string) {
 	utils.Assertf(action == "drop" || action == "reject" || action == "accept", "action must be drop or reject or accept, but %s got", action)
-	t.Setf("firewall name %s.%s default-action %v", ethname, direction, action)
+	t.SetPath("firewall", "name", ethname + "." + direction, "default-action", action)
 }
 
 func (t *VyosConfigTree) SetFirewallOnInterface(ethname, direction string, rules...string) int {
+	return t.SetFirewallOnInterfaceFor(RULE_FEATURE_DEFAULT, ethname, direction, rules...)
+}
+
+// the rule number is allocated in the range of the feature, see rules.go
+func (t *VyosConfigTree) SetFirewallOnInterfaceFor(feature, ethname, direction string, rules...string) int {
 	if direction != "in" && direction != "out" && direction != "local" {
 		panic(fmt.Sprintf("the direction can only be [in, out, local], but %s get", direction))
 	}
 
-	currentRuleNum := -1
-	for i:=1; i<=9999; i++ {
-		if c := t.Getf("firewall name %s.%s rule %v", ethname, direction, i); c == nil {
-			currentRuleNum = i
-			break
-		}
-	}
-
-	if currentRuleNum == -1 {
-		panic(fmt.Sprintf("No firewall rule number found for the interface %s.%s. You have set more than 9999 rules???", ethname, direction))
-	}
+	name := fmt.Sprintf("%v.%v", ethname, direction)
+	path := []string{ "firewall", "name", name, "rule" }
+	currentRuleNum := t.allocateRule(RULE_SET_FIREWALL, path, feature)
 
+	// the rules are paths made by ConfigPath
+	prefix := ConfigPath(ruleWords(path, currentRuleNum)...)
 	for _, rule := range rules {
-		t.Setf("firewall name %v.%v rule %v %s", ethname, direction, currentRuleNum, rule)
+		t.Set(prefix + " " + rule)
 	}
+	t.allocatedRules = append(t.allocatedRules, RuleAllocation{ Type: RULE_SET_FIREWALL, Name: name, Number: currentRuleNum, Feature: feature })
 
 	return currentRuleNum
 }
 
 func (t *VyosConfigTree) SetDnat(rules...string) int {
-	currentRuleNum := -1
-
-	for i:=1; i<=9999; i ++ {
-		if c := t.Getf("nat destination rule %v", i); c == nil {
-			currentRuleNum = i
-			break
-		}
-	}
+	return t.SetDnatFor(RULE_FEATURE_DEFAULT, rules...)
+}
 
-	if currentRuleNum == -1 {
-		panic("No rule number avaible for dnat. You have set more than 9999 rules???")
-	}
+func (t *VyosConfigTree) SetDnatFor(feature string, rules...string) int {
+	currentRuleNum := t.allocateRule(RULE_SET_NAT_DESTINATION, []string{ "nat", "destination", "rule" }, feature)
 
 	for _, rule := range rules {
 		t.Setf("nat destination rule %v %s", currentRuleNum, rule)
 	}
+	t.allocatedRules = append(t.allocatedRules, RuleAllocation{ Type: RULE_SET_NAT_DESTINATION, Number: currentRuleNum, Feature: feature })
 
 	return currentRuleNum
 }
 
 func (t *VyosConfigTree) FindDnatRuleDescription(des string) *VyosConfigNode {
-	rs := t.Get("nat destination rule")
-	if rs == nil {
-		return nil
-	}
-
-	for _, r := range rs.children {
-		if d := r.Get("description"); d != nil && d.Value() == des {
-			return r
-		}
+	if d := t.FindFirst("nat destination rule * description", Equals(des)); d != nil {
+		return d.Parent()
 	}
 
 	return nil
 }
 
 func (t *VyosConfigTree) FindSnatRuleDescription(des string) *VyosConfigNode {
-	rs := t.Get("nat source rule")
-
-	if rs == nil {
-		return nil
-	}
-
-	for _, r := range rs.children {
-		if d := r.Get("description"); d != nil && d.Value() == des {
-			return r
-		}
+	if d := t.FindFirst("nat source rule * description", Equals(des)); d != nil {
+		return d.Parent()
 	}
 
 	return nil
@@ -467,35 +655,25 @@ func (t *VyosConfigTree) SetSnatWithRuleNumber(ruleNum int, rules...string) {
 	}
 }
 
-func (t *VyosConfigTree) SetSnatWithStartRuleNumber(startNum int, rules...string) int {
-	currentRuleNum := -1
-
-	for i:=startNum; i<=9999; i ++ {
-		if c := t.Getf("nat destination rule %v", i); c == nil {
-			currentRuleNum = i
-			break
-		}
-	}
+func (t *VyosConfigTree) SetSnat(rules...string) int {
+	return t.SetSnatFor(RULE_FEATURE_DEFAULT, rules...)
+}
 
-	if currentRuleNum == -1 {
-		panic("No rule number avaible for source nat. You have set more than 9999 rules???")
-	}
+func (t *VyosConfigTree) SetSnatFor(feature string, rules...string) int {
+	currentRuleNum := t.allocateRule(RULE_SET_NAT_SOURCE, []string{ "nat", "source", "rule" }, feature)
 
 	for _, rule := range rules {
 		t.Setf("nat source rule %v %s", currentRuleNum, rule)
 	}
+	t.allocatedRules = append(t.allocatedRules, RuleAllocation{ Type: RULE_SET_NAT_SOURCE, Number: currentRuleNum, Feature: feature })
 
 	return currentRuleNum
 }
 
-func (t *VyosConfigTree) SetSnat(rules...string) int {
-	return t.SetSnatWithStartRuleNumber(1, rules...)
-}
-
 // set the config without checking any existing config with the same path
 // usually used for set multi-value keys
 func (t *VyosConfigTree) SetWithoutCheckExisting(config string) {
-	t.changeCommands = append(t.changeCommands, fmt.Sprintf("$SET %s", config))
+	t.changeCommands = append(t.changeCommands, makeScriptCommand("$SET", tokenTexts(splitConfigPath(config))))
 }
 
 // set the config without checking any existing config with the same path
@@ -522,35 +700,75 @@ func (t *VyosConfigTree) Setf(f string, args...interface{}) bool {
 // delete the old one and set the new one
 func (t *VyosConfigTree) Set(config string) bool {
 	t.init()
-	cs := strings.Split(config, " ")
-	key := strings.Join(cs[:len(cs)-1], " ")
+	cs := splitConfigPath(config)
+	utils.Assertf(len(cs) > 1, "the config[%s] has no value", config)
 	value := cs[len(cs)-1]
-	keyNode := t.Get(key)
-	if keyNode != nil && keyNode.ValueSize() > 0 {
-		// the key found
-		cvalue := keyNode.Value()
-		if (value != cvalue) {
-			keyNode.deleteNode(cvalue)
-			keyNode.addNode(value)
-			// the value is changed, delete the old one
-			t.changeCommands = append(t.changeCommands, fmt.Sprintf("$DELETE %s", key))
-			t.changeCommands = append(t.changeCommands, fmt.Sprintf("$SET %s", config))
-			return true
-		} else {
-			// the value is unchanged
-			return false
+	keyNode := t.Root
+	for _, c := range cs[:len(cs)-1] {
+		if keyNode = keyNode.getNode(c.text); keyNode == nil {
+			break
 		}
+	}
+
+	if keyNode != nil && keyNode.HasValue(value.text) {
+		// the value is unchanged
+		return false
+	} else if keyNode != nil && keyNode.ValueSize() == 1 {
+		// the key found
+		keyNode.deleteNode(keyNode.Value())
+		keyNode.addWord(value)
+		// the value is changed, delete the old one
+		t.changeCommands = append(t.changeCommands, makeScriptCommand("$DELETE", keyNode.words()))
+		t.changeCommands = append(t.changeCommands, makeScriptCommand("$SET", tokenTexts(cs)))
+		return true
 	} else {
-		// the key not found
-		current := t.Root
-		for _, c := range cs {
-			current = current.addNode(c)
-		}
-		t.changeCommands = append(t.changeCommands, fmt.Sprintf("$SET %s", config))
+		// the key not found, or a multi-value leaf which the value is added to
+		t.Root.addPath(cs)
+		t.changeCommands = append(t.changeCommands, makeScriptCommand("$SET", tokenTexts(cs)))
 		return true
 	}
 }
 
+// the path and the value are words as they are, e.g. a password with spaces
+func (t *VyosConfigTree) SetPath(path ...string) bool {
+	return t.Set(ConfigPath(path...))
+}
+
+func (t *VyosConfigTree) AddValuePath(path ...string) bool {
+	return t.AddValue(ConfigPath(path...))
+}
+
+func (t *VyosConfigTree) GetPath(path ...string) *VyosConfigNode {
+	return t.Get(ConfigPath(path...))
+}
+
+func (t *VyosConfigTree) DeletePath(path ...string) bool {
+	return t.Delete(ConfigPath(path...))
+}
+
+// add the value to a multi-value leaf, e.g. 'service dns forwarding name-server 8.8.8.8',
+// the other values are kept
+func (t *VyosConfigTree) AddValue(config string) bool {
+	t.init()
+	cs := splitConfigPath(config)
+	utils.Assertf(len(cs) > 1, "the config[%s] has no value", config)
+	if t.Has(config) {
+		return false
+	}
+
+	t.Root.addPath(cs)
+	t.changeCommands = append(t.changeCommands, makeScriptCommand("$SET", tokenTexts(cs)))
+	return true
+}
+
+func (t *VyosConfigTree) AddValuef(f string, args...interface{}) bool {
+	if args != nil {
+		return t.AddValue(fmt.Sprintf(f, args...))
+	} else {
+		return t.AddValue(f)
+	}
+}
+
 func (t *VyosConfigTree) Getf(f string, args...interface{}) *VyosConfigNode {
 	if args != nil {
 		return t.Get(fmt.Sprintf(f, args...))
@@ -579,7 +797,7 @@ func (t *VyosConfigTree) Delete(config string) bool {
 	}
 
 	n.deleteSelf()
-	t.changeCommands = append(t.changeCommands, fmt.Sprintf("$DELETE %s", config))
+	t.changeCommands = append(t.changeCommands, makeScriptCommand("$DELETE", n.words()))
 	return true
 }
 
@@ -603,7 +821,7 @@ func (t *VyosConfigTree) String() string {
 		var pathBuilder func(node *VyosConfigNode)
 		pathBuilder = func(node *VyosConfigNode) {
 			if node.children == nil {
-				path.Push(node.name)
+				path.Push(quoteConfigWord(node.name, node.quoted))
 				strs = append(strs, func() string {
 					sl := path.ReverseSlice()
 					ss := make([]string, len(sl))
@@ -617,7 +835,7 @@ func (t *VyosConfigTree) String() string {
 				return
 			}
 
-			path.Push(node.name)
+			path.Push(quoteConfigWord(node.name, node.quoted))
 			for _, cn := range node.children {
 				pathBuilder(cn)
 			}
@@ -630,3 +848,80 @@ func (t *VyosConfigTree) String() string {
 	return strings.Join(strs, "\n")
 }
 
+// a new node is a tag node if vyos has a template for the names under it,
+// e.g. templates/firewall/name/node.tag/rule/node.tag for the rule numbers
+func isVyosTagNode(n *VyosConfigNode) bool {
+	words := make([]string, 0)
+	for c := n; c.parent != nil; c = c.parent {
+		if c.parent.tag {
+			words = append([]string{ "node.tag" }, words...)
+		} else {
+			words = append([]string{ c.name }, words...)
+		}
+	}
+
+	path := filepath.Join(VYOS_TEMPLATE_DIR, filepath.Join(words...), "node.tag")
+	if tag, ok := vyosTagTemplates.Load(path); ok {
+		return tag.(bool)
+	}
+
+	info, err := os.Stat(path)
+	tag := err == nil && info.IsDir()
+	vyosTagTemplates.Store(path, tag)
+	return tag
+}
+
+// the tree in the format of showCfg, a parsed config is printed as it is
+func (t *VyosConfigTree) Config() string {
+	buf := &bytes.Buffer{}
+	if t.Root != nil {
+		for _, n := range t.Root.children {
+			writeConfigNode(buf, n, "")
+		}
+	}
+	for _, c := range t.comments {
+		fmt.Fprintf(buf, "/*%s*/\n", c)
+	}
+	return buf.String()
+}
+
+func writeConfigComments(buf *bytes.Buffer, n *VyosConfigNode, indent string) {
+	for _, c := range n.comments {
+		fmt.Fprintf(buf, "%s/*%s*/\n", indent, c)
+	}
+}
+
+func writeConfigNode(buf *bytes.Buffer, n *VyosConfigNode, indent string) {
+	writeConfigComments(buf, n, indent)
+
+	name := quoteConfigWord(n.name, n.quoted)
+	hasBlockChild := false
+	for _, c := range n.children {
+		hasBlockChild = hasBlockChild || c.block || len(c.children) != 0
+	}
+
+	if n.tag {
+		for _, c := range n.children {
+			writeConfigComments(buf, c, indent)
+			writeConfigBlock(buf, fmt.Sprintf("%s %s", name, quoteConfigWord(c.name, c.quoted)), c, indent)
+		}
+	} else if n.block || hasBlockChild {
+		writeConfigBlock(buf, name, n, indent)
+	} else if len(n.children) == 0 {
+		fmt.Fprintf(buf, "%s%s\n", indent, name)
+	} else {
+		// a leaf, one line for each value
+		for _, c := range n.children {
+			writeConfigComments(buf, c, indent)
+			fmt.Fprintf(buf, "%s%s %s\n", indent, name, quoteConfigWord(c.name, c.quoted))
+		}
+	}
+}
+
+func writeConfigBlock(buf *bytes.Buffer, head string, n *VyosConfigNode, indent string) {
+	fmt.Fprintf(buf, "%s%s {\n", indent, head)
+	for _, c := range n.children {
+		writeConfigNode(buf, c, indent + "    ")
+	}
+	fmt.Fprintf(buf, "%s}\n", indent)
+}
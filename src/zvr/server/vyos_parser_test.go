@@ -1,11 +1,30 @@
 package server
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"fmt"
 	"zvr/utils"
 )
 
+// the vyos templates of the tag nodes, e.g. "firewall name node.tag rule"
+func useVyosTemplates(t *testing.T, tagNodes ...string) func() {
+	dir, err := ioutil.TempDir("", "zvr-templates"); utils.PanicOnError(err)
+	for _, n := range tagNodes {
+		utils.PanicOnError(os.MkdirAll(filepath.Join(dir, filepath.Join(strings.Fields(n)...), "node.tag"), 0755))
+	}
+
+	old := VYOS_TEMPLATE_DIR
+	VYOS_TEMPLATE_DIR = dir
+	return func() {
+		VYOS_TEMPLATE_DIR = old
+		os.RemoveAll(dir)
+	}
+}
+
 func TestSetFirewall(t *testing.T) {
 	UNIT_TEST = true
 
@@ -156,3 +175,147 @@ ABC E
 	fmt.Println(tree.String())
 }
 
+
+func TestVyosParserRoundTrip(t *testing.T) {
+	text := `interfaces {
+    ethernet eth0 {
+        address 172.20.14.209/16
+        address 10.0.0.1/24
+        description "the public { network } /* not a comment */"
+        hw-id fa:da:21:1f:1a:00
+    }
+    /* the management nic */
+    ethernet eth1 {
+        description "say \"hi\" \\ bye"
+    }
+    loopback lo {
+    }
+}
+service {
+    dhcp-server {
+        shared-network-name eth1_subnet {
+            subnet 10.0.0.0/24 {
+                static-mapping fa_00 {
+                    ip-address 10.0.0.10
+                    static-mapping-parameters "option subnet-mask 255.255.255.0;"
+                    static-mapping-parameters "option host-name &quot;vm1&quot;;"
+                }
+            }
+        }
+    }
+}
+system {
+    console {
+        device ttyS0 {
+            speed 9600
+        }
+        test
+    }
+    package {
+        repository community {
+            username ""
+        }
+    }
+}
+/* Warning: Do not remove the following line. */
+/* === vyatta-config-version: "system@6:nat@4" === */
+`
+
+	tree := NewParserFromConfiguration(text).Tree
+	utils.Assertf(tree.Config() == text, "the config is changed after a round trip:\n%s", tree.Config())
+
+	utils.Assert(tree.Get("interfaces ethernet eth0 address").ValueSize() == 2, "the multi-value leaf is broken")
+	utils.Assert(tree.Get("interfaces ethernet eth0 description").Value() == "the public { network } /* not a comment */", "wrong quoted value")
+	utils.Assert(tree.Get("interfaces ethernet eth1 description").Value() == `say "hi" \ bye`, "wrong escaped value")
+	utils.Assert(tree.Get("system package repository community username").Value() == "", "wrong empty value")
+
+	params := tree.Get("service dhcp-server shared-network-name eth1_subnet subnet 10.0.0.0/24 static-mapping fa_00 static-mapping-parameters")
+	utils.Assert(params.ValueSize() == 2, fmt.Sprintf("wrong values %v", params.Values()))
+	utils.Assert(params.Values()[1] == "option host-name &quot;vm1&quot;;", params.Values()[1])
+
+	// the quoted values work in paths and commands
+	p := `service dhcp-server shared-network-name eth1_subnet subnet 10.0.0.0/24 static-mapping fa_00 static-mapping-parameters "option routers 10.0.0.1;"`
+	utils.Assert(tree.AddValue(p), "the value is not added")
+	utils.Assert(!tree.AddValue(p), "the value is added twice")
+	utils.Assert(params.ValueSize() == 3, fmt.Sprintf("wrong values %v", params.Values()))
+	utils.Assert(tree.Has(p), "the value is not found")
+	tree.Get(p).Delete()
+	cmd := "service dhcp-server shared-network-name eth1_subnet subnet 10.0.0.0/24 static-mapping fa_00 static-mapping-parameters 'option routers 10.0.0.1;'"
+	utils.Assert(tree.CommandsAsString() == fmt.Sprintf("$SET %s\n$DELETE %s", cmd, cmd), tree.CommandsAsString())
+
+	tree.Set("system console device ttyS0 speed 115200")
+	utils.Assert(tree.Get("system console device ttyS0 speed").Value() == "115200", "the value is not replaced")
+
+	// an unquoted value with spaces as the old parser did
+	utils.Assert(NewParserFromConfiguration("a b c d\n").Tree.Get("a").Value() == "b c d", "wrong unquoted value")
+}
+
+func TestConfigOfScriptCommands(t *testing.T) {
+	tree := NewParserFromConfiguration(`
+firewall {
+    name eth0.in {
+        rule 1 {
+            action accept
+        }
+    }
+}
+`).Tree
+	defer useVyosTemplates(t, "firewall name", "firewall name node.tag rule", "nat destination rule",
+		"vpn ipsec site-to-site peer", "vpn ipsec site-to-site peer node.tag tunnel")()
+
+	// the tag nodes created by the commands are printed as showCfg does,
+	// they are known by the lines of the config or the vyos templates
+	utils.PanicOnError(tree.applyScriptCommands([]string{
+		"$SET firewall name eth0.in rule 2 action drop",
+		"$SET firewall name eth1.in rule 1 action accept",
+		"$SET nat destination rule 100 inbound-interface eth0",
+		"$SET vpn ipsec site-to-site peer 1.1.1.1 tunnel 1 local prefix 10.0.0.0/24",
+		"$SET service ssh port 22",
+	}))
+
+	text := `firewall {
+    name eth0.in {
+        rule 1 {
+            action accept
+        }
+        rule 2 {
+            action drop
+        }
+    }
+    name eth1.in {
+        rule 1 {
+            action accept
+        }
+    }
+}
+nat {
+    destination {
+        rule 100 {
+            inbound-interface eth0
+        }
+    }
+}
+vpn {
+    ipsec {
+        site-to-site {
+            peer 1.1.1.1 {
+                tunnel 1 {
+                    local {
+                        prefix 10.0.0.0/24
+                    }
+                }
+            }
+        }
+    }
+}
+service {
+    ssh {
+        port 22
+    }
+}
+`
+	utils.Assertf(tree.Config() == text, "the config is not in the format of showCfg:\n%s", tree.Config())
+	parsed := NewParserFromConfiguration(tree.Config()).Tree
+	utils.Assertf(parsed.Config() == text, "the config is changed after a round trip:\n%s", parsed.Config())
+	utils.Assert(parsed.Has("vpn ipsec site-to-site peer 1.1.1.1 tunnel 1 local prefix 10.0.0.0/24"), "the peer is not parsed")
+}
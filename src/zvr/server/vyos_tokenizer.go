@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"zvr/utils"
+)
+
+// The tokenizer of the config printed by showCfg:
+//
+//   /* a comment */
+//   interfaces {
+//       ethernet eth0 {
+//           address 172.20.14.209/16
+//           description "a quoted \"value\""
+//       }
+//   }
+//
+// A quoted value is one word whatever it contains, a backslash escapes the
+// next character inside the quotes. Comments are kept as tokens so they can
+// be printed back.
+//
+// The config paths given to VyosConfigTree are split by the same rules, and
+// the commands of the vyos script are built from the words, each quoted for
+// bash, so no value can break the script or run anything
+
+type tokenKind int
+const (
+	TOKEN_WORD tokenKind = iota
+	TOKEN_OPEN
+	TOKEN_CLOSE
+	TOKEN_NEWLINE
+	TOKEN_COMMENT
+)
+
+type vyosToken struct {
+	kind tokenKind
+	// the word without the quotes and escapes, or the comment between /* and */
+	text string
+	quoted bool
+}
+
+func tokenizeVyosConfig(text string) []vyosToken {
+	tokens := make([]vyosToken, 0)
+	rs := []rune(text)
+
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case c == '\n':
+			tokens = append(tokens, vyosToken{ kind: TOKEN_NEWLINE })
+			i++
+		case unicode.IsSpace(c):
+			i++
+		case c == '{' && wordEnds(rs, i + 1):
+			tokens = append(tokens, vyosToken{ kind: TOKEN_OPEN, text: "{" })
+			i++
+		case c == '}' && wordEnds(rs, i + 1):
+			tokens = append(tokens, vyosToken{ kind: TOKEN_CLOSE, text: "}" })
+			i++
+		case c == '/' && i + 1 < len(rs) && rs[i + 1] == '*':
+			end := strings.Index(string(rs[i + 2:]), "*/")
+			if end < 0 {
+				panic(fmt.Errorf("unable to parse the configuration, the comment at %v is not closed", i))
+			}
+			comment := string(rs[i + 2:])[:end]
+			tokens = append(tokens, vyosToken{ kind: TOKEN_COMMENT, text: comment })
+			i += 2 + len([]rune(comment)) + 2
+		case c == '"':
+			word := make([]rune, 0)
+			closed := false
+			for i++; i < len(rs); i++ {
+				if rs[i] == '\\' && i + 1 < len(rs) {
+					i++
+					word = append(word, rs[i])
+				} else if rs[i] == '"' {
+					closed = true
+					i++
+					break
+				} else {
+					word = append(word, rs[i])
+				}
+			}
+			if !closed {
+				panic(fmt.Errorf("unable to parse the configuration, the quote of the value[%s] is not closed", string(word)))
+			}
+			tokens = append(tokens, vyosToken{ kind: TOKEN_WORD, text: string(word), quoted: true })
+		default:
+			start := i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) && rs[i] != '"' {
+				i++
+			}
+			tokens = append(tokens, vyosToken{ kind: TOKEN_WORD, text: string(rs[start:i]) })
+		}
+	}
+
+	return tokens
+}
+
+// a brace is a token only if it's not a part of a word, e.g. a{b}
+func wordEnds(rs []rune, i int) bool {
+	return i >= len(rs) || unicode.IsSpace(rs[i])
+}
+
+// the words of a path, e.g. `service dhcp-server ... static-mapping-parameters "option routers 10.0.0.1;"`
+func splitConfigPath(config string) []vyosToken {
+	words := make([]vyosToken, 0)
+	for _, t := range tokenizeVyosConfig(config) {
+		if t.kind == TOKEN_WORD {
+			words = append(words, t)
+		} else if t.kind == TOKEN_OPEN || t.kind == TOKEN_CLOSE {
+			// not a block but the word '{' or '}'
+			words = append(words, vyosToken{ kind: TOKEN_WORD, text: t.text })
+		}
+	}
+	return words
+}
+
+// the word in the config, quoted if it's quoted in the config or can't be a word otherwise
+func quoteConfigWord(word string, quoted bool) string {
+	if !quoted && word != "" && strings.IndexFunc(word, unicode.IsSpace) < 0 && !strings.ContainsAny(word, "\"\\{}") && !strings.HasPrefix(word, "/*") {
+		return word
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return fmt.Sprintf(`"%s"`, r.Replace(word))
+}
+
+func tokenTexts(tokens []vyosToken) []string {
+	texts := make([]string, len(tokens))
+	for i, t := range tokens {
+		texts[i] = t.text
+	}
+	return texts
+}
+
+// the path of the words, each quoted if needed, to pass to Set, Get, Delete
+// and others. Use it for the values from the users, e.g.
+//   tree.Set(ConfigPath("vpn", "ipsec", "site-to-site", "peer", peer, "authentication", "pre-shared-secret", key))
+func ConfigPath(words ...string) string {
+	ws := make([]string, len(words))
+	for i, w := range words {
+		ws[i] = quoteConfigWord(w, false)
+	}
+	return strings.Join(ws, " ")
+}
+
+// the line of the vyos script, e.g. $SET with the path
+func makeScriptCommand(op string, words []string) string {
+	ws := make([]string, len(words) + 1)
+	ws[0] = op
+	for i, w := range words {
+		ws[i + 1] = utils.ShellQuote(w)
+	}
+	return strings.Join(ws, " ")
+}
+
+// the op and the words of a line of the vyos script, unquoted as bash does,
+// e.g. the line made by makeScriptCommand
+func parseScriptCommand(line string) (string, []string, error) {
+	words := make([]string, 0)
+	word := make([]rune, 0)
+	inWord := false
+	var quote rune
+
+	rs := []rune(line)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case quote == '\'' && r == '\'':
+			quote = 0
+		case quote == '\'':
+			word = append(word, r)
+		case quote == '"' && r == '"':
+			quote = 0
+		case quote == '"' && r == '\\' && i + 1 < len(rs) && strings.ContainsRune("$`\"\\", rs[i + 1]):
+			i++
+			word = append(word, rs[i])
+		case quote == '"':
+			word = append(word, r)
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == '\\' && i + 1 < len(rs):
+			i++
+			word, inWord = append(word, rs[i]), true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = word[:0], false
+			}
+		default:
+			word, inWord = append(word, r), true
+		}
+	}
+
+	if quote != 0 {
+		return "", nil, fmt.Errorf("the quote is not closed")
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	if len(words) == 0 {
+		return "", nil, fmt.Errorf("no command")
+	}
+	return words[0], words[1:], nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"zvr/utils"
+)
+
+// the words bash passes to $SET and $DELETE when it runs the commands
+func runScriptCommands(commands []string) [][]string {
+	script := `record() { printf '%s\0' "$@"; printf '\1'; }
+SET=record
+DELETE=record
+` + strings.Join(commands, "\n")
+
+	b := utils.Bash{ Command: script, NoLog: true }
+	ret, so, se, err := b.RunWithReturn()
+	utils.PanicOnError(err)
+	utils.Assertf(ret == 0, "the script failed, %s", se)
+
+	calls := make([][]string, 0)
+	for _, line := range strings.Split(so, "\x01") {
+		if line == "" {
+			continue
+		}
+		words := strings.Split(strings.TrimSuffix(line, "\x00"), "\x00")
+		calls = append(calls, words)
+	}
+	return calls
+}
+
+func randomValue(r *rand.Rand) string {
+	const dangerous = " \t\n'\"`$(){}[];|&<>\\#*?~!%=/"
+	const plain = "abcXYZ019-_.:"
+
+	n := r.Intn(12)
+	rs := make([]byte, n)
+	for i := range rs {
+		if r.Intn(2) == 0 {
+			rs[i] = dangerous[r.Intn(len(dangerous))]
+		} else {
+			rs[i] = plain[r.Intn(len(plain))]
+		}
+	}
+	return string(rs)
+}
+
+func TestScriptQuoting(t *testing.T) {
+	values := []string{
+		"",
+		"with spaces",
+		"$(touch /tmp/zvr-injected)",
+		"`touch /tmp/zvr-injected`",
+		"'; touch /tmp/zvr-injected; '",
+		"\"; touch /tmp/zvr-injected; \"",
+		"a\nb",
+		"{{.Injected}}",
+		"/* not a comment */",
+		"}",
+		"\\",
+	}
+	r := rand.New(rand.NewSource(7272))
+	for i := 0; i < 300; i++ {
+		values = append(values, randomValue(r))
+	}
+
+	for _, v := range values {
+		tree := &VyosConfigTree{}
+		path := []string{ "vpn", "ipsec", "site-to-site", "peer", "10.0.0.1", "authentication", "pre-shared-secret", v }
+		utils.Assert(tree.SetPath(path...), "nothing is set")
+
+		// the value is a word in the tree
+		n := tree.GetPath(path[:len(path) - 1]...)
+		utils.Assertf(n != nil && n.Value() == v, "the value[%q] is not set", v)
+
+		// and survives a round trip through the parser
+		parsed := NewParserFromConfiguration(tree.Config()).Tree
+		n = parsed.GetPath(path[:len(path) - 1]...)
+		utils.Assertf(n != nil && n.Value() == v, "the value[%q] is changed by the round trip:\n%s", v, tree.Config())
+
+		// and bash passes it as one argument
+		utils.Assert(tree.DeletePath(path...), "nothing is deleted")
+		calls := runScriptCommands(tree.Commands())
+		utils.Assertf(len(calls) == 2, "the value[%q] is run as %v", v, calls)
+		for _, c := range calls {
+			utils.Assertf(strings.Join(c, "\x00") == strings.Join(path, "\x00"), "the value[%q] is passed as %q", v, c)
+		}
+
+		// and the simulated vyos reads the commands as bash does
+		for _, c := range tree.Commands() {
+			_, words, err := parseScriptCommand(c)
+			utils.Assertf(err == nil && strings.Join(words, "\x00") == strings.Join(path, "\x00"), "the value[%q] is parsed as %q, %v", v, words, err)
+		}
+	}
+
+	e, _ := utils.PathExists("/tmp/zvr-injected")
+	utils.Assert(!e, "the command is injected")
+}
+
+func TestDiffQuoting(t *testing.T) {
+	current := &VyosConfigTree{}
+	current.SetPath("system", "login", "banner", "pre-login", "$(reboot) 'now'")
+
+	desired := &VyosConfigTree{}
+	desired.SetPath("system", "login", "banner", "post-login", "say \"hi\"")
+
+	calls := runScriptCommands(Diff(current, desired))
+	utils.Assert(fmt.Sprintf("%q", calls) == `[["system" "login" "banner" "pre-login"] ["system" "login" "banner" "post-login" "say \"hi\""]]`,
+		fmt.Sprintf("wrong commands %q", calls))
+}
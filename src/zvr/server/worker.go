@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	ASYNC_STATUS_PATH = "/async/status"
+
+	DEFAULT_ASYNC_WORKERS = 4
+	DEFAULT_ASYNC_QUEUE_SIZE = 256
+)
+
+var (
+	// the Retry-After hint returned when the queue is full
+	ASYNC_RETRY_AFTER = time.Duration(5) * time.Second
+)
+
+type asyncJob struct {
+	taskUuid string
+	fn func()
+	enqueueTime time.Time
+}
+
+// async commands run in a fixed number of workers, the
+// commands beyond them wait in a bounded queue
+type workerPool struct {
+	workers int
+	queueSize int
+	jobs chan *asyncJob
+
+	lock sync.Mutex
+	busy int
+	accepted uint64
+	rejected uint64
+	lastWait time.Duration
+	maxWait time.Duration
+	totalWait time.Duration
+	started uint64
+}
+
+var (
+	workers *workerPool
+	workersOnce sync.Once
+)
+
+func newWorkerPool(size, queueSize int) *workerPool {
+	p := &workerPool{
+		workers: size,
+		queueSize: queueSize,
+		jobs: make(chan *asyncJob, queueSize),
+	}
+
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// the pool is sized by the options the first time it's used
+func getWorkerPool() *workerPool {
+	workersOnce.Do(func() {
+		size := int(commandOptions.AsyncWorkers)
+		if size == 0 {
+			size = DEFAULT_ASYNC_WORKERS
+		}
+
+		queueSize := int(commandOptions.AsyncQueueSize)
+		if queueSize == 0 {
+			queueSize = DEFAULT_ASYNC_QUEUE_SIZE
+		}
+
+		log.Debugf("start %v workers for async commands, the queue size is %v", size, queueSize)
+		workers = newWorkerPool(size, queueSize)
+	})
+
+	return workers
+}
+
+// return false if the queue is full, the job is not run then
+func (p *workerPool) submit(taskUuid string, fn func()) bool {
+	select {
+	case p.jobs <- &asyncJob{ taskUuid: taskUuid, fn: fn, enqueueTime: time.Now() }:
+		p.lock.Lock()
+		p.accepted++
+		p.lock.Unlock()
+		return true
+	default:
+		p.lock.Lock()
+		p.rejected++
+		p.lock.Unlock()
+		asyncRejected.Inc()
+		return false
+	}
+}
+
+func (p *workerPool) work() {
+	for j := range p.jobs {
+		wait := time.Now().Sub(j.enqueueTime)
+		asyncQueueWait.Observe(wait.Seconds())
+
+		p.lock.Lock()
+		p.busy++
+		p.started++
+		p.lastWait = wait
+		p.totalWait += wait
+		if wait > p.maxWait {
+			p.maxWait = wait
+		}
+		p.lock.Unlock()
+
+		p.run(j)
+
+		p.lock.Lock()
+		p.busy--
+		p.lock.Unlock()
+	}
+}
+
+// the job recovers by itself, this only keeps the worker alive
+func (p *workerPool) run(j *asyncJob) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Warnf("%+v\n", errors.New(fmt.Sprintf("async job of the task[uuid:%s] failed, %v", j.taskUuid, err)))
+		}
+	}()
+
+	j.fn()
+}
+
+type asyncStatusRsp struct {
+	Workers int `json:"workers"`
+	BusyWorkers int `json:"busyWorkers"`
+	QueueSize int `json:"queueSize"`
+	QueueDepth int `json:"queueDepth"`
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	LastWaitSeconds float64 `json:"lastWaitSeconds"`
+	MaxWaitSeconds float64 `json:"maxWaitSeconds"`
+	AvgWaitSeconds float64 `json:"avgWaitSeconds"`
+}
+
+func (p *workerPool) status() asyncStatusRsp {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	rsp := asyncStatusRsp{
+		Workers: p.workers,
+		BusyWorkers: p.busy,
+		QueueSize: p.queueSize,
+		QueueDepth: len(p.jobs),
+		Accepted: p.accepted,
+		Rejected: p.rejected,
+		LastWaitSeconds: p.lastWait.Seconds(),
+		MaxWaitSeconds: p.maxWait.Seconds(),
+	}
+
+	if p.started > 0 {
+		rsp.AvgWaitSeconds = p.totalWait.Seconds() / float64(p.started)
+	}
+
+	return rsp
+}
+
+func asyncStatusHandler(ctx *CommandContext) interface{} {
+	return getWorkerPool().status()
+}
+
+func init() {
+	RegisterSyncCommandHandler(ASYNC_STATUS_PATH, asyncStatusHandler)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+	"zvr/utils"
+)
+
+func TestWorkerPoolRejectWhenFull(t *testing.T) {
+	p := newWorkerPool(1, 1)
+	block := make(chan struct{})
+	done := make(chan struct{}, 2)
+
+	job := func() {
+		<-block
+		done <- struct{}{}
+	}
+
+	utils.Assert(p.submit("task1", job), "the first job is rejected")
+	// wait for the worker to take the first job
+	utils.LoopRunUntilSuccessOrTimeout(func() bool {
+		return p.status().BusyWorkers == 1
+	}, time.Duration(2) * time.Second, time.Duration(10) * time.Millisecond)
+
+	utils.Assert(p.submit("task2", job), "the second job is rejected")
+	utils.Assert(!p.submit("task3", job), "the third job is accepted but the queue is full")
+
+	s := p.status()
+	utils.Assertf(s.QueueDepth == 1 && s.Accepted == 2 && s.Rejected == 1, "unexpected status %+v", s)
+
+	close(block)
+	<-done
+	<-done
+}
+
+func TestAsyncCommandQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zvr-outbox"); utils.PanicOnError(err)
+	defer os.RemoveAll(dir)
+	OUTBOX_DIR = dir
+
+	mgmt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer mgmt.Close()
+
+	getWorkerPool()
+	old := workers
+	workers = newWorkerPool(1, 1)
+	defer func() { workers = old }()
+
+	block := make(chan struct{})
+	path := "/testqueuefull"
+	RegisterAsyncCommandHandler(path, func(ctx *CommandContext) interface{} {
+		<-block
+		return nil
+	})
+
+	post := func(taskUuid string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte("{}")))
+		req.Header.Set(CALLBACK_URL, mgmt.URL)
+		req.Header.Set(TASK_UUID, taskUuid)
+		dispatch(w, req)
+		return w
+	}
+
+	utils.Assert(post("queue-full-1").Code == http.StatusOK, "the first task is rejected")
+	utils.LoopRunUntilSuccessOrTimeout(func() bool {
+		return workers.status().BusyWorkers == 1
+	}, time.Duration(2) * time.Second, time.Duration(10) * time.Millisecond)
+	utils.Assert(post("queue-full-2").Code == http.StatusOK, "the second task is rejected")
+
+	w := post("queue-full-3")
+	utils.Assertf(w.Code == http.StatusServiceUnavailable, "unexpected status code %v", w.Code)
+	utils.Assert(w.Header().Get("Retry-After") != "", "no retry hint")
+	_, found := tasks.get("queue-full-3")
+	utils.Assert(!found, "the rejected task is still in the registry")
+
+	// the status endpoint shows the queue
+	sw := httptest.NewRecorder()
+	dispatch(sw, httptest.NewRequest(http.MethodPost, ASYNC_STATUS_PATH, bytes.NewReader([]byte("{}"))))
+	s := asyncStatusRsp{}
+	utils.PanicOnError(json.Unmarshal(sw.Body.Bytes(), &s))
+	utils.Assertf(s.Workers == 1 && s.QueueDepth == 1 && s.Rejected == 1, "unexpected status %+v", s)
+
+	close(block)
+	utils.LoopRunUntilSuccessOrTimeout(func() bool {
+		t, _ := tasks.get("queue-full-2")
+		return t.isDone()
+	}, time.Duration(5) * time.Second, time.Duration(50) * time.Millisecond)
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// the checks of the arguments sent by the mgmt server, a bad argument is
+// reported as INVALID_ARGUMENT rather than failing later as INTERNAL_ERROR
+
+func AssertIpArgument(name, ip string) {
+	AssertArgument(net.ParseIP(ip) != nil, "%s[%s] is not a valid IP address", name, ip)
+}
+
+func AssertCidrArgument(name, cidr string) {
+	_, _, err := net.ParseCIDR(cidr)
+	AssertArgument(err == nil, "%s[%s] is not a valid CIDR", name, cidr)
+}
+
+func AssertNetmaskArgument(name, netmask string) {
+	ip := net.ParseIP(netmask).To4()
+	valid := ip != nil
+	if valid {
+		_, bits := net.IPMask(ip).Size()
+		valid = bits == 32
+	}
+	AssertArgument(valid, "%s[%s] is not a valid netmask", name, netmask)
+}
+
+func AssertMacArgument(name, mac string) {
+	_, err := net.ParseMAC(mac)
+	AssertArgument(err == nil, "%s[%s] is not a valid mac address", name, mac)
+}
+
+func AssertPortRangeArgument(name string, start, end int) {
+	AssertArgument(start > 0 && end <= 65535 && start <= end, "%s[%v-%v] is not a valid port range", name, start, end)
+}
+
+var uuidRegex = regexp.MustCompile(`^([0-9a-fA-F]{32}|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+func AssertUuidArgument(name, uuid string) {
+	AssertArgument(uuidRegex.MatchString(uuid), "%s[%s] is not a valid uuid", name, uuid)
+}
+
+// a value set as a single vyos word, e.g. an algorithm
+func AssertWordArgument(name, word string) {
+	valid := word != "" && strings.IndexFunc(word, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || r == '"' || r == '\''
+	}) < 0
+	AssertArgument(valid, "%s[%q] is not a valid word", name, word)
+}
+
+// a host name or a domain name, it's written into the config files of services
+var hostnameRegex = regexp.MustCompile(`^[0-9a-zA-Z]([0-9a-zA-Z-]*[0-9a-zA-Z])?(\.[0-9a-zA-Z]([0-9a-zA-Z-]*[0-9a-zA-Z])?)*$`)
+
+func AssertHostnameArgument(name, hostname string) {
+	AssertArgument(len(hostname) <= 253 && hostnameRegex.MatchString(hostname), "%s[%q] is not a valid host name", name, hostname)
+}
+
+func AssertOneOfArgument(name, value string, values ...string) {
+	for _, v := range values {
+		if v == value {
+			return
+		}
+	}
+	AssertArgument(false, "%s[%s] is not one of %v", name, value, values)
+}
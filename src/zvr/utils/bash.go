@@ -2,6 +2,8 @@ package utils
 
 import (
 	"bytes"
+	"regexp"
+	"strings"
 	"text/template"
 	"os/exec"
 	"syscall"
@@ -62,7 +64,9 @@ func (b *Bash) Run() error {
 }
 
 func (b *Bash) RunWithReturn() (retCode int, stdout, stderr string, err error) {
+	bashExecutions.Inc()
 	if err = b.build(); err != nil {
+		bashFailures.Inc()
 		b.err = err
 		return -1, "", "", err
 	}
@@ -92,6 +96,10 @@ func (b *Bash) RunWithReturn() (retCode int, stdout, stderr string, err error) {
 	stdout = string(so.Bytes())
 	stderr = string(se.Bytes())
 
+	if retCode != 0 {
+		bashFailures.Inc()
+	}
+
 	b.retCode = retCode
 	b.stdout = stdout
 	b.stderr = stderr
@@ -123,4 +131,13 @@ func NewBash() *Bash {
 	return &Bash{}
 }
 
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_./:,=@%+-]+$`)
 
+// quote the string as one word of bash, nothing in it is expanded
+func ShellQuote(s string) string {
+	if shellSafeRegex.MatchString(s) {
+		return s
+	}
+
+	return fmt.Sprintf("'%s'", strings.Replace(s, "'", `'\''`, -1))
+}
@@ -38,3 +38,14 @@ func TestBash(t *testing.T)  {
 	}
 	fmt.Printf("%v, %v, %v", ret, so, se)
 }
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{ "eth0", "", "a b", "it's", "$(touch /tmp/x)", "`id`", "a\nb", "'", "\\'\"" } {
+		b := NewBash()
+		b.Command = fmt.Sprintf("printf %%s %s", ShellQuote(s))
+		b.NoLog = true
+		_, so, _, err := b.RunWithReturn()
+		PanicOnError(err)
+		Assertf(so == s, "the word[%s] is changed to %s by bash", s, so)
+	}
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"fmt"
+)
+
+// a stable code the mgmt server can react to, the message is for humans only
+type ErrorCode string
+
+const (
+	INTERNAL_ERROR ErrorCode = "INTERNAL_ERROR"
+	INVALID_ARGUMENT ErrorCode = "INVALID_ARGUMENT"
+	NIC_NOT_FOUND ErrorCode = "NIC_NOT_FOUND"
+	VYOS_COMMIT_FAILED ErrorCode = "VYOS_COMMIT_FAILED"
+	// the commit failed and the running config is unknown
+	VYOS_ROLLBACK_FAILED ErrorCode = "VYOS_ROLLBACK_FAILED"
+	TASK_CANCELLED ErrorCode = "TASK_CANCELLED"
+	AGENT_BUSY ErrorCode = "AGENT_BUSY"
+)
+
+type AgentError struct {
+	Code ErrorCode
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *AgentError) Error() string {
+	return e.Message
+}
+
+func NewAgentError(code ErrorCode, details map[string]interface{}, f string, args...interface{}) *AgentError {
+	return &AgentError{
+		Code: code,
+		Message: fmt.Sprintf(f, args...),
+		Details: details,
+	}
+}
+
+// return the AgentError in the error chain, or nil
+func AsAgentError(err error) *AgentError {
+	for err != nil {
+		if e, ok := err.(*AgentError); ok {
+			return e
+		}
+
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return nil
+		}
+		err = cause.Cause()
+	}
+
+	return nil
+}
+
+// like Assertf, but the failure is reported as INVALID_ARGUMENT
+func AssertArgument(expression bool, f string, args...interface{}) {
+	if !expression {
+		panic(NewAgentError(INVALID_ARGUMENT, nil, f, args...))
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"testing"
+	"github.com/pkg/errors"
+)
+
+func TestAsAgentError(t *testing.T) {
+	e := NewAgentError(NIC_NOT_FOUND, map[string]interface{}{ "mac": "00:11" }, "cannot find the nic[mac:%s]", "00:11")
+	Assert(e.Error() == "cannot find the nic[mac:00:11]", e.Error())
+
+	ae := AsAgentError(errors.Wrap(e, "wrapped"))
+	Assert(ae == e, "the AgentError is not found in the error chain")
+	Assert(AsAgentError(errors.New("plain")) == nil, "a plain error is not an AgentError")
+	Assert(AsAgentError(nil) == nil, "nil is not an AgentError")
+}
+
+func TestAssertArgument(t *testing.T) {
+	defer func() {
+		err := recover()
+		ae, ok := err.(*AgentError)
+		Assert(ok, "AssertArgument must panic an AgentError")
+		Assertf(ae.Code == INVALID_ARGUMENT, "unexpected code %s", ae.Code)
+		Assertf(ae.Message == "bad value 1", "unexpected message %s", ae.Message)
+	}()
+
+	AssertArgument(true, "never")
+	AssertArgument(false, "bad value %v", 1)
+}
+
+func TestAssertArguments(t *testing.T) {
+	check := func(fn func(), ok bool, name string) {
+		rejected := func() (rejected bool) {
+			defer func() {
+				if err := recover(); err != nil {
+					ae, isAgentError := err.(*AgentError)
+					Assertf(isAgentError && ae.Code == INVALID_ARGUMENT, "unexpected error %v", err)
+					rejected = true
+				}
+			}()
+			fn()
+			return false
+		}()
+		Assertf(rejected != ok, "%s is wrongly checked", name)
+	}
+
+	check(func() { AssertIpArgument("ip", "10.0.0.1") }, true, "ip")
+	check(func() { AssertIpArgument("ip", "10.0.0.1; reboot") }, false, "bad ip")
+	check(func() { AssertCidrArgument("cidr", "10.0.0.0/24") }, true, "cidr")
+	check(func() { AssertCidrArgument("cidr", "10.0.0.0") }, false, "bad cidr")
+	check(func() { AssertNetmaskArgument("netmask", "255.255.255.0") }, true, "netmask")
+	check(func() { AssertNetmaskArgument("netmask", "255.0.255.0") }, false, "bad netmask")
+	check(func() { AssertMacArgument("mac", "fa:da:21:1f:1a:00") }, true, "mac")
+	check(func() { AssertMacArgument("mac", "fa:da") }, false, "bad mac")
+	check(func() { AssertPortRangeArgument("port", 22, 22) }, true, "port")
+	check(func() { AssertPortRangeArgument("port", 0, 65536) }, false, "bad port")
+	check(func() { AssertUuidArgument("uuid", "9c1b2d5e3f4a4b6c8d7e0f1a2b3c4d5e") }, true, "uuid")
+	check(func() { AssertUuidArgument("uuid", "../../etc") }, false, "bad uuid")
+	check(func() { AssertWordArgument("word", "aes128") }, true, "word")
+	check(func() { AssertWordArgument("word", "aes128 hash") }, false, "bad word")
+	check(func() { AssertHostnameArgument("hostname", "vm-1.zstack.org") }, true, "hostname")
+	check(func() { AssertHostnameArgument("hostname", `vm"; option`) }, false, "bad hostname")
+	check(func() { AssertOneOfArgument("mode", "tcp", "tcp", "http") }, true, "mode")
+	check(func() { AssertOneOfArgument("mode", "ftp", "tcp", "http") }, false, "bad mode")
+}
@@ -2,7 +2,14 @@ package utils
 
 import (
 	"os"
+	"os/user"
 	"path"
+	"strconv"
+)
+
+const (
+	// written by zvrboot, read by zvr
+	BOOTSTRAP_INFO_CACHE = "/home/vyos/zvr/bootstrap-info.json"
 )
 
 func MkdirForFile(filepath string, perm os.FileMode) error {
@@ -24,6 +31,25 @@ func CreateFileIfNotExists(filePath string, flag int, perm os.FileMode) (*os.Fil
 	return os.OpenFile(filePath, flag, perm)
 }
 
+// e.g. the files read by the scripts run as user vyos
+func ChownToUser(filepath, username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(filepath, uid, gid)
+}
+
 func PathExists(filepath string) (bool, error) {
 	_, err := os.Stat(filepath)
 	if os.IsNotExist(err) {
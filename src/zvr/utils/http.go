@@ -1,25 +1,94 @@
 package utils
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"net/http"
 	"encoding/json"
 	"github.com/pkg/errors"
 	"fmt"
 	"bytes"
 	"io/ioutil"
+	"time"
 	"github.com/Sirupsen/logrus"
 )
 
 var (
 	HEADER_TRIGGER_URL = "TriggerURL"
+	// how long a post waits for the whole response, a server
+	// that never answers must not hold the caller forever
+	HTTP_POST_TIMEOUT = time.Duration(30) * time.Second
+
+	httpClient = &http.Client{ Timeout: HTTP_POST_TIMEOUT }
 )
 
+type HttpTlsOptions struct {
+	// the CA to verify the server, the system CAs are used if empty
+	CaFile string
+	// the client certificate presented to the server requiring mutual TLS
+	CertFile string
+	KeyFile string
+}
+
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to read the CA file[%s]", caFile))
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("no PEM certificate found in the CA file[%s]", caFile))
+	}
+
+	return pool, nil
+}
+
+// set TLS options of the client used by HttpPost, the client is
+// unchanged if no option is set
+func SetHttpTlsOptions(o HttpTlsOptions) error {
+	if o == (HttpTlsOptions{}) {
+		return nil
+	}
+
+	cfg := &tls.Config{}
+
+	if o.CaFile != "" {
+		pool, err := LoadCertPool(o.CaFile)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unable to load the client certificate[cert:%s, key:%s]", o.CertFile, o.KeyFile))
+		}
+		cfg.Certificates = []tls.Certificate{ cert }
+	}
+
+	// keep the dial, handshake and idle timeouts of the default transport
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	httpClient = &http.Client{ Transport: transport, Timeout: HTTP_POST_TIMEOUT }
+
+	return nil
+}
+
 func HttpPostWithoutHeaders(url string, obj interface{}) ([]byte, error) {
 	return HttpPost(url, nil, obj)
 }
 
 func HttpPostForObject(url string, headers map[string]string, obj interface{}, retObj interface{}) error {
-	b, err := HttpPost(url, headers, obj)
+	return HttpPostForObjectWithContext(context.Background(), url, headers, obj, retObj)
+}
+
+// the post is given up when the context is done, even if the client timeout is not reached
+func HttpPostForObjectWithContext(ctx context.Context, url string, headers map[string]string, obj interface{}, retObj interface{}) error {
+	b, err := HttpPostWithContext(ctx, url, headers, obj)
 	if err != nil {
 		return err
 	}
@@ -50,6 +119,10 @@ func (e *HttpPostError) StatusCode() int {
 }
 
 func HttpPost(url string, headers map[string]string, obj interface{}) ([]byte, error) {
+	return HttpPostWithContext(context.Background(), url, headers, obj)
+}
+
+func HttpPostWithContext(ctx context.Context, url string, headers map[string]string, obj interface{}) ([]byte, error) {
 	var b []byte
 	var err error
 
@@ -62,7 +135,7 @@ func HttpPost(url string, headers map[string]string, obj interface{}) ([]byte, e
 		b = []byte("")
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("unable to do HTTP post to %v", url))
 	}
@@ -73,7 +146,7 @@ func HttpPost(url string, headers map[string]string, obj interface{}) ([]byte, e
 		}
 	}
 
-	c := &http.Client{}
+	c := httpClient
 
 	triggerUrl := req.Header.Get(HEADER_TRIGGER_URL)
 	if triggerUrl != "" {
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHttpPostWithTls(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+
+	// no option, the default client is kept
+	old := httpClient
+	PanicOnError(SetHttpTlsOptions(HttpTlsOptions{}))
+	Assert(httpClient == old, "the client is replaced without any option")
+
+	// the server certificate is self-signed, it's unknown without the CA
+	_, err := HttpPostWithoutHeaders(ts.URL, nil)
+	Assert(err != nil, "the server certificate should not be trusted")
+
+	ca, err := ioutil.TempFile("", "zvr-ca"); PanicOnError(err)
+	defer os.Remove(ca.Name())
+	err = pem.Encode(ca, &pem.Block{ Type: "CERTIFICATE", Bytes: ts.Certificate().Raw }); PanicOnError(err)
+	ca.Close()
+
+	err = SetHttpTlsOptions(HttpTlsOptions{ CaFile: ca.Name() }); PanicOnError(err)
+	b, err := HttpPostWithoutHeaders(ts.URL, nil); PanicOnError(err)
+	Assert(string(b) == "hello", string(b))
+
+	// with the timeouts of the default transport
+	transport := httpClient.Transport.(*http.Transport)
+	Assert(transport.TLSHandshakeTimeout != 0 && transport.IdleConnTimeout != 0 && transport.DialContext != nil, "the timeouts are dropped")
+	Assert(httpClient.Timeout == HTTP_POST_TIMEOUT, "the client timeout is dropped")
+
+	err = SetHttpTlsOptions(HttpTlsOptions{ CaFile: "/not/existing/ca" })
+	Assert(err != nil, "the CA file doesn't exist")
+}
+
+func TestHttpPostTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	Assert(httpClient.Timeout == HTTP_POST_TIMEOUT, "the client has no timeout")
+
+	// the post is given up at the deadline of the context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(200) * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := HttpPostWithContext(ctx, ts.URL, nil, nil)
+	Assert(err != nil, "the post to a hanging server succeeds")
+	Assertf(time.Since(start) < time.Second, "the post is not given up in time, %v", time.Since(start))
+}
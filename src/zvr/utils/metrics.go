@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal implementation of Prometheus counters and histograms,
+// rendered in the Prometheus text exposition format
+
+var (
+	DEFAULT_DURATION_BUCKETS = []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+	metricsLock = &sync.Mutex{}
+	metrics = make([]metric, 0)
+)
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+type metricBase struct {
+	metricName string
+	help string
+	labelNames []string
+	lock sync.Mutex
+	// label values in the order of first seen
+	keys []string
+	labels map[string][]string
+}
+
+func (m *metricBase) name() string {
+	return m.metricName
+}
+
+// must be called with the lock held
+func (m *metricBase) key(labelValues []string) (string, bool) {
+	Assertf(len(labelValues) == len(m.labelNames), "metric[%s] requires labels%v, but got %v", m.metricName, m.labelNames, labelValues)
+	k := strings.Join(labelValues, "\x00")
+	if _, ok := m.labels[k]; ok {
+		return k, false
+	}
+
+	m.labels[k] = labelValues
+	m.keys = append(m.keys, k)
+	return k, true
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func (m *metricBase) formatLabels(labelValues []string, extra ...string) string {
+	pairs := make([]string, 0)
+	for i, n := range m.labelNames {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, n, escapeLabelValue(labelValues[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type Counter struct {
+	metricBase
+	values map[string]float64
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	k, _ := c.key(labelValues)
+	c.values[k] += v
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.metricName, c.help, c.metricName)
+	for _, k := range c.keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.formatLabels(c.labels[k]), formatFloat(c.values[k]))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum float64
+	count uint64
+}
+
+type Histogram struct {
+	metricBase
+	buckets []float64
+	values map[string]*histogramValue
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	k, created := h.key(labelValues)
+	if created {
+		h.values[k] = &histogramValue{ counts: make([]uint64, len(h.buckets)) }
+	}
+
+	hv := h.values[k]
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// observe the seconds elapsed since the start time
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Now().Sub(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.metricName, h.help, h.metricName)
+	for _, k := range h.keys {
+		lv := h.labels[k]
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %v\n", h.metricName, h.formatLabels(lv, "le", formatFloat(b)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %v\n", h.metricName, h.formatLabels(lv, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.formatLabels(lv), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %v\n", h.metricName, h.formatLabels(lv), hv.count)
+	}
+}
+
+func register(m metric) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	for _, o := range metrics {
+		if o.name() == m.name() {
+			panic(fmt.Errorf("duplicate metric[%s]", m.name()))
+		}
+	}
+	metrics = append(metrics, m)
+}
+
+func newMetricBase(name, help string, labelNames []string) metricBase {
+	return metricBase{
+		metricName: name,
+		help: help,
+		labelNames: labelNames,
+		keys: make([]string, 0),
+		labels: make(map[string][]string),
+	}
+}
+
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{
+		metricBase: newMetricBase(name, help, labelNames),
+		values: make(map[string]float64),
+	}
+	register(c)
+	return c
+}
+
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	bs := make([]float64, len(buckets))
+	copy(bs, buckets)
+	sort.Float64s(bs)
+
+	h := &Histogram{
+		metricBase: newMetricBase(name, help, labelNames),
+		buckets: bs,
+		values: make(map[string]*histogramValue),
+	}
+	register(h)
+	return h
+}
+
+// write all metrics in the Prometheus text format
+func WriteMetrics(w io.Writer) {
+	metricsLock.Lock()
+	ms := make([]metric, len(metrics))
+	copy(ms, metrics)
+	metricsLock.Unlock()
+
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].name() < ms[j].name()
+	})
+
+	var buf bytes.Buffer
+	for _, m := range ms {
+		m.write(&buf)
+	}
+	w.Write(buf.Bytes())
+}
+
+var (
+	bashExecutions = NewCounter("zvr_shell_executions_total", "Number of shell commands executed")
+	bashFailures = NewCounter("zvr_shell_failures_total", "Number of shell commands failed or returned non-zero")
+)
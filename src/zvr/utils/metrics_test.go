@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	c := NewCounter("test_requests_total", "Number of test requests", "path")
+	c.Inc("/a")
+	c.Inc("/a")
+	c.Add(3, `/b"`)
+
+	h := NewHistogram("test_duration_seconds", "Test duration", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{path="/a"} 2`,
+		`test_requests_total{path="/b\""} 3`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{le="0.1"} 1`,
+		`test_duration_seconds_bucket{le="1"} 2`,
+		`test_duration_seconds_bucket{le="+Inf"} 3`,
+		"test_duration_seconds_sum 5.55",
+		"test_duration_seconds_count 3",
+	} {
+		Assert(strings.Contains(out, line+"\n"), line)
+	}
+}
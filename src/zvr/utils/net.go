@@ -108,19 +108,19 @@ func GetNicNameByMac(mac string) (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("cannot find any nic with the mac[%s]", mac)
+	return "", NewAgentError(NIC_NOT_FOUND, map[string]interface{}{ "mac": mac }, "cannot find any nic with the mac[%s]", mac)
 }
 
 func GetNicNameByIp(ip string) (string, error) {
 	bash := Bash{
-		Command: fmt.Sprintf("ip addr | grep -w %s", ip),
+		Command: fmt.Sprintf("ip addr | grep -w %s", ShellQuote(ip)),
 	}
 	ret, o, _, err := bash.RunWithReturn()
 	if err != nil {
 		return "", err
 	}
 	if ret != 0 {
-		return "", errors.New(fmt.Sprintf("no nic with the IP[%s] found in the system", ip))
+		return "", NewAgentError(NIC_NOT_FOUND, map[string]interface{}{ "ip": ip }, "no nic with the IP[%s] found in the system", ip)
 	}
 
 	o = strings.TrimSpace(o)
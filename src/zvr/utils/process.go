@@ -12,7 +12,7 @@ func FindPIDByPS(cmdline...string) (int, error) {
 
 	cmds := []string {"ps aux"}
 	for _, c := range cmdline {
-		cmds = append(cmds, fmt.Sprintf("grep '%s'", c))
+		cmds = append(cmds, fmt.Sprintf("grep %s", ShellQuote(c)))
 	}
 	cmds = append(cmds, "grep -v grep")
 	cmds = append(cmds, "awk '{print $2}'")
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HEADER_SIGNATURE = "signature"
+	HEADER_SIGNATURE_TIMESTAMP = "signaturetimestamp"
+)
+
+// the headers signed with the path, the timestamp and the body, in the
+// order signed. They tell where to reply and how to run the command, so
+// they can't be changed in the middle. An absent header is signed as empty
+var SIGNED_HEADERS = []string{ "callbackurl", "taskuuid", "dryrun", HEADER_TRIGGER_URL }
+
+// the HMAC-SHA256 in hex of
+//   path\ntimestamp\n
+//   header:value\n      for each of SIGNED_HEADERS, the name in lower case
+//   body
+func Sign(secret []byte, path, timestamp string, header http.Header, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	for _, h := range SIGNED_HEADERS {
+		mac.Write([]byte(fmt.Sprintf("%s:%s\n", strings.ToLower(h), header.Get(h))))
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifySignature(secret []byte, path, timestamp string, header http.Header, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, path, timestamp, header, body)), []byte(signature))
+}
+
+// add the signature headers for posting the body to the URL, the other headers must be set before
+func SignHttpHeaders(secret []byte, rawurl string, body []byte, headers map[string]string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("unable to sign the request to %s, %v", rawurl, err)
+	}
+
+	// as HttpPost sends them
+	header := http.Header{}
+	for k, v := range headers {
+		header.Add(k, v)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	headers[HEADER_SIGNATURE_TIMESTAMP] = timestamp
+	headers[HEADER_SIGNATURE] = Sign(secret, u.Path, timestamp, header, body)
+	return nil
+}
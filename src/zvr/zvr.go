@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"flag"
 	"os"
+	"io/ioutil"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
 )
 
 func loadPlugins()  {
@@ -24,6 +27,9 @@ func loadPlugins()  {
 
 var options server.Options
 
+// the config file the simulated vyos starts with, see server.SimulatedBackend
+var simulatedConfig string
+
 func abortOnWrongOption(msg string) {
 	fmt.Println(msg)
 	flag.Usage()
@@ -37,6 +43,16 @@ func parseCommandOptions() {
 	flag.UintVar(&options.ReadTimeout, "readtimeout", 10, "The socket read timeout")
 	flag.UintVar(&options.WriteTimeout, "writetimeout", 10, "The socket write timeout")
 	flag.StringVar(&options.LogFile, "logfile", "zvr.log", "The log file path")
+	flag.StringVar(&options.TlsCertFile, "tlscert", "", "The certificate file to serve HTTPS")
+	flag.StringVar(&options.TlsKeyFile, "tlskey", "", "The private key file of the certificate")
+	flag.StringVar(&options.TlsClientCaFile, "tlsclientca", "", "The CA file to verify client certificates, client certificates are required if set")
+	flag.StringVar(&options.CallbackCaFile, "callbackca", "", "The CA file to verify the mgmt server when sending async replies")
+	flag.StringVar(&options.CallbackCertFile, "callbackcert", "", "The client certificate file presented to the mgmt server")
+	flag.StringVar(&options.CallbackKeyFile, "callbackkey", "", "The private key file of the client certificate")
+	flag.UintVar(&options.AsyncWorkers, "asyncworkers", server.DEFAULT_ASYNC_WORKERS, "The number of async commands running at the same time")
+	flag.UintVar(&options.AsyncQueueSize, "asyncqueue", server.DEFAULT_ASYNC_QUEUE_SIZE, "The number of async commands waiting for a worker, more are rejected")
+	flag.UintVar(&options.ConfigCacheTTL, "configcachettl", server.DEFAULT_CONFIG_CACHE_TTL, "The seconds the parsed running config is cached, 0 disables the cache")
+	flag.StringVar(&simulatedConfig, "simulate", "", "The config file to start a simulated vyos with, the config is kept in memory and nothing is committed to vyos")
 
 	flag.Parse()
 
@@ -44,9 +60,47 @@ func parseCommandOptions() {
 		abortOnWrongOption("error: the options 'ip' is required")
 	}
 
+	if (options.TlsCertFile == "") != (options.TlsKeyFile == "") {
+		abortOnWrongOption("error: the options 'tlscert' and 'tlskey' must be set together")
+	}
+
+	if options.TlsClientCaFile != "" && options.TlsCertFile == "" {
+		abortOnWrongOption("error: the option 'tlsclientca' requires 'tlscert' and 'tlskey'")
+	}
+
+	if options.AsyncWorkers == 0 {
+		abortOnWrongOption("error: the option 'asyncworkers' must be greater than 0")
+	}
+
+	if (options.CallbackCertFile == "") != (options.CallbackKeyFile == "") {
+		abortOnWrongOption("error: the options 'callbackcert' and 'callbackkey' must be set together")
+	}
+
+	if err := utils.SetHttpTlsOptions(utils.HttpTlsOptions{
+		CaFile: options.CallbackCaFile,
+		CertFile: options.CallbackCertFile,
+		KeyFile: options.CallbackKeyFile,
+	}); err != nil {
+		abortOnWrongOption(fmt.Sprintf("error: %v", err))
+	}
+
 	server.SetOptions(options)
 }
 
+func useSimulatedVyos() {
+	if simulatedConfig == "" {
+		return
+	}
+
+	content, err := ioutil.ReadFile(simulatedConfig)
+	if err != nil {
+		abortOnWrongOption(fmt.Sprintf("error: unable to read the config file %s, %v", simulatedConfig, err))
+	}
+
+	log.Warnf("running in the simulation mode, the config is kept in memory")
+	server.SetBackend(server.NewSimulatedBackend(string(content)))
+}
+
 func configureZvrFirewall() {
 	tree := server.NewParserFromShowConfiguration().Tree
 
@@ -60,9 +114,42 @@ func configureZvrFirewall() {
 	tree.Apply(false)
 }
 
+// the secret shared with the mgmt server can be delivered in the bootstrap
+// info, and changed later by a signed /init command which saves it
+func loadAuthSecret() {
+	if secret := server.LoadSavedAuthSecret(); secret != "" {
+		log.Debugf("the request signing is enabled by the saved secret")
+		server.SetAuthSecret(secret)
+		return
+	}
+
+	if ok, _ := utils.PathExists(utils.BOOTSTRAP_INFO_CACHE); !ok {
+		return
+	}
+
+	content, err := ioutil.ReadFile(utils.BOOTSTRAP_INFO_CACHE)
+	if err != nil {
+		log.Warnf("unable to read %s, %v", utils.BOOTSTRAP_INFO_CACHE, err)
+		return
+	}
+
+	info := make(map[string]interface{})
+	if err = json.Unmarshal(content, &info); err != nil {
+		log.Warnf("unable to JSON parse %s, %v", utils.BOOTSTRAP_INFO_CACHE, err)
+		return
+	}
+
+	if secret, ok := info["agentSecret"].(string); ok && secret != "" {
+		log.Debugf("the request signing is enabled by the bootstrap info")
+		server.SetAuthSecret(secret)
+	}
+}
+
 func main()  {
 	parseCommandOptions()
 	utils.InitLog(options.LogFile, false)
+	loadAuthSecret()
+	useSimulatedVyos()
 	loadPlugins()
 	configureZvrFirewall()
 	server.Start()
@@ -15,7 +15,6 @@ import (
 
 const (
 	VIRTIO_PORT_PATH = "/dev/virtio-ports/applianceVm.vport"
-	BOOTSTRAP_INFO_CACHE = "/home/vyos/zvr/bootstrap-info.json"
 	TMP_LOCATION_FOR_ESX = "/tmp/bootstrap-info.json"
 )
 
@@ -76,17 +75,24 @@ func parseEsxBootInfo() {
 
 		content, err := ioutil.ReadFile(TMP_LOCATION_FOR_ESX); utils.PanicOnError(err)
 		if err = json.Unmarshal(content, &bootstrapInfo); err != nil {
-			panic(errors.Wrap(err, fmt.Sprintf("unable to JSON parse:\n %s", string(content))))
+			panic(errors.Wrap(err, "unable to JSON parse the bootstrap info"))
 		}
 
-		err = utils.MkdirForFile(BOOTSTRAP_INFO_CACHE, 0666); utils.PanicOnError(err)
-		err = os.Rename(TMP_LOCATION_FOR_ESX, BOOTSTRAP_INFO_CACHE); utils.PanicOnError(err)
-		err = os.Chmod(BOOTSTRAP_INFO_CACHE, 0777); utils.PanicOnError(err)
-		log.Debugf("recieved bootstrap info:\n%s", string(content))
+		err = utils.MkdirForFile(utils.BOOTSTRAP_INFO_CACHE, 0666); utils.PanicOnError(err)
+		err = os.Rename(TMP_LOCATION_FOR_ESX, utils.BOOTSTRAP_INFO_CACHE); utils.PanicOnError(err)
+		protectBootstrapInfo()
 		return true
 	}, time.Duration(300)*time.Second, time.Duration(1)*time.Second)
 }
 
+// the bootstrap info has the secrets, e.g. the agent secret, only zvr
+// running as user vyos reads it
+func protectBootstrapInfo() {
+	err := os.Chmod(utils.BOOTSTRAP_INFO_CACHE, 0600); utils.PanicOnError(err)
+	err = utils.ChownToUser(utils.BOOTSTRAP_INFO_CACHE, "vyos"); utils.PanicOnError(err)
+	log.Debugf("recieved bootstrap info, saved to %s", utils.BOOTSTRAP_INFO_CACHE)
+}
+
 func parseKvmBootInfo() {
 	utils.LoopRunUntilSuccessOrTimeout(func() bool {
 		content, err := ioutil.ReadFile(VIRTIO_PORT_PATH); utils.PanicOnError(err)
@@ -96,13 +102,12 @@ func parseKvmBootInfo() {
 		}
 
 		if err := json.Unmarshal(content, &bootstrapInfo); err != nil {
-			panic(errors.Wrap(err, fmt.Sprintf("unable to JSON parse:\n %s", string(content))))
+			panic(errors.Wrap(err, "unable to JSON parse the bootstrap info"))
 		}
 
-		err = utils.MkdirForFile(BOOTSTRAP_INFO_CACHE, 0666); utils.PanicOnError(err)
-		err = ioutil.WriteFile(BOOTSTRAP_INFO_CACHE, content, 0666); utils.PanicOnError(err)
-		err = os.Chmod(BOOTSTRAP_INFO_CACHE, 0777); utils.PanicOnError(err)
-		log.Debugf("recieved bootstrap info:\n%s", string(content))
+		err = utils.MkdirForFile(utils.BOOTSTRAP_INFO_CACHE, 0666); utils.PanicOnError(err)
+		err = ioutil.WriteFile(utils.BOOTSTRAP_INFO_CACHE, content, 0600); utils.PanicOnError(err)
+		protectBootstrapInfo()
 		return true
 	}, time.Duration(300)*time.Second, time.Duration(1)*time.Second)
 }